@@ -0,0 +1,81 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package main
+
+import (
+	"flag"
+	"os"
+
+	driver "github.com/IBM/power-openstack-k8s-volume-driver/pkg/driver"
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+	volume "github.com/IBM/power-openstack-k8s-volume-driver/pkg/volume"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	nodeID     = flag.String("nodeid", "", "The name of the Kubernetes node this driver is running on.")
+	endpoint   = flag.String("csi-address", resources.CSIDefaultEndpoint, "The CSI endpoint the driver will listen on.")
+	driverName = flag.String("drivername", resources.CSIDriverName, "The name of the CSI driver.")
+	prefix     = flag.String("prefix", "power-openstack-k8s", "The prefix to use for the name of the volumes and drivers.")
+	cloudName  = flag.String("cloud", "", "The cloud in clouds.yaml to use instead of the OS_CLOUD environment variable.")
+	clusterID  = flag.String("cluster-id", "", "The ID the volumes of this cluster are tagged with. Defaults to the UID of the kube-system namespace.")
+)
+
+func main() {
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+	resources.UpdateDriverPrefix(*prefix)
+	if *cloudName != "" {
+		os.Setenv(resources.OSCloud, *cloudName)
+	}
+
+	// Creates a new OpenStack Client and authenticates
+	cloud, err := utils.CreateOpenstackClient()
+	if err != nil {
+		glog.Fatalf("Failed to construct / authenticate OpenStack : %s", err)
+	}
+
+	d := driver.NewDriver(*driverName, *nodeID, *endpoint, cloud, utils.NewMounter())
+	// The cluster ID tells the volumes of this cluster apart from those of other clusters sharing the project
+	if *clusterID == "" {
+		*clusterID, err = defaultClusterID()
+		if err != nil {
+			glog.Warningf("Volumes will not be tagged with a cluster ID, and only untagged volumes can be deleted: %v", err)
+		}
+	}
+	glog.Infof("Tagging volumes with cluster ID %s", *clusterID)
+	d.ClusterID = *clusterID
+	glog.Infof("Starting CSI driver %s version %s", d.Name, d.Version)
+	if err := d.Run(); err != nil {
+		glog.Fatalf("CSI driver %s stopped: %v", d.Name, err)
+	}
+}
+
+// defaultClusterID : Returns the UID of the kube-system namespace of the cluster the driver runs in
+func defaultClusterID() (string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return "", err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+	return volume.DefaultClusterID(clientset)
+}
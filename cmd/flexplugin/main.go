@@ -25,7 +25,6 @@ import (
 
 	resources "github.com/IBM//power-openstack-k8s-volume-driver/pkg/resources"
 	utils "github.com/IBM//power-openstack-k8s-volume-driver/pkg/utils"
-	"github.com/nightlyone/lockfile"
 )
 
 // Map to hold the operation to its allowed operation params
@@ -37,6 +36,12 @@ var log = utils.Log
 // Reference to openstack
 var cloud utils.OpenstackCloudI
 
+// Mounts the volumes on the node
+var mounter = utils.NewMounter()
+
+// Returns the name of the node the plugin runs on
+var getNodeName = os.Hostname
+
 /********************** Driver operations ************************/
 
 // Implements <driver> init API
@@ -117,6 +122,10 @@ func attach(nodeName string, jsonArgs map[string]string) map[string]string {
 		return utils.ErrorStruct(fmt.Sprintf("Could not find volume with id %s. Error is %s", volumeID, err.Error()))
 	}
 
+	if err := utils.CheckVolumeAttachable(vmID, volume); err != nil {
+		return utils.ErrorStruct(fmt.Sprintf("Could not attach volume %s to VM %s. Error is %s", volumeID, vmID, err))
+	}
+
 	// Update volume metadata to store the volume name. This is required to identify the
 	// volume in detach API as in detach, only volume name is provided.
 	volumeMeta := make(map[string]string)
@@ -129,6 +138,16 @@ func attach(nodeName string, jsonArgs map[string]string) map[string]string {
 			"kubernetes volume name. Error is %s", volumeID, err.Error()))
 	}
 
+	// A retry of the kubelet finds the volume already attached, so return its path again
+	attached, err := utils.IsVolumeAttached(cloud, vmID, volumeID)
+	if err != nil {
+		return utils.ErrorStruct(fmt.Sprintf("Could not check if volume %s is attached to VM %s. Error is %s", volumeID, vmID, err))
+	}
+	if attached {
+		log.Infof("Volume %s is already attached to VM %s", volumeID, vmID)
+		return attachedDevicePath(nodeName, volumeID, volume)
+	}
+
 	// Attach volume to VM. Pass volume to avoid making the get volume call in the method again.
 	isSuccess, err := utils.AttachVolumeToVM(cloud, vmID, volumeID, volume)
 	if err != nil {
@@ -136,7 +155,11 @@ func attach(nodeName string, jsonArgs map[string]string) map[string]string {
 	} else if !isSuccess {
 		return utils.ErrorStruct(fmt.Sprintf("Could not attach volume %s to VM %s.", volumeID, vmID))
 	}
+	return attachedDevicePath(nodeName, volumeID, volume)
+}
 
+// attachedDevicePath : Returns the result of attach with the path where the attached volume shows up on the node
+func attachedDevicePath(nodeName string, volumeID string, volume *resources.OSVolume) map[string]string {
 	// Find the path of the directory where volume will show up on VM
 	volPath, err := utils.GetVolumeDirectoryName(cloud, utils.ResolveNodeAddress(nodeName), volumeID, volume)
 	if err != nil {
@@ -153,136 +176,140 @@ func attach(nodeName string, jsonArgs map[string]string) map[string]string {
 // Implements <driver> waitforattach device_path <json_params> API
 func waitForAttach(devicePath string, jsonArgs map[string]string) map[string]string {
 	log.Infof("\n waitForAttach called with %s %s", devicePath, jsonArgs)
-	var volPath string
-	var pID = os.Getpid()
 
 	// Get volume id from json params
 	volumeID := jsonArgs[resources.OsArgsVolID]
-	volPath = devicePath
-	lock, err := lockfile.New(filepath.Join(os.TempDir(), resources.ScsiScanLock))
+	// The device found is checked against the identifiers of the volume, the WWN of which only Cinder knows
+	volume, err := nodeVolume(volumeID)
+	if err != nil {
+		return utils.ErrorStruct(err.Error())
+	}
+	volDevicePath, err := utils.WaitForAttachedDevice(devicePath, volume, volumeConnection(volumeID))
 	if err != nil {
-		log.Debugf("%d : Cannot init lock. Reason : %v", pID, err)
-		return utils.ErrorStruct(fmt.Sprintf("Could not initialize lock file %s", err))
-	}
-	// Try to get the lock
-	for i := 0; i < resources.MaxAttemptsToTryLock; i++ {
-		err = lock.TryLock()
-		if err == nil {
-			break
+		reason := fmt.Sprintf("Could not find directory of attached volume with id %s. Error is %s", volumeID, err)
+		// Detach the volume rather than leave it in-use by a VM which can't see it
+		if err := rollbackAttach(volumeID, reason); err != nil {
+			log.Errorf("Could not roll back the attach of volume %s. Error is %s", volumeID, err)
+			return utils.ErrorStruct(fmt.Sprintf("%s. Could not roll back the attach. Error is %s", reason, err))
 		}
-		log.Debugf("%d : Could not get lock, error is %v . Sleeping for 5 secs..", pID, err)
-		time.Sleep(5 * time.Second)
-	}
-	log.Debugf("%d : Got hold of Scsiscan lock", pID)
-
-	// defer unlock to end of function call
-	defer lock.Unlock()
-
-	// Loop for max of 120 seconds to find the attached volume
-	for i := 0; i < resources.MaxAttemptsToFindVolume; i++ {
-		// Run scsi scan to discover the volume directory on VM
-		utils.ScsiHostScan()
-		// Sleep for a second before running udevadm
-		time.Sleep(1 * time.Second)
-		// Let udevd handle device events
-		err := utils.UdevdHandleEvents(volPath)
-		if err != nil {
-			log.Warningf("%d : There was error while at udevd. Error is %s", pID, err)
+		return utils.ErrorStruct(reason + ". The volume was detached from the node")
+	}
+	return map[string]string{
+		"status":     resources.ResultStatusSuccess,
+		"msg":        resources.ResultMsgOpSuccess,
+		"deviceName": volDevicePath,
+	}
+}
+
+// nodeVolume : Returns the volume being attached to the node, authenticating if the plugin hasn't yet
+func nodeVolume(volumeID string) (*resources.OSVolume, error) {
+	if cloud == nil {
+		if err := initCloud(); err != nil {
+			return nil, fmt.Errorf("Could not authenticate to get volume with id %s. Error is %s", volumeID, err)
 		}
-		// Sleep for 2 seconds for letting udevadm handle the events
-		time.Sleep(4 * time.Second)
-		// Check if directory is available now after scan
-		if fileInfo, err := os.Lstat(volPath); err == nil {
-			// Find the symbolic link to the file
-			if fileInfo.Mode() != 0&os.ModeSymlink {
-				volDevicePath := utils.FindAttachedVolumeDirectoryPath(volPath)
-				// If the file was link and we failed to read the link, return failed status
-				if volDevicePath == "" {
-					log.Errorf("%d : Error finding link %s", pID, err)
-					return utils.ErrorStruct(fmt.Sprintf("Could not find symbolic link of attached volume with id %s. Error is %s", volumeID, err))
-				}
-
-				log.Debugf("%d : Found directory of attached volume %s", pID, volDevicePath)
-				return map[string]string{
-					"status":     resources.ResultStatusSuccess,
-					"msg":        resources.ResultMsgOpSuccess,
-					"deviceName": volDevicePath,
-				}
-			}
-			break
+	}
+	volume, err := utils.GetOSVolumeByID(cloud, volumeID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find volume with id %s. Error is %s", volumeID, err)
+	}
+	return volume, nil
+}
+
+// volumeConnection : Returns the connection info of the volume on the VM of the node, so that only its LUN
+// has to be scanned, or nil if it can't be found
+func volumeConnection(volumeID string) *resources.VolumeConnection {
+	// Authenticating is still cheaper than scanning every host, and the node reuses the cached token
+	if cloud == nil {
+		if err := initCloud(); err != nil {
+			log.Warningf("Could not authenticate to get the connection info of volume %s. Error is %s", volumeID, err)
+			return nil
 		}
 	}
-	return utils.ErrorStruct(fmt.Sprintf("Could not find directory of attached volume with id %s", volumeID))
+	_, vmID, err := nodeVMID()
+	if err != nil {
+		log.Warningf("Could not get the connection info of volume %s. Error is %s", volumeID, err)
+		return nil
+	}
+	conn, err := utils.GetVolumeConnection(cloud, volumeID, vmID)
+	if err != nil {
+		log.Warningf("Could not get the connection info of volume %s. Error is %s", volumeID, err)
+		return nil
+	}
+	return conn
 }
 
-// Implements <driver> mountdevice mount_dir device_path <json_params> API
-func mountDevice(mountPath string, devicePath string, jsonArgs map[string]string) map[string]string {
-	log.Infof("\n mountDevice called with %s %s", mountPath, jsonArgs)
-	fsType := jsonArgs[resources.K8sArgFSType]
+// nodeVMID : Returns the address and the VM ID of the node the plugin runs on
+func nodeVMID() (string, string, error) {
+	hostname, err := getNodeName()
+	if err != nil {
+		return "", "", fmt.Errorf("Could not get the name of the node. Error is %s", err)
+	}
+	nodeAddr := utils.ResolveNodeAddress(hostname)
+	vmID, err := utils.GetVMID(cloud, nodeAddr)
+	if err != nil || vmID == "" {
+		return "", "", fmt.Errorf("Could not find VM of node %s, whose host name has to resolve to an address of "+
+			"its server in OpenStack. Error is %v", hostname, err)
+	}
+	return nodeAddr, vmID, nil
+}
 
-	// Determine if attached volume has FS already on it
-	hasFS, _ := utils.HasFSOnVolumeDevice(devicePath)
-	// We should create FS only if there is no FS installed on volume
-	if !hasFS {
-		// Create File system on directory of attached volume
-		if fsType == "" {
-			// Assume default
-			fsType = "ext4"
-		}
-		cmdStrs := []string{resources.CMDMkFS + fsType, devicePath}
-		// We want to force the filesystem create if the command has the option, but very few actually do
-		if strings.HasPrefix(fsType, "ext") || strings.HasPrefix(fsType, "ntfs") {
-			cmdStrs = append(cmdStrs, "-F")
+// rollbackAttach : Detaches the volume from the VM of the node and clears the volume name set by attach,
+// recording the reason in the volume metadata
+func rollbackAttach(volumeID string, reason string) error {
+	volume, err := nodeVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	_, vmID, err := nodeVMID()
+	if err != nil {
+		return err
+	}
+	log.Infof("Detaching volume %s from VM %s as its device never showed up", volumeID, vmID)
+	if isSuccess, err := utils.DetachVolumeFromVM(cloud, vmID, volumeID, *volume); err != nil {
+		return fmt.Errorf("Could not detach volume from VM with id %s. Error is %s", vmID, err)
+	} else if !isSuccess {
+		return fmt.Errorf("Could not detach volume from VM with id %s", vmID)
+	}
+
+	// The other VMs of a multi-attach volume still need the volume name to detach it
+	inUse := false
+	for _, attachment := range volume.Attachments {
+		if attachment.ServerID != "" && attachment.ServerID != vmID {
+			inUse = true
 		}
-		_, _, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
-		if err != nil {
-			log.Errorf("Could not create file system on attached volume directory %s. Error is %s", devicePath, err)
-			return utils.ErrorStruct(fmt.Sprintf("Could not create file system on attached volume directory %s. Error is %s", devicePath, err))
+	}
+	if !inUse {
+		volumeMeta := map[string]string{resources.OsK8sVolumeNameMeta: ""}
+		if err := utils.UpdateVolumeMetadata(cloud, volumeID, volumeMeta, true); err != nil {
+			return fmt.Errorf("Could not remove the kubernetes volume name from volume %s metadata. Error is %s", volumeID, err)
 		}
-		log.Debugf("Created %s file system at %s", fsType, devicePath)
 	}
-
-	// Create mount directory as specified by mountPath
-	cmdStrs := []string{resources.CMDMkDir, "-p", mountPath}
-	_, _, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
-	if err != nil {
-		log.Errorf("Could not create directory %s to mount attached volume", mountPath)
-		return utils.ErrorStruct(fmt.Sprintf("Could not create directory %s to mount attached volume. Error is %s", mountPath, err))
+	// Cinder metadata values are limited to 255 characters
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	volumeMeta := map[string]string{resources.OsK8sAttachErrorMeta: reason}
+	if err := utils.UpdateVolumeMetadata(cloud, volumeID, volumeMeta, false); err != nil {
+		log.Warningf("Could not record the attach error in volume %s metadata. Error is %s", volumeID, err)
 	}
-	log.Debugf("Created directory %s for mounting volume ", mountPath)
+	return nil
+}
+
+// Implements <driver> mountdevice mount_dir device_path <json_params> API
+func mountDevice(mountPath string, devicePath string, jsonArgs map[string]string) map[string]string {
+	log.Infof("\n mountDevice called with %s %s", mountPath, jsonArgs)
+	fsType := jsonArgs[resources.K8sArgFSType]
 
-	// Mount the volume at mount path
-	cmdStrs = []string{resources.CMDMount, devicePath, mountPath}
-	// If they asked to mount it as read-only, add in the -r option here
 	// Since the the kubernetes.io/readwrite argument isn't accurate currently,
 	// we will also look at our own flag for now until the other one is fixed
+	var options []string
 	if jsonArgs[resources.K8sArgMountRW] == "ro" || jsonArgs[resources.OsArgsMountRW] == "ro" {
-		cmdStrs = []string{resources.CMDMount, "-r", devicePath, mountPath}
+		options = append(options, "ro")
 	}
-	cmdOut, cmdErr, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
+	err := mounter.FormatAndMount(devicePath, mountPath, fsType, options)
 	if err != nil {
-		// Check if the flie system is bad
-		if (cmdOut != "" && strings.Contains(cmdOut, "bad superblock")) ||
-			(cmdErr != "" && strings.Contains(cmdErr, "bad superblock")) {
-			log.Debugf("Corrupted file system found. Creating file system again..")
-			cmdStrs := []string{resources.CMDMkFS + fsType, devicePath}
-			// We want to force the filesystem create if the command has the option, but very few actually do
-			if strings.HasPrefix(fsType, "ext") || strings.HasPrefix(fsType, "ntfs") {
-				cmdStrs = append(cmdStrs, "-F")
-			}
-			_, _, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
-			if err != nil {
-				// Still can not create.. return error
-				log.Errorf("Could not create file system on attached volume directory %s. Error is %s", devicePath, err)
-				return utils.ErrorStruct(fmt.Sprintf("Could not create file system on attached volume directory %s. Error is %s", devicePath, err))
-			}
-			log.Debugf("Created %s file system at %s", fsType, devicePath)
-		}
-		log.Errorf("Could not mount %s directory to mount path %s", devicePath, mountPath)
-		return utils.ErrorStruct(fmt.Sprintf("Could not mount %s directory to mount path %s. Error is %s", devicePath, mountPath, err))
+		return utils.ErrorStruct(err.Error())
 	}
-
-	log.Debugf("Mounted %s directory to mount path %s", devicePath, mountPath)
 	return map[string]string{
 		"status": resources.ResultStatusSuccess,
 		"msg":    resources.ResultMsgOpSuccess,
@@ -295,23 +322,10 @@ func mount(mountDir string, jsonArgs map[string]string) map[string]string {
 	volumeName := jsonArgs[resources.K8sArgPV]
 	volumeMountDir := resources.GlobalMountsDir + volumeName
 
-	// Create pod mount directory
-	cmdStrs := []string{resources.CMDMkDir, "-p", mountDir}
-	_, _, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
-	if err != nil {
-		log.Errorf("Could not create directory %s to mount attached volume", mountDir)
-		return utils.ErrorStruct(fmt.Sprintf("Could not create directory %s to mount attached volume. Error is %s", mountDir, err))
-	}
-
-	// Bind mount
-	cmdStrs = []string{resources.CMDMount, "--bind", volumeMountDir, mountDir}
-	_, _, err = utils.RunCommand(resources.CMDSudo, cmdStrs)
+	err := mounter.Mount(volumeMountDir, mountDir, "", []string{"bind"})
 	if err != nil {
-		log.Errorf("Could not bind mount %s on %s. Error is %s", volumeMountDir, mountDir, err)
-		return utils.ErrorStruct(fmt.Sprintf("Could not bind mount %s on %s. Error is %s", volumeMountDir, mountDir, err))
+		return utils.ErrorStruct(err.Error())
 	}
-
-	log.Debugf("Bind mounted %s %s", volumeMountDir, mountDir)
 	return map[string]string{
 		"status": resources.ResultStatusSuccess,
 		"msg":    resources.ResultMsgOpSuccess,
@@ -328,7 +342,14 @@ func detach(devicePath string, nodeName string) map[string]string {
 	// Retrieve volume id by querying its metadata for volumename
 	volumeMeta := map[string]string{resources.OsK8sVolumeNameMeta: devicePath}
 	vols, err := utils.GetVolumeByMetadataProperty(cloud, volumeMeta)
-	if err != nil {
+	if _, ok := err.(utils.VolumeMappingNotFoundError); ok {
+		// waitforattach detaches the volume and clears its name when its device never shows up
+		log.Infof("No volume has name %s, so it is detached already", devicePath)
+		return map[string]string{
+			"status": resources.ResultStatusSuccess,
+			"msg":    resources.ResultMsgOpSuccess,
+		}
+	} else if err != nil {
 		return utils.ErrorStruct(fmt.Sprintf("Could not find volume with name %s. Error is %s", devicePath, err))
 	}
 	if len(*vols) > 1 {
@@ -359,44 +380,69 @@ func detach(devicePath string, nodeName string) map[string]string {
 	}
 }
 
-// Implements <driver> waitfordetach device_path API
+// Implements <driver> waitfordetach device_path API. Kubernetes runs it on the node the volume is detached
+// from without naming the node, so the VM is the one of the host name of the node, and the node needs the
+// OpenStack configuration when it is given the volume name.
 func waitForDetach(devicePath string) map[string]string {
-	// Doesn't really gets called
 	log.Infof("\n waitfordetach called with %s", devicePath)
-	details := map[string]string{
+	// Like detach, this gets called with the volume name rather than the device path
+	volPath := devicePath
+	// The volume and then its devices are waited for, within one deadline
+	deadline := time.Now().Add(resources.WaitForDetachTimeout)
+	if !strings.HasPrefix(devicePath, "/") {
+		if cloud == nil {
+			if err := initCloud(); err != nil {
+				return utils.ErrorStruct(fmt.Sprintf("Could not authenticate with Openstack to wait for volume %s to be detached. "+
+					"The node needs the OpenStack configuration of the plugin. Error is %s", devicePath, err))
+			}
+		}
+		volumeMeta := map[string]string{resources.OsK8sVolumeNameMeta: devicePath}
+		vols, err := utils.GetVolumeByMetadataProperty(cloud, volumeMeta)
+		if _, ok := err.(utils.VolumeMappingNotFoundError); ok {
+			// Like in detach, the attachment of the volume was rolled back
+			log.Infof("No volume has name %s, so it is detached already", devicePath)
+			return map[string]string{
+				"status": resources.ResultStatusSuccess,
+				"msg":    resources.ResultMsgOpSuccess,
+			}
+		} else if err != nil || len(*vols) == 0 {
+			return utils.ErrorStruct(fmt.Sprintf("Could not find volume with name %s. Error is %v", devicePath, err))
+		}
+		if len(*vols) > 1 {
+			log.Errorf("Found more than one volume with volume name %s set in metadata.", devicePath)
+			return utils.ErrorStruct(fmt.Sprintf("Found more than one volume with volume name %s set in metadata.", devicePath))
+		}
+		volume := (*vols)[0]
+		nodeAddr, vmID, err := nodeVMID()
+		if err != nil {
+			return utils.ErrorStruct(err.Error())
+		}
+		if err := utils.WaitForVolumeDetached(cloud, vmID, volume.ID, &volume, deadline); err != nil {
+			return utils.ErrorStruct(err.Error())
+		}
+		volPath, err = utils.GetVolumeDirectoryName(cloud, nodeAddr, volume.ID, &volume)
+		if err != nil {
+			return utils.ErrorStruct(fmt.Sprintf("Could not determine volume directory name. Error is %s", err))
+		}
+	}
+	// The SCSI devices and multipath map go away once the node notices the volume is gone
+	if volPath != "" {
+		if err := utils.WaitForDetachedDevice(volPath, deadline); err != nil {
+			return utils.ErrorStruct(err.Error())
+		}
+	}
+	return map[string]string{
 		"status": resources.ResultStatusSuccess,
 		"msg":    resources.ResultMsgOpSuccess,
 	}
-	return details
 }
 
 // Implements <driver> unmount_device mount_dir API
 func unmountDevice(mountPath string) map[string]string {
 	log.Infof("\n unmountDevice called with %s", mountPath)
-	// First, find out all the block devices and multipath devices
-	// which are associated with this mount directory
-	var dmParent string
-	var devices []string
-	devicePath, _ := utils.GetDeviceOfMount(mountPath)
-	if devicePath != "" {
-		dmParent, devices, _ = utils.GetAssociatedBlockDevices(devicePath)
-	}
-	// Now unmount the directory from the device
-	cmdStrs := []string{resources.CMDUnmount, mountPath}
-	_, _, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
+	err := utils.UnmountDevice(mounter, mountPath)
 	if err != nil {
-		log.Errorf("Could not unmount volume directory %s. Error is %s", mountPath, err)
-		return utils.ErrorStruct(fmt.Sprintf("Could not unmount volume directory %s. Error is %s", mountPath, err))
-	}
-	// Now that directory is unmounted, remove the block device which was associated with the mountPath
-	if devices != nil && len(devices) >= 1 {
-		for _, device := range devices {
-			utils.DeleteScsiDevice(device)
-		}
-	}
-	// Clear out the multipath entry too as part of device cleanup
-	if dmParent != "" {
-		utils.RemoveMultipathForDevice(devicePath)
+		return utils.ErrorStruct(err.Error())
 	}
 	// Return finally with success message
 	details := map[string]string{
@@ -409,11 +455,9 @@ func unmountDevice(mountPath string) map[string]string {
 // Implements <driver> unmount mount_dir API
 func unmount(mountDir string) map[string]string {
 	log.Infof("\n unmount called with %s", mountDir)
-	cmdStrs := []string{resources.CMDUnmount, mountDir}
-	_, _, err := utils.RunCommand(resources.CMDSudo, cmdStrs)
+	err := mounter.Unmount(mountDir)
 	if err != nil {
-		log.Errorf("Could not unmount volume directory %s. Error is %s", mountDir, err)
-		return utils.ErrorStruct(fmt.Sprintf("Could not unmount volume directory %s. Error is %s", mountDir, err))
+		return utils.ErrorStruct(err.Error())
 	}
 	details := map[string]string{
 		"status": resources.ResultStatusSuccess,
@@ -426,7 +470,8 @@ func unmount(mountDir string) map[string]string {
 
 func initCloud() error {
 	var err error
-	cloud, err = utils.CreateOpenstackClient()
+	// The plugin runs for every operation, so it reuses the token of the earlier runs on the node
+	cloud, err = utils.CreateOpenstackClientWithTokenCache(resources.TokenCacheFile)
 	if err != nil {
 		return err
 	}
@@ -438,7 +483,8 @@ func createRespMsg(opType string, args []string) resources.Response {
 	var resp resources.Response
 	var details map[string]string
 
-	// Initialize openstack provider for attach/detach operations. Needed only on controller.
+	// Initialize openstack provider for attach/detach operations. Needed only on controller, the node
+	// operations authenticate when they need to.
 	if opType == resources.OpAttach || opType == resources.OpDetach || opType == resources.OpIsAttached {
 		err := initCloud()
 		if err != nil {
@@ -16,9 +16,7 @@ package main
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
-	"strconv"
+	"strings"
 	"testing"
 
 	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
@@ -73,6 +71,57 @@ func TestAttach(t *testing.T) {
 	}
 }
 
+func TestAttachNovaError(t *testing.T) {
+	cloud = &utils.OpenstackCloudMock{AttachedErr: fmt.Errorf("nova is unavailable")}
+	jsonArgs := utils.GetJSONArgs(getVolumeByNameJSONArgs)
+	result := attach("1.2.3.4", jsonArgs)
+	if result["status"] != resources.ResultStatusFailed {
+		t.Errorf("Expected attach to fail when the attachments can't be listed, but got %v", result)
+	}
+}
+
+func TestAttachToAnotherVM(t *testing.T) {
+	cloud = &utils.OpenstackCloudMock{}
+	// vol_2 is attached to vm_2 and isn't multi-attach
+	jsonArgs := map[string]string{resources.OsArgsVolID: "vol_2", resources.K8sArgPV: "vol_2"}
+	result := attach("1.2.3.4", jsonArgs)
+	if result["status"] != resources.ResultStatusFailed {
+		t.Errorf("Expected attach of a volume attached to another VM to fail")
+	} else if !strings.Contains(result["msg"], "vm_2") {
+		t.Errorf("Expected the error to name the VM the volume is attached to, but got %s", result["msg"])
+	}
+}
+
+func TestRollbackAttach(t *testing.T) {
+	cloud = &utils.OpenstackCloudMock{}
+	getNodeName = func() (string, error) { return "1.2.3.4", nil }
+	if err := rollbackAttach("vol_1", "device not found"); err != nil {
+		t.Errorf("Expected the attach to be rolled back, but got %s", err)
+	}
+	// There is no VM to detach the volume from
+	getNodeName = func() (string, error) { return "1.2.3.9", nil }
+	if err := rollbackAttach("vol_1", "device not found"); err == nil {
+		t.Errorf("Expected the rollback to fail on a node without VM")
+	}
+}
+
+func TestDetachAfterRollback(t *testing.T) {
+	cloud = &utils.OpenstackCloudMock{}
+	getNodeName = func() (string, error) { return "1.2.3.4", nil }
+	if err := rollbackAttach("vol_1", "device not found"); err != nil {
+		t.Fatalf("Expected the attach to be rolled back, but got %s", err)
+	}
+	// The controller still thinks the volume is attached and detaches it by its name
+	result := detach("vol_1", "1.2.3.4")
+	if result["status"] != resources.ResultStatusSuccess {
+		t.Errorf("Expected detach of the rolled back volume to be successful, but got %s", result["msg"])
+	}
+	result = waitForDetach("vol_1")
+	if result["status"] != resources.ResultStatusSuccess {
+		t.Errorf("Expected waitfordetach of the rolled back volume to be successful, but got %s", result["msg"])
+	}
+}
+
 func TestDetach(t *testing.T) {
 	cloud = &utils.OpenstackCloudMock{}
 	nodeName := "1.2.3.4"
@@ -82,31 +131,56 @@ func TestDetach(t *testing.T) {
 	}
 }
 
+func TestWaitForDetach(t *testing.T) {
+	cloud = &utils.OpenstackCloudMock{}
+	getNodeName = func() (string, error) { return "1.2.3.4", nil }
+	// vol_2 is only attached to another VM
+	result := waitForDetach("vol_2")
+	if result["status"] != resources.ResultStatusSuccess {
+		t.Errorf("Expected waitfordetach to be successful, but got %s", result["msg"])
+	}
+	// The device path is only checked on the node
+	result = waitForDetach(resources.PathPVMVIOS + "wwn_missing")
+	if result["status"] != resources.ResultStatusSuccess {
+		t.Errorf("Expected waitfordetach to be successful, but got %s", result["msg"])
+	}
+
+	getNodeName = func() (string, error) { return "", fmt.Errorf("no hostname") }
+	result = waitForDetach("vol_2")
+	if result["status"] != resources.ResultStatusFailed {
+		t.Errorf("Expected waitfordetach to fail without the node name, but got %s", result["msg"])
+	}
+	// The host name of the node has to be the one of its VM
+	getNodeName = func() (string, error) { return "1.2.3.9", nil }
+	result = waitForDetach("vol_2")
+	if result["status"] != resources.ResultStatusFailed || !strings.Contains(result["msg"], "host name") {
+		t.Errorf("Expected waitfordetach to fail on a node without VM, but got %s", result["msg"])
+	}
+	// Waiting for the device doesn't need OpenStack
+	cloud = nil
+	result = waitForDetach(resources.PathPVMVIOS + "wwn_missing")
+	if result["status"] != resources.ResultStatusSuccess {
+		t.Errorf("Expected waitfordetach of a device path to be successful without OpenStack, but got %s", result["msg"])
+	}
+}
+
 func TestMountDevice(t *testing.T) {
-	utils.ExecCommand = fakeExecCommand
-	cmdExitStatus = 0
-	cmdsExecuted = []string{}
+	fakeMounter := utils.NewFakeMounter()
+	mounter = fakeMounter
 	devicePath := "dev/sdd"
 	mountPath := "/kubelet/mount/vol_1"
 	result := mountDevice(mountPath, devicePath, utils.GetJSONArgs(getVolumeByNameJSONArgs))
 	if result["status"] != resources.ResultStatusSuccess {
 		t.Errorf("Expected mountdevice to be successful, but got %s", result["msg"])
 	}
-	expectedCmdsRun := []string{
-		resources.CMDLsBlk, devicePath, "--noheadings", "-o", "FSTYPE", "-f",
-		resources.CMDMkFS + "ext4", devicePath, "-F",
-		resources.CMDMkDir, "-p", mountPath,
-		resources.CMDMount, devicePath, mountPath,
-	}
-	for i, c := range expectedCmdsRun {
-		if c != cmdsExecuted[i] {
-			t.Errorf("Expected %s to run", cmdsExecuted[i])
-		}
+	if fakeMounter.FileSystems[devicePath] != "ext4" || fakeMounter.MountPoints[mountPath] != devicePath {
+		t.Errorf("Expected %s to be formatted and mounted at %s, but got %s", devicePath, mountPath, fakeMounter.Actions)
 	}
 
 	// Test negative path
-	cmdExitStatus = -1
-	cmdsExecuted = []string{}
+	fakeMounter = utils.NewFakeMounter()
+	fakeMounter.Err = fmt.Errorf("mount failed")
+	mounter = fakeMounter
 	result = mountDevice(mountPath, devicePath, utils.GetJSONArgs(getVolumeByNameJSONArgs))
 	if result["status"] != resources.ResultStatusFailed {
 		t.Errorf("Expected mountdevice to fail, but got %s", result["msg"])
@@ -114,53 +188,41 @@ func TestMountDevice(t *testing.T) {
 }
 
 func TestMount(t *testing.T) {
-	utils.ExecCommand = fakeExecCommand
-	cmdExitStatus = 0
-	cmdsExecuted = []string{}
+	fakeMounter := utils.NewFakeMounter()
+	mounter = fakeMounter
 	mountDir := "/kubelet/mount"
 	volumeMountDir := resources.GlobalMountsDir + "vol_1"
 	result := mount(mountDir, utils.GetJSONArgs(getVolumeByNameJSONArgs))
 	if result["status"] != resources.ResultStatusSuccess {
-		t.Errorf("Expected mountdevice to be successful, but got %s", result["msg"])
+		t.Errorf("Expected mount to be successful, but got %s", result["msg"])
 	}
-	expectedCmdsRun := []string{resources.CMDMkDir, "-p", mountDir,
-		resources.CMDMount, "--bind", volumeMountDir, mountDir}
-	for i, c := range expectedCmdsRun {
-		if c != cmdsExecuted[i] {
-			t.Errorf("Expected %s to run", cmdsExecuted[i])
-		}
+	options := fakeMounter.Options[mountDir]
+	if fakeMounter.MountPoints[mountDir] != volumeMountDir || len(options) != 1 || options[0] != "bind" {
+		t.Errorf("Expected %s to be bind mounted at %s, but got %s", volumeMountDir, mountDir, fakeMounter.Actions)
 	}
 
 	// Test negative path
-	cmdsExecuted = []string{}
-	cmdExitStatus = -1
+	fakeMounter.Err = fmt.Errorf("mount failed")
 	result = mount(mountDir, utils.GetJSONArgs(getVolumeByNameJSONArgs))
 	if result["status"] != resources.ResultStatusFailed {
-		t.Errorf("Expected mountdevice to fail, but got %s", result["msg"])
+		t.Errorf("Expected mount to fail, but got %s", result["msg"])
 	}
 }
 
 func TestUnmountDevice(t *testing.T) {
-	utils.ExecCommand = fakeExecCommand
-	cmdExitStatus = 0
-	mountPath := "/dev/sdd"
-	cmdsExecuted = []string{}
+	fakeMounter := utils.NewFakeMounter()
+	mounter = fakeMounter
+	mountPath := "/kubelet/mount/vol_1"
+	fakeMounter.MountPoints[mountPath] = "dev/sdd"
 	result := unmountDevice(mountPath)
 	if result["status"] != resources.ResultStatusSuccess {
 		t.Errorf("Expected unmountdevice to be successful, but got %s", result["msg"])
 	}
-	expectedCmdsRun := []string{
-		resources.CMDMount, "-w", mountPath,
-		resources.CMDUnmount, mountPath}
-	for i, c := range expectedCmdsRun {
-		if c != cmdsExecuted[i] {
-			t.Errorf("Expected %s to run", cmdsExecuted[i])
-		}
+	if _, ok := fakeMounter.MountPoints[mountPath]; ok {
+		t.Errorf("Expected %s to be unmounted, but got %s", mountPath, fakeMounter.Actions)
 	}
 
 	// Test negative path
-	cmdsExecuted = []string{}
-	cmdExitStatus = -1
 	result = unmountDevice(mountPath)
 	if result["status"] != resources.ResultStatusFailed {
 		t.Errorf("Expected unmountdevice to fail, but got %s", result["msg"])
@@ -168,53 +230,22 @@ func TestUnmountDevice(t *testing.T) {
 }
 
 func TestUnmount(t *testing.T) {
-	utils.ExecCommand = fakeExecCommand
-	cmdExitStatus = 0
-	cmdsExecuted = []string{}
+	fakeMounter := utils.NewFakeMounter()
+	mounter = fakeMounter
 	mountDir := "/kubelet/mount"
+	fakeMounter.MountPoints[mountDir] = resources.GlobalMountsDir + "vol_1"
 	result := unmount(mountDir)
 	if result["status"] != resources.ResultStatusSuccess {
-		t.Errorf("Expected mountdevice to be successful, but got %s", result["msg"])
+		t.Errorf("Expected unmount to be successful, but got %s", result["msg"])
 	}
-	t.Logf("The commands executed are %s", cmdsExecuted)
-	expectedCmdsRun := []string{resources.CMDUnmount, mountDir}
-	for i, c := range expectedCmdsRun {
-		if c != cmdsExecuted[i] {
-			t.Errorf("Expected %s to run", cmdsExecuted[i])
-		}
+	if _, ok := fakeMounter.MountPoints[mountDir]; ok {
+		t.Errorf("Expected %s to be unmounted, but got %s", mountDir, fakeMounter.Actions)
 	}
 
 	// Test negative path
-	cmdsExecuted = []string{}
-	cmdExitStatus = -1
+	fakeMounter.Err = fmt.Errorf("unmount failed")
 	result = unmount(mountDir)
 	if result["status"] != resources.ResultStatusFailed {
-		t.Errorf("Expected mountdevice to fail, but got %s", result["msg"])
-	}
-}
-
-/*********************** OS commands mocking *****************/
-
-var cmdRunResult = ""
-var cmdExitStatus = 0
-var cmdsExecuted = []string{}
-
-func fakeExecCommand(command string, args ...string) *exec.Cmd {
-	cs := []string{"-test.run=TestHelperProcess", "--", command}
-	cs = append(cs, args...)
-	// Save the command being executed
-	cmdsExecuted = append(cmdsExecuted, args...)
-	cmd := exec.Command(os.Args[0], cs...)
-	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "GO_CMD_RESULT_STATUS=" + strconv.Itoa(cmdExitStatus)}
-	return cmd
-}
-
-func TestHelperProcess(t *testing.T) {
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-		return
+		t.Errorf("Expected unmount to fail, but got %s", result["msg"])
 	}
-	// some code here to check arguments perhaps?
-	fmt.Fprintf(os.Stdout, cmdRunResult)
-	exitStatus, _ := strconv.Atoi(os.Getenv("GO_CMD_RESULT_STATUS"))
-	os.Exit(exitStatus)
 }
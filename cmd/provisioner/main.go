@@ -16,26 +16,45 @@ package main
 
 import (
 	"flag"
+	"net/http"
+	"os"
+	"time"
 
 	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
 	volume "github.com/IBM/power-openstack-k8s-volume-driver/pkg/volume"
 
 	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
-	prefix = flag.String("prefix", "power-openstack-k8", "The prefix to use for the name of the volume provisioner.")
+	prefix            = flag.String("prefix", "power-openstack-k8", "The prefix to use for the name of the volume provisioner.")
+	reconcileInterval = flag.Duration("reconcile-interval", 10*time.Minute, "How often to look for orphaned Cinder volumes and PVs. 0 disables the reconciler.")
+	orphanGracePeriod = flag.Duration("orphan-grace-period", 24*time.Hour, "How long a volume or PV has to stay orphaned before it is deleted.")
+	deleteOrphans     = flag.Bool("delete-orphans", false, "Delete orphaned Cinder volumes and PVs after the grace period instead of only reporting them.")
+	metricsAddress    = flag.String("metrics-address", ":8080", "The address to serve the Prometheus metrics on. Empty disables the metrics.")
+	clusterID         = flag.String("cluster-id", "", "The ID the volumes of this cluster are tagged with. Defaults to the UID of the kube-system namespace.")
+	cloudName         = flag.String("cloud", "", "The cloud in clouds.yaml to use instead of the OS_CLOUD environment variable.")
 )
 
 func main() {
 	flag.Parse()
 	flag.Set("logtostderr", "true")
 	resources.UpdateDriverPrefix(*prefix)
+	if *cloudName != "" {
+		os.Setenv(resources.OSCloud, *cloudName)
+	}
 
 	glog.Info("Building kubeconfig for running in cluster")
 	config, err := rest.InClusterConfig()
@@ -55,12 +74,30 @@ func main() {
 		glog.Fatalf("Error getting server version: %v", err)
 	}
 
+	// The cluster ID tells the volumes of this cluster apart from those of other clusters sharing the project
+	if *clusterID == "" {
+		*clusterID, err = volume.DefaultClusterID(clientset)
+		if err != nil {
+			glog.Fatalf("Error getting the cluster ID: %v", err)
+		}
+	}
+	glog.Infof("Tagging volumes with cluster ID %s", *clusterID)
+
+	// The provisioner and the reconciler share one re-authenticating OpenStack client per set of credentials
+	clients := utils.NewClientCache()
 	// Create the provisioner that implements the provisoner interface expected by the controller
-	openstackProvisioner, err := volume.NewOpenstackProvisioner(clientset, resources.ProvisionerName)
+	openstackProvisioner, err := volume.NewOpenstackProvisioner(clientset, resources.ProvisionerName, *clusterID, clients)
 	if err != nil {
 		glog.Fatalf("Error creating the %s provisioner: %v", resources.ProvisionerName, err)
 	}
 
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+	if *reconcileInterval > 0 {
+		go startReconciler(clientset, clients)
+	}
+
 	// Start the provisioner controller, which dynamically provisions the PersistentVolumes
 	pc := controller.NewProvisionController(
 		clientset,
@@ -71,3 +108,26 @@ func main() {
 	glog.Infof("New provision controller started for %s", resources.ProvisionerName)
 	pc.Run(wait.NeverStop)
 }
+
+// serveMetrics : Serves the Prometheus metrics of the provisioner
+func serveMetrics(address string) {
+	http.Handle("/metrics", promhttp.Handler())
+	glog.Infof("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		glog.Errorf("Failed to serve metrics on %s: %v", address, err)
+	}
+}
+
+// startReconciler : Runs the reconciler which reports and cleans up orphaned volumes and PVs
+func startReconciler(clientset kubernetes.Interface, clients *utils.ClientCache) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedv1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: resources.ProvisionerNameOnly})
+
+	newCinderClient := func() (*gophercloud.ServiceClient, error) {
+		return clients.GetCinderClient(nil)
+	}
+	reconciler := volume.NewReconciler(*clusterID, clientset, newCinderClient, recorder, *orphanGracePeriod, *deleteOrphans)
+	reconciler.Run(*reconcileInterval, wait.NeverStop)
+}
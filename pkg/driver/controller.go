@@ -0,0 +1,660 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+	volume "github.com/IBM/power-openstack-k8s-volume-driver/pkg/volume"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/kubernetes-incubator/external-storage/lib/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type controllerServer struct {
+	driver *Driver
+}
+
+// The access modes that a Cinder volume can be attached with
+var supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// CreateVolume : Creates the Cinder volume, reusing the volume if one was already created with the same name
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume name is missing in the request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities are missing in the request")
+	}
+	if err := validateCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	opts, err := parseCreateParameters(req)
+	if err != nil {
+		return nil, err
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if err := applyContentSource(cloud, req, &opts); err != nil {
+		return nil, err
+	}
+
+	cinderClient, err := cloud.NewVolumeV3()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not get cinder client. Error is %s", err)
+	}
+
+	// The CO may retry the create if it timed out, so we need to hand back the volume we already created
+	existing, err := volume.FindVolume(cinderClient, opts.Name, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not look up volume %s. Error is %s", opts.Name, err)
+	}
+	if existing != nil {
+		// Never hand back a volume another cluster sharing the project created for itself
+		if err := volume.CheckOwnership(existing, cs.driver.ClusterID, req.GetParameters()[resources.CSIParamPVName]); err != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume %s already exists. Error is %s", opts.Name, err)
+		}
+		if existing.Size != opts.Size || existing.SnapshotID != opts.SnapshotID || existing.SourceVolID != opts.SourceVolID {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume %s already exists with size %dGB", opts.Name, existing.Size)
+		}
+		glog.Infof("Volume %s already exists with id %s", opts.Name, existing.ID)
+		return createVolumeResponse(existing), nil
+	}
+
+	// Tag the volume like the provisioner does, so that it is never deleted by another cluster
+	params := req.GetParameters()
+	opts.Metadata = volume.OwnershipMetadata(cs.driver.ClusterID, cs.driver.Name,
+		params[resources.CSIParamPVName], params[resources.CSIParamPVCNamespace], params[resources.CSIParamPVCName])
+	vol, err := volume.CreateVolume(cinderClient, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create volume %s. Error is %s", opts.Name, err)
+	}
+	return createVolumeResponse(vol), nil
+}
+
+// DeleteVolume : Deletes the Cinder volume, treating a volume that no longer exists as deleted
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is missing in the request")
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	cinderClient, err := cloud.NewVolumeV3()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not get cinder client. Error is %s", err)
+	}
+	// Several clusters may share the project, so make sure the volume is really ours to delete
+	vol, err := volumes.Get(cinderClient, volumeID).Extract()
+	if err != nil {
+		if utils.IsNotFoundError(err) {
+			glog.Infof("Volume %s is already deleted", volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "Could not get volume with id %s. Error is %s", volumeID, err)
+	}
+	// The CO only gives the volume ID, so only the cluster is checked
+	if err := volume.CheckOwnership(vol, cs.driver.ClusterID, ""); err != nil {
+		glog.Errorf("Refusing to delete volume %s: %s", volumeID, err)
+		return nil, status.Errorf(codes.FailedPrecondition, "Could not delete volume %s. Error is %s", volumeID, err)
+	}
+
+	glog.Infof("Deleting volume %s", volumeID)
+	err = volumes.Delete(cinderClient, volumeID, volumes.DeleteOpts{}).ExtractErr()
+	if err != nil && !utils.IsNotFoundError(err) {
+		return nil, status.Errorf(codes.Internal, "Could not delete volume %s. Error is %s", volumeID, err)
+	}
+	glog.Infof("Volume %s deleted", volumeID)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume : Attaches the volume to the VM of the given node
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID, nodeID := req.GetVolumeId(), req.GetNodeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is missing in the request")
+	}
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID is missing in the request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is missing in the request")
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	vmID, err := utils.GetVMID(cloud, nodeID)
+	if err != nil || vmID == "" {
+		return nil, status.Errorf(codes.NotFound, "Could not find VM for node %s. Error is %v", nodeID, err)
+	}
+	vol, err := utils.GetOSVolumeByID(cloud, volumeID)
+	if err != nil {
+		if utils.IsNotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "Could not find volume with id %s", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not get volume with id %s. Error is %s", volumeID, err)
+	}
+
+	attached, err := utils.IsVolumeAttached(cloud, vmID, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if volume %s is attached to VM %s. Error is %s", volumeID, vmID, err)
+	}
+	if attached {
+		glog.Infof("Volume %s is already attached to VM %s", volumeID, vmID)
+	} else {
+		if err := utils.CheckVolumeAttachable(vmID, vol); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "Could not attach volume %s to VM %s. Error is %s", volumeID, vmID, err)
+		}
+		isSuccess, err := utils.AttachVolumeToVM(cloud, vmID, volumeID, vol)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not attach volume %s to VM %s. Error is %s", volumeID, vmID, err)
+		} else if !isSuccess {
+			return nil, status.Errorf(codes.Internal, "Could not attach volume %s to VM %s.", volumeID, vmID)
+		}
+	}
+
+	// Find the path of the directory where volume will show up on VM
+	volPath, err := utils.GetVolumeDirectoryName(cloud, utils.ResolveNodeAddress(nodeID), volumeID, vol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine volume directory name. Error is %s", err)
+	}
+	glog.Infof("Volume %s attached to VM %s with expected device path %s", volumeID, vmID, volPath)
+	publishContext := map[string]string{resources.DevicePath: volPath}
+	// The node checks that the device it finds is the volume, by its WWN on most storage
+	if wwn := vol.Metadata["volume_wwn"]; wwn != "" {
+		publishContext[resources.VolumeWWN] = wwn
+	}
+	// The node can scan only the LUN of the volume with the connection info, or else it scans every host
+	if conn, err := utils.GetVolumeConnection(cloud, volumeID, vmID); err != nil {
+		glog.Warningf("Could not get the connection info of volume %s on VM %s. Error is %s", volumeID, vmID, err)
+	} else {
+		utils.AddVolumeConnection(publishContext, conn)
+	}
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+}
+
+// ControllerUnpublishVolume : Detaches the volume from the VM of the given node
+func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeID, nodeID := req.GetVolumeId(), req.GetNodeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is missing in the request")
+	}
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID is missing in the request")
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	vmID, err := utils.GetVMID(cloud, nodeID)
+	if err != nil || vmID == "" {
+		return nil, status.Errorf(codes.NotFound, "Could not find VM for node %s. Error is %v", nodeID, err)
+	}
+	vol, err := utils.GetOSVolumeByID(cloud, volumeID)
+	if err != nil {
+		// If the volume is gone then so is the attachment
+		if utils.IsNotFoundError(err) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "Could not get volume with id %s. Error is %s", volumeID, err)
+	}
+
+	attached, err := utils.IsVolumeAttached(cloud, vmID, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if volume %s is attached to VM %s. Error is %s", volumeID, vmID, err)
+	}
+	if !attached {
+		glog.Infof("Volume %s is not attached to VM %s", volumeID, vmID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	isSuccess, err := utils.DetachVolumeFromVM(cloud, vmID, volumeID, *vol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not detach volume %s from VM %s. Error is %s", volumeID, vmID, err)
+	} else if !isSuccess {
+		return nil, status.Errorf(codes.Internal, "Could not detach volume %s from VM %s.", volumeID, vmID)
+	}
+	glog.Infof("Volume %s detached from VM %s", volumeID, vmID)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities : Confirms the capabilities if the volume exists and all of them are supported
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is missing in the request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities are missing in the request")
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := utils.GetOSVolumeByID(cloud, volumeID); err != nil {
+		if utils.IsNotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "Could not find volume with id %s", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not get volume with id %s. Error is %s", volumeID, err)
+	}
+	if err := validateCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// ControllerGetCapabilities : Returns the controller operations this driver supports
+func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	var caps []*csi.ControllerServiceCapability
+	for _, capType := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	} {
+		caps = append(caps, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: capType},
+			},
+		})
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// ListVolumes : Not supported
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ListVolumes is not supported")
+}
+
+// GetCapacity : Not supported
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported")
+}
+
+// CreateSnapshot : Takes a Cinder snapshot of the volume, reusing the snapshot if one was already taken with the same name
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	name, volumeID := req.GetName(), req.GetSourceVolumeId()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name is missing in the request")
+	}
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID is missing in the request")
+	}
+	for key := range req.GetParameters() {
+		if !strings.HasPrefix(key, resources.CSIParamPrefix) {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot options unknown parameter passed in: %s", key)
+		}
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	// The CO may retry the create if it timed out, so we need to hand back the snapshot we already took
+	existing, err := cloud.ListSnapshots(snapshots.ListOpts{Name: name})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not look up snapshot %s. Error is %s", name, err)
+	}
+	for _, snap := range *existing {
+		if snap.Name != name {
+			continue
+		}
+		if snap.VolumeID != volumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for volume %s", name, snap.VolumeID)
+		}
+		glog.Infof("Snapshot %s already exists with id %s", name, snap.ID)
+		return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(&snap)}, nil
+	}
+
+	if _, err := utils.GetOSVolumeByID(cloud, volumeID); err != nil {
+		if utils.IsNotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "Could not find volume with id %s", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not get volume with id %s. Error is %s", volumeID, err)
+	}
+	snap, err := cloud.CreateSnapshot(volumeID, name, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create snapshot %s of volume %s. Error is %s", name, volumeID, err)
+	}
+	glog.Infof("Snapshot %s of volume %s created with id %s", name, volumeID, snap.ID)
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snap)}, nil
+}
+
+// DeleteSnapshot : Deletes the Cinder snapshot, treating a snapshot that no longer exists as deleted
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID is missing in the request")
+	}
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Deleting snapshot %s", snapshotID)
+	err = cloud.DeleteSnapshot(snapshotID)
+	if err != nil && !utils.IsNotFoundError(err) {
+		return nil, status.Errorf(codes.Internal, "Could not delete snapshot %s. Error is %s", snapshotID, err)
+	}
+	glog.Infof("Snapshot %s deleted", snapshotID)
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots : Lists the Cinder snapshots, optionally only the one snapshot or the snapshots of one volume
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshots.Snapshot
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		snap, err := cloud.GetSnapshotByID(snapshotID)
+		if err != nil {
+			// A snapshot that doesn't exist just means there is nothing to list
+			if utils.IsNotFoundError(err) {
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Errorf(codes.Internal, "Could not get snapshot with id %s. Error is %s", snapshotID, err)
+		}
+		snaps = append(snaps, *snap)
+	} else {
+		snapList, err := cloud.ListSnapshots(snapshots.ListOpts{VolumeID: req.GetSourceVolumeId()})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not list snapshots. Error is %s", err)
+		}
+		snaps = *snapList
+	}
+
+	// The starting token is simply the index of the next snapshot to return
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index > len(snaps) {
+			return nil, status.Errorf(codes.Aborted, "Starting token %s is not valid", token)
+		}
+		start = index
+	}
+	end := len(snaps)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	for i := start; i < end; i++ {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(&snaps[i])})
+	}
+	if end < len(snaps) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// ControllerExpandVolume : Extends the Cinder volume, which is allowed whether or not the volume is attached
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is missing in the request")
+	}
+	capRange := req.GetCapacityRange()
+	if capRange == nil || capRange.GetRequiredBytes() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range is missing in the request")
+	}
+	sizeGB := int(util.RoundUpSize(capRange.GetRequiredBytes(), util.GiB))
+	if capRange.GetLimitBytes() > 0 && int64(sizeGB)*util.GiB > capRange.GetLimitBytes() {
+		return nil, status.Errorf(codes.OutOfRange,
+			"Volume size %dGB is over the limit of %d bytes", sizeGB, capRange.GetLimitBytes())
+	}
+
+	cloud, err := cs.cloudForSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Extending volume %s to %dGB", volumeID, sizeGB)
+	vol, err := cloud.ExtendVolume(volumeID, sizeGB)
+	if err != nil {
+		if utils.IsNotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "Could not find volume with id %s", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not extend volume %s. Error is %s", volumeID, err)
+	}
+	glog.Infof("Volume %s extended to %dGB", volumeID, vol.Size)
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes: int64(vol.Size) * util.GiB,
+		// The node rescans the devices of the volume, and grows its file system unless it is a raw block volume
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+// ControllerGetVolume : Not supported
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is not supported")
+}
+
+// Parses the create request to populate a struct for the gophercloud create call
+func parseCreateParameters(req *csi.CreateVolumeRequest) (volume.VolumeCreateOpts, error) {
+	var createOptions volume.VolumeCreateOpts
+
+	sizeGB := resources.CSIDefaultVolumeSize
+	if capRange := req.GetCapacityRange(); capRange != nil {
+		if capRange.GetRequiredBytes() > 0 {
+			sizeGB = int(util.RoundUpSize(capRange.GetRequiredBytes(), util.GiB))
+		}
+		if capRange.GetLimitBytes() > 0 && int64(sizeGB)*util.GiB > capRange.GetLimitBytes() {
+			return createOptions, status.Errorf(codes.OutOfRange,
+				"Volume size %dGB is over the limit of %d bytes", sizeGB, capRange.GetLimitBytes())
+		}
+	}
+	glog.Infof("Volume requested with %dGB", sizeGB)
+
+	volumeType := ""
+	availabilityZone := ""
+	for key, value := range req.GetParameters() {
+		switch strings.ToLower(key) {
+		case "type":
+			volumeType = value
+		case "availability":
+			availabilityZone = value
+		default:
+			// The parameters reserved by the CSI sidecars are not ours to handle
+			if strings.HasPrefix(key, resources.CSIParamPrefix) {
+				continue
+			}
+			return createOptions, status.Errorf(codes.InvalidArgument, "volume options unknown parameter passed in: %s", key)
+		}
+	}
+
+	// Any of the multi-node access modes means we need a multi-attach volume
+	multiAttach := false
+	for _, capability := range req.GetVolumeCapabilities() {
+		switch capability.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			multiAttach = true
+		}
+	}
+
+	return volume.VolumeCreateOpts{
+		Name:             volume.VolumeName(req.GetName()),
+		Size:             sizeGB,
+		VolumeType:       volumeType,
+		AvailabilityZone: availabilityZone,
+		MultiAttach:      multiAttach,
+	}, nil
+}
+
+// applyContentSource : Creates the volume from the snapshot or volume it was requested from,
+// making sure the volume is at least as big as its source
+func applyContentSource(cloud utils.OpenstackCloudI, req *csi.CreateVolumeRequest, opts *volume.VolumeCreateOpts) error {
+	source := req.GetVolumeContentSource()
+	if source == nil {
+		return nil
+	}
+	switch {
+	case source.GetSnapshot() != nil:
+		snapshotID := source.GetSnapshot().GetSnapshotId()
+		snap, err := cloud.GetSnapshotByID(snapshotID)
+		if err != nil {
+			if utils.IsNotFoundError(err) {
+				return status.Errorf(codes.NotFound, "Could not find snapshot with id %s", snapshotID)
+			}
+			return status.Errorf(codes.Internal, "Could not get snapshot with id %s. Error is %s", snapshotID, err)
+		}
+		if snap.Status != "available" {
+			return status.Errorf(codes.Unavailable, "Snapshot %s is %s and can't be used to create a volume", snapshotID, snap.Status)
+		}
+		if err := growToSource(req, opts, snap.Size); err != nil {
+			return err
+		}
+		opts.SnapshotID = snapshotID
+	case source.GetVolume() != nil:
+		sourceVolID := source.GetVolume().GetVolumeId()
+		vol, err := utils.GetOSVolumeByID(cloud, sourceVolID)
+		if err != nil {
+			if utils.IsNotFoundError(err) {
+				return status.Errorf(codes.NotFound, "Could not find volume with id %s", sourceVolID)
+			}
+			return status.Errorf(codes.Internal, "Could not get volume with id %s. Error is %s", sourceVolID, err)
+		}
+		// Cinder would quietly clone into the source's type, which isn't what the storage class asked for
+		if opts.VolumeType != "" && opts.VolumeType != vol.VolumeType {
+			return status.Errorf(codes.InvalidArgument, "Volume type %s doesn't match the type %s of source volume %s",
+				opts.VolumeType, vol.VolumeType, sourceVolID)
+		}
+		if err := growToSource(req, opts, vol.Size); err != nil {
+			return err
+		}
+		opts.SourceVolID = sourceVolID
+	default:
+		return status.Error(codes.InvalidArgument, "Volume content source type is not supported")
+	}
+	return nil
+}
+
+// cloudForSecrets : Returns a cloud authenticated with the OpenStack credentials in the secrets the CO passed
+// along for the StorageClass, or the cloud of the driver if there aren't any
+func (cs *controllerServer) cloudForSecrets(secrets map[string]string) (utils.OpenstackCloudI, error) {
+	if len(secrets) == 0 {
+		return cs.driver.cloud, nil
+	}
+	if _, err := utils.AuthOptionsFromSecret(secrets); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The client of the same secrets is reused until they change, instead of logging in on every call
+	cloud, err := cs.driver.clients.GetOpenstackClient(secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Could not authenticate with the credentials in the secrets. Error is %s", err)
+	}
+	return cloud, nil
+}
+
+// growToSource : Grows the volume to the size of its source if the source is bigger than requested
+func growToSource(req *csi.CreateVolumeRequest, opts *volume.VolumeCreateOpts, sourceSizeGB int) error {
+	if opts.Size >= sourceSizeGB {
+		return nil
+	}
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && int64(sourceSizeGB)*util.GiB > limit {
+		return status.Errorf(codes.OutOfRange,
+			"Volume source of %dGB is over the limit of %d bytes", sourceSizeGB, limit)
+	}
+	opts.Size = sourceSizeGB
+	return nil
+}
+
+// validateCapabilities : Makes sure each of the requested capabilities can be satisfied by a Cinder volume
+func validateCapabilities(caps []*csi.VolumeCapability) error {
+	for _, capability := range caps {
+		if capability.GetBlock() == nil && capability.GetMount() == nil {
+			return fmt.Errorf("Volume capability must specify block or mount access type")
+		}
+		mode := capability.GetAccessMode().GetMode()
+		supported := false
+		for _, supportedMode := range supportedAccessModes {
+			if mode == supportedMode {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("Volume access mode %s is not supported", mode)
+		}
+	}
+	return nil
+}
+
+func createVolumeResponse(vol *volumes.Volume) *csi.CreateVolumeResponse {
+	resp := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      vol.ID,
+			CapacityBytes: int64(vol.Size) * util.GiB,
+		},
+	}
+	if vol.SnapshotID != "" {
+		resp.Volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: vol.SnapshotID},
+			},
+		}
+	} else if vol.SourceVolID != "" {
+		resp.Volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vol.SourceVolID},
+			},
+		}
+	}
+	return resp
+}
+
+// csiSnapshot : Converts the Cinder snapshot into the CSI representation
+func csiSnapshot(snap *snapshots.Snapshot) *csi.Snapshot {
+	// A zero time can't be converted, in which case the creation time is just left out
+	creationTime, _ := ptypes.TimestampProto(snap.CreatedAt)
+	return &csi.Snapshot{
+		SnapshotId:     snap.ID,
+		SourceVolumeId: snap.VolumeID,
+		SizeBytes:      int64(snap.Size) * util.GiB,
+		CreationTime:   creationTime,
+		ReadyToUse:     snap.Status == "available",
+	}
+}
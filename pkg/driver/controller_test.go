@@ -0,0 +1,466 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	"github.com/IBM/power-openstack-k8s-volume-driver/pkg/testutils"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestController() *controllerServer {
+	d := NewDriver(resources.CSIDriverName, "1.2.3.4", resources.CSIDefaultEndpoint, &utils.OpenstackCloudMock{}, utils.NewFakeMounter())
+	return d.cs
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability {
+	return []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		},
+	}
+}
+
+func TestCreateVolumeInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *csi.CreateVolumeRequest
+		expected codes.Code
+	}{
+		{
+			name:     "no name in request",
+			req:      &csi.CreateVolumeRequest{VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name:     "no capabilities in request",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-test"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name: "unknown parameter",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-test",
+				VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				Parameters:         map[string]string{"unknown": "test"},
+			},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name: "size over the limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-test",
+				VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1500, LimitBytes: 2000},
+			},
+			expected: codes.OutOfRange,
+		},
+		{
+			name: "secrets without credentials",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-test",
+				VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				Secrets:            map[string]string{resources.OSAuthURL: "https://auth.url"},
+			},
+			expected: codes.InvalidArgument,
+		},
+	}
+	cs := newTestController()
+	for _, test := range tests {
+		_, err := cs.CreateVolume(context.Background(), test.req)
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s \n received: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-test",
+		VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		Parameters:         map[string]string{"type": "test", resources.CSIParamPrefix + "fstype": "ext4"},
+	}
+	resp, err := newTestController().CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	testutils.AssertEquals(t, resp.GetVolume().GetVolumeId(), "icp-test")
+}
+
+func TestCreateVolumeOwnershipMetadata(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	volumeMeta := make(map[string]string)
+	testutils.MuxHandleCreateWithMetadata(t, volumeMeta)
+	testutils.MuxHandleListEmpty(t)
+
+	cs := newTestController()
+	cs.driver.ClusterID = "test-cluster"
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-test",
+		VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		Parameters: map[string]string{
+			resources.CSIParamPVName:       "pvc-test",
+			resources.CSIParamPVCName:      "claim",
+			resources.CSIParamPVCNamespace: "default",
+		},
+	}
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	testutils.AssertEquals(t, volumeMeta[resources.OsK8sClusterIDMeta], "test-cluster")
+	testutils.AssertEquals(t, volumeMeta[resources.OsK8sPVNameMeta], "pvc-test")
+	testutils.AssertEquals(t, volumeMeta[resources.OsK8sPVCNameMeta], "claim")
+	testutils.AssertEquals(t, volumeMeta[resources.OsK8sPVCNamespaceMeta], "default")
+	testutils.AssertEquals(t, volumeMeta[resources.OsK8sProvisionerMeta], resources.CSIDriverName)
+}
+
+func TestDeleteVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeMeta map[string]string
+		expected   codes.Code
+	}{
+		{
+			name:       "volume owned by the cluster",
+			volumeMeta: map[string]string{resources.OsK8sClusterIDMeta: "test-cluster"},
+			expected:   codes.OK,
+		},
+		{
+			name:     "volume created before the ownership tags",
+			expected: codes.OK,
+		},
+		{
+			name:       "volume owned by another cluster",
+			volumeMeta: map[string]string{resources.OsK8sClusterIDMeta: "other-cluster"},
+			expected:   codes.FailedPrecondition,
+		},
+	}
+	for _, test := range tests {
+		testutils.SetupHTTP()
+		testutils.MuxHandleGetAndDeleteVolume(t, "icp-test", test.volumeMeta)
+
+		cs := newTestController()
+		cs.driver.ClusterID = "test-cluster"
+		_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "icp-test"})
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s, but got %v", test.name, test.expected, err)
+		}
+		testutils.TearDownHTTP()
+	}
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol_1",
+		NodeId:           "1.2.3.4",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0],
+	}
+	resp, err := newTestController().ControllerPublishVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to publish volume: %s", err)
+	}
+	testutils.AssertEquals(t, resp.GetPublishContext()[resources.DevicePath], resources.PathPVMVIOS+"wwn_1")
+	testutils.AssertEquals(t, resp.GetPublishContext()[resources.TargetWWNs], "500507680b215660,500507680b225660")
+	testutils.AssertEquals(t, resp.GetPublishContext()[resources.TargetLUN], "1")
+	testutils.AssertEquals(t, resp.GetPublishContext()[resources.VolumeWWN], "wwn_1")
+}
+
+func TestControllerPublishVolumeAttachedToAnotherVM(t *testing.T) {
+	// vol_2 is attached to vm_2 and isn't multi-attach
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol_2",
+		NodeId:           "1.2.3.4",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0],
+	}
+	_, err := newTestController().ControllerPublishVolume(context.Background(), req)
+	testutils.AssertEquals(t, status.Code(err), codes.FailedPrecondition)
+}
+
+func TestControllerUnpublishVolume(t *testing.T) {
+	req := &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol_1", NodeId: "1.2.3.4"}
+	_, err := newTestController().ControllerUnpublishVolume(context.Background(), req)
+	if err != nil {
+		t.Errorf("failed to unpublish volume: %s", err)
+	}
+}
+
+func TestControllerPublishVolumeNovaError(t *testing.T) {
+	// A failed Nova lookup doesn't tell if the volume is attached
+	d := NewDriver(resources.CSIDriverName, "1.2.3.4", resources.CSIDefaultEndpoint,
+		&utils.OpenstackCloudMock{AttachedErr: fmt.Errorf("nova is down")}, utils.NewFakeMounter())
+	_, err := d.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol_1",
+		NodeId:           "1.2.3.4",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0],
+	})
+	testutils.AssertEquals(t, status.Code(err), codes.Internal)
+	_, err = d.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol_1", NodeId: "1.2.3.4"})
+	testutils.AssertEquals(t, status.Code(err), codes.Internal)
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	req := &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "vol_1",
+		VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	}
+	resp, err := newTestController().ValidateVolumeCapabilities(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to validate capabilities: %s", err)
+	}
+	if resp.GetConfirmed() == nil {
+		t.Errorf("expected capabilities to be confirmed, but got %s", resp.GetMessage())
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
+
+	tests := []struct {
+		name       string
+		snapshotID string
+		expected   codes.Code
+	}{
+		{
+			name:       "snapshot exists",
+			snapshotID: "snap_2",
+			expected:   codes.OK,
+		},
+		{
+			name:       "snapshot does not exist",
+			snapshotID: "snap_unknown",
+			expected:   codes.NotFound,
+		},
+	}
+	cs := newTestController()
+	for _, test := range tests {
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-test",
+			VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: test.snapshotID},
+				},
+			},
+		}
+		_, err := cs.CreateVolume(context.Background(), req)
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s \n received: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestCreateVolumeClone(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
+
+	tests := []struct {
+		name       string
+		volumeType string
+		expected   codes.Code
+	}{
+		{
+			name:       "same type as the source",
+			volumeType: "",
+			expected:   codes.OK,
+		},
+		{
+			name:       "different type than the source",
+			volumeType: "gold",
+			expected:   codes.InvalidArgument,
+		},
+	}
+	cs := newTestController()
+	for _, test := range tests {
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-test",
+			VolumeCapabilities: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			Parameters:         map[string]string{"type": test.volumeType},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vol_1"},
+				},
+			},
+		}
+		_, err := cs.CreateVolume(context.Background(), req)
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s \n received: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *csi.CreateSnapshotRequest
+		expected codes.Code
+	}{
+		{
+			name:     "no name in request",
+			req:      &csi.CreateSnapshotRequest{SourceVolumeId: "vol_1"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name:     "no source volume in request",
+			req:      &csi.CreateSnapshotRequest{Name: "snapshot-test"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name:     "snapshot already taken of the volume",
+			req:      &csi.CreateSnapshotRequest{Name: "snap_1", SourceVolumeId: "vol_1"},
+			expected: codes.OK,
+		},
+		{
+			name:     "snapshot name already taken by another volume",
+			req:      &csi.CreateSnapshotRequest{Name: "snap_2", SourceVolumeId: "vol_1"},
+			expected: codes.AlreadyExists,
+		},
+		{
+			name:     "new snapshot",
+			req:      &csi.CreateSnapshotRequest{Name: "snapshot-test", SourceVolumeId: "vol_1"},
+			expected: codes.OK,
+		},
+	}
+	cs := newTestController()
+	for _, test := range tests {
+		resp, err := cs.CreateSnapshot(context.Background(), test.req)
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s \n received: %v", test.name, test.expected, err)
+			continue
+		}
+		if err == nil {
+			testutils.AssertEquals(t, resp.GetSnapshot().GetSourceVolumeId(), test.req.GetSourceVolumeId())
+			testutils.AssertEquals(t, resp.GetSnapshot().GetReadyToUse(), true)
+		}
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	cs := newTestController()
+	for _, snapshotID := range []string{"snap_1", "snap_unknown"} {
+		_, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+		if err != nil {
+			t.Errorf("failed to delete snapshot %s: %s", snapshotID, err)
+		}
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	cs := newTestController()
+
+	resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 1})
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %s", err)
+	}
+	testutils.AssertEquals(t, len(resp.GetEntries()), 1)
+	testutils.AssertEquals(t, resp.GetNextToken(), "1")
+
+	resp, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: resp.GetNextToken()})
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %s", err)
+	}
+	testutils.AssertEquals(t, len(resp.GetEntries()), 1)
+	testutils.AssertEquals(t, resp.GetEntries()[0].GetSnapshot().GetSnapshotId(), "snap_2")
+
+	resp, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: "vol_1"})
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %s", err)
+	}
+	testutils.AssertEquals(t, len(resp.GetEntries()), 1)
+	testutils.AssertEquals(t, resp.GetEntries()[0].GetSnapshot().GetSnapshotId(), "snap_1")
+
+	_, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "bad"})
+	testutils.AssertEquals(t, status.Code(err), codes.Aborted)
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	tests := []struct {
+		name          string
+		req           *csi.ControllerExpandVolumeRequest
+		expected      codes.Code
+		nodeExpansion bool
+	}{
+		{
+			name:     "no capacity in request",
+			req:      &csi.ControllerExpandVolumeRequest{VolumeId: "vol_1"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name: "volume does not exist",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "vol_unknown",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+			},
+			expected: codes.NotFound,
+		},
+		{
+			name: "mounted volume",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:         "vol_1",
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+				VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0],
+			},
+			expected:      codes.OK,
+			nodeExpansion: true,
+		},
+		{
+			name: "raw block volume",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "vol_1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				},
+			},
+			expected:      codes.OK,
+			nodeExpansion: true,
+		},
+	}
+	cs := newTestController()
+	for _, test := range tests {
+		resp, err := cs.ControllerExpandVolume(context.Background(), test.req)
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s \n received: %v", test.name, test.expected, err)
+			continue
+		}
+		if err == nil {
+			testutils.AssertEquals(t, resp.GetCapacityBytes(), test.req.GetCapacityRange().GetRequiredBytes())
+			testutils.AssertEquals(t, resp.GetNodeExpansionRequired(), test.nodeExpansion)
+		}
+	}
+}
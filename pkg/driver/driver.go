@@ -0,0 +1,183 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// Replaces the values of the secrets in the logged gRPC messages
+const strippedSecret = "***stripped***"
+
+// Driver : The CSI driver which serves the identity, controller and node services over gRPC
+type Driver struct {
+	// The name the driver is registered with in Kubernetes
+	Name string
+	// The version of the driver reported back through the identity service
+	Version string
+	// The Kubernetes node name this instance of the driver is running on
+	NodeID string
+	// The endpoint (unix socket) the gRPC server will be listening on
+	Endpoint string
+	// The ID the volumes of this cluster are tagged with, to tell them apart from those of other clusters
+	ClusterID string
+
+	cloud   utils.OpenstackCloudI
+	mounter utils.Mounter
+	server  *grpc.Server
+	// The clients of the credentials in the secrets of the requests, shared between the requests
+	clients *utils.ClientCache
+
+	ids *identityServer
+	cs  *controllerServer
+	ns  *nodeServer
+}
+
+// NewDriver : Creates a new CSI driver that uses the given OpenStack cloud for all of its operations,
+// and the mounter for the volumes on the node
+func NewDriver(name string, nodeID string, endpoint string, cloud utils.OpenstackCloudI, mounter utils.Mounter) *Driver {
+	d := &Driver{
+		Name:     name,
+		Version:  resources.CSIDriverVersion,
+		NodeID:   nodeID,
+		Endpoint: endpoint,
+		cloud:    cloud,
+		mounter:  mounter,
+		clients:  utils.NewClientCache(),
+	}
+	d.ids = &identityServer{driver: d}
+	d.cs = &controllerServer{driver: d}
+	d.ns = &nodeServer{driver: d}
+	return d
+}
+
+// Run : Starts the gRPC server and blocks serving requests until the server is stopped
+func (d *Driver) Run() error {
+	scheme, addr, err := parseEndpoint(d.Endpoint)
+	if err != nil {
+		return err
+	}
+	// A stale socket left behind by a previous instance would keep us from listening
+	if scheme == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove stale socket %s. Error is %s", addr, err)
+		}
+	}
+	listener, err := net.Listen(scheme, addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s. Error is %s", d.Endpoint, err)
+	}
+
+	d.server = grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	csi.RegisterIdentityServer(d.server, d.ids)
+	csi.RegisterControllerServer(d.server, d.cs)
+	csi.RegisterNodeServer(d.server, d.ns)
+
+	glog.Infof("CSI driver %s listening on %s", d.Name, d.Endpoint)
+	return d.server.Serve(listener)
+}
+
+// Stop : Stops the gRPC server if it is running
+func (d *Driver) Stop() {
+	if d.server != nil {
+		d.server.Stop()
+	}
+}
+
+// parseEndpoint : Splits an endpoint of the form unix:///csi/csi.sock or tcp://host:port
+// into the network and address that net.Listen expects
+func parseEndpoint(endpoint string) (string, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not parse endpoint %s. Error is %s", endpoint, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		addr := u.Path
+		if u.Host != "" {
+			addr = u.Host + addr
+		}
+		return u.Scheme, addr, nil
+	case "tcp":
+		return u.Scheme, u.Host, nil
+	}
+	return "", "", fmt.Errorf("Endpoint scheme %s is not supported in %s", u.Scheme, endpoint)
+}
+
+// logGRPC : Logs each of the gRPC calls along with any error returned
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	glog.V(4).Infof("GRPC call: %s", info.FullMethod)
+	glog.V(5).Infof("GRPC request: %+v", stripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("GRPC call %s failed: %v", info.FullMethod, err)
+	} else {
+		glog.V(5).Infof("GRPC response: %+v", stripSecrets(resp))
+	}
+	return resp, err
+}
+
+// stripSecrets : Returns a copy of the gRPC message whose Secrets maps, which are the fields the CSI spec
+// marks as csi_secret, have their values replaced, so that the OpenStack credentials never reach the logs
+func stripSecrets(msg interface{}) interface{} {
+	message, ok := msg.(proto.Message)
+	if !ok || reflect.ValueOf(message).IsNil() {
+		return msg
+	}
+	stripped := proto.Clone(message)
+	stripSecretFields(reflect.ValueOf(stripped))
+	return stripped
+}
+
+// stripSecretFields : Replaces the values of the Secrets maps of the message and of the messages it holds
+func stripSecretFields(value reflect.Value) {
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return
+	}
+	message := value.Elem()
+	for i := 0; i < message.NumField(); i++ {
+		field := message.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch {
+		case message.Type().Field(i).Name == "Secrets" && field.Kind() == reflect.Map && field.Len() > 0:
+			secrets := reflect.MakeMap(field.Type())
+			for _, key := range field.MapKeys() {
+				secrets.SetMapIndex(key, reflect.ValueOf(strippedSecret))
+			}
+			field.Set(secrets)
+		case field.Kind() == reflect.Ptr:
+			stripSecretFields(field)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Ptr:
+			for j := 0; j < field.Len(); j++ {
+				stripSecretFields(field.Index(j))
+			}
+		}
+	}
+}
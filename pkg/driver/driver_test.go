@@ -0,0 +1,47 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	"github.com/IBM/power-openstack-k8s-volume-driver/pkg/testutils"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestStripSecrets(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:    "pvc-test",
+		Secrets: map[string]string{resources.OSPassword: "passw0rd"},
+	}
+	logged := fmt.Sprintf("%+v", stripSecrets(req))
+	if strings.Contains(logged, "passw0rd") || !strings.Contains(logged, strippedSecret) {
+		t.Errorf("Expected the password to be stripped, but got %s", logged)
+	}
+	if !strings.Contains(logged, "pvc-test") {
+		t.Errorf("Expected the other fields to be logged, but got %s", logged)
+	}
+	// The request itself is still handled with its secrets
+	testutils.AssertEquals(t, req.GetSecrets()[resources.OSPassword], "passw0rd")
+
+	// Messages without secrets, and nil ones, are logged as they are
+	testutils.AssertEquals(t, fmt.Sprintf("%+v", stripSecrets(&csi.ProbeResponse{})), fmt.Sprintf("%+v", &csi.ProbeResponse{}))
+	var resp *csi.CreateVolumeResponse
+	testutils.AssertEquals(t, stripSecrets(resp), resp)
+}
@@ -0,0 +1,302 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type nodeServer struct {
+	driver *Driver
+}
+
+// NodeStageVolume : Waits for the attached volume to show up on the node and then formats
+// and mounts it at the global staging path, which is shared by all the pods using the volume
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	devicePath := req.GetPublishContext()[resources.DevicePath]
+	if devicePath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Device path of volume %s missing in publish context", volumeID)
+	}
+
+	// Rescan the SCSI bus until the volume the controller attached shows up on the node, only where
+	// the connection info says it is if the controller found it
+	conn := utils.VolumeConnectionFromContext(req.GetPublishContext())
+	// The node has to connect to the targets of some volumes, with the properties it only gets from Cinder
+	if conn != nil && utils.GetConnector(conn.DriverVolumeType) != nil {
+		var err error
+		if conn, err = ns.volumeConnection(volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not get the connection info of volume %s. Error is %s", volumeID, err)
+		}
+	}
+	volume := &resources.OSVolume{}
+	volume.ID = volumeID
+	volume.Metadata = map[string]string{"volume_wwn": req.GetPublishContext()[resources.VolumeWWN]}
+	volDevicePath, err := utils.WaitForAttachedDevice(devicePath, volume, conn)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not find directory of attached volume with id %s. Error is %s", volumeID, err)
+	}
+	// Raw block volumes are bind mounted straight from the device when published
+	if volCap.GetBlock() != nil {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	// Nothing to do if an earlier call already mounted the volume
+	if notMnt, err := ns.driver.mounter.IsLikelyNotMountPoint(stagingPath); err == nil && !notMnt {
+		glog.Infof("Volume %s is already staged at %s", volumeID, stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mnt := volCap.GetMount()
+	var options []string
+	if isReadOnly(volCap) {
+		options = append(options, "ro")
+	}
+	if err := ns.driver.mounter.FormatAndMount(volDevicePath, stagingPath, mnt.GetFsType(), options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("Staged volume %s from %s at %s", volumeID, volDevicePath, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// volumeConnection : Returns the connection info of the attachment of the volume to the VM of the node
+func (ns *nodeServer) volumeConnection(volumeID string) (*resources.VolumeConnection, error) {
+	vmID, err := utils.GetVMID(ns.driver.cloud, ns.driver.NodeID)
+	if err != nil || vmID == "" {
+		return nil, fmt.Errorf("Could not find VM for node %s. Error is %v", ns.driver.NodeID, err)
+	}
+	conn, err := utils.GetVolumeConnection(ns.driver.cloud, volumeID, vmID)
+	if err != nil {
+		return nil, err
+	} else if conn == nil {
+		return nil, fmt.Errorf("Volume %s is not attached to VM %s", volumeID, vmID)
+	}
+	return conn, nil
+}
+
+// NodeUnstageVolume : Unmounts the volume from the global staging path and removes
+// the SCSI and multipath devices of the volume from the node
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	if notMnt, err := ns.driver.mounter.IsLikelyNotMountPoint(stagingPath); err != nil || notMnt {
+		glog.Infof("Volume %s is not staged at %s, nothing to do", volumeID, stagingPath)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	if err := utils.UnmountDevice(ns.driver.mounter, stagingPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("Unstaged volume %s from %s", volumeID, stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume : Bind mounts the staged volume into the pod's target path. Raw block
+// volumes are bind mounted from the device onto a file at the target path instead.
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	// Nothing to do if an earlier call already mounted the volume
+	if notMnt, err := ns.driver.mounter.IsLikelyNotMountPoint(targetPath); err == nil && !notMnt {
+		glog.Infof("Volume %s is already published at %s", volumeID, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// The volume is read-only in the pod if the pod asks for it or the access mode only allows reading
+	readOnly := req.GetReadonly() || isReadOnly(volCap)
+	if volCap.GetBlock() != nil {
+		devicePath := req.GetPublishContext()[resources.DevicePath]
+		if devicePath == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Device path of volume %s missing in publish context", volumeID)
+		}
+		volDevicePath := utils.FindAttachedVolumeDirectoryPath(devicePath)
+		if volDevicePath == "" {
+			return nil, status.Errorf(codes.NotFound, "Could not find symbolic link of attached volume %s", devicePath)
+		}
+		if err := ns.publishBlockDevice(volDevicePath, targetPath, readOnly); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("Published block volume %s from %s at %s", volumeID, volDevicePath, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	if err := ns.driver.mounter.Mount(stagingPath, targetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("Published volume %s from %s at %s", volumeID, stagingPath, targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume : Unmounts the volume from the pod's target path
+func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	if notMnt, err := ns.driver.mounter.IsLikelyNotMountPoint(targetPath); err == nil && !notMnt {
+		if err := ns.driver.mounter.Unmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	// The target is a directory for mounted volumes and a file for block volumes
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "Could not remove target path %s. Error is %s", targetPath, err)
+	}
+	glog.Infof("Unpublished volume %s from %s", volumeID, targetPath)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetInfo : Returns the Kubernetes node name, which the controller resolves to the OpenStack VM
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId: ns.driver.NodeID,
+	}, nil
+}
+
+// NodeGetCapabilities : Returns the node capabilities supported by the driver
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// NodeGetVolumeStats : Not supported
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// NodeExpandVolume : Grows the file system of the volume after the controller has extended the volume
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	// Raw block volumes have no file system to grow, but the node still has to see the new size of the device
+	if req.GetVolumeCapability().GetBlock() != nil {
+		devicePath, err := utils.BlockDeviceOfPath(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "Could not find device of volume %s at %s. Error is %s", volumeID, volumePath, err)
+		}
+		if err := utils.ResizeDevice(devicePath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("Expanded device %s of volume %s", devicePath, volumeID)
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+	if notMnt, err := ns.driver.mounter.IsLikelyNotMountPoint(volumePath); err != nil || notMnt {
+		return nil, status.Errorf(codes.NotFound, "Volume %s is not mounted at %s", volumeID, volumePath)
+	}
+	if err := utils.ResizeFileSystem(ns.driver.mounter, volumePath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("Expanded file system of volume %s at %s", volumeID, volumePath)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+}
+
+// isReadOnly : Tells if the access mode of the capability only allows reading the volume
+func isReadOnly(volCap *csi.VolumeCapability) bool {
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// publishBlockDevice : Bind mounts the block device onto a file created at the target path
+func (ns *nodeServer) publishBlockDevice(devicePath string, targetPath string, readOnly bool) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(targetPath, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return ns.driver.mounter.Mount(devicePath, targetPath, "", options)
+}
@@ -0,0 +1,217 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	"github.com/IBM/power-openstack-k8s-volume-driver/pkg/testutils"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestNode() *nodeServer {
+	d := NewDriver(resources.CSIDriverName, "1.2.3.4", resources.CSIDefaultEndpoint, &utils.OpenstackCloudMock{}, utils.NewFakeMounter())
+	return d.ns
+}
+
+func TestNodeStageVolumeInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *csi.NodeStageVolumeRequest
+	}{
+		{
+			name: "no volume id in request",
+			req:  &csi.NodeStageVolumeRequest{StagingTargetPath: "/staging"},
+		},
+		{
+			name: "no staging path in request",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol_1"},
+		},
+		{
+			name: "no capability in request",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: "/staging"},
+		},
+		{
+			name: "no device path in publish context",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol_1",
+				StagingTargetPath: "/staging",
+				VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0],
+			},
+		},
+	}
+	ns := newTestNode()
+	for _, test := range tests {
+		_, err := ns.NodeStageVolume(context.Background(), test.req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected %s \n received: %v", test.name, codes.InvalidArgument, err)
+		}
+	}
+}
+
+func TestNodePublishVolumeInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *csi.NodePublishVolumeRequest
+	}{
+		{
+			name: "no volume id in request",
+			req:  &csi.NodePublishVolumeRequest{TargetPath: "/target"},
+		},
+		{
+			name: "no target path in request",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol_1"},
+		},
+		{
+			name: "no capability in request",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol_1", TargetPath: "/target"},
+		},
+	}
+	ns := newTestNode()
+	for _, test := range tests {
+		_, err := ns.NodePublishVolume(context.Background(), test.req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected %s \n received: %v", test.name, codes.InvalidArgument, err)
+		}
+	}
+}
+
+func TestNodePublishAndUnpublishVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	targetPath := filepath.Join(dir, "target")
+
+	ns := newTestNode()
+	mounter := ns.driver.mounter.(*utils.FakeMounter)
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: "/staging",
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)[0],
+		Readonly:          true,
+	}
+	// Publishing again is a no-op
+	for i := 0; i < 2; i++ {
+		if _, err := ns.NodePublishVolume(context.Background(), req); err != nil {
+			t.Fatalf("failed to publish volume: %s", err)
+		}
+	}
+	testutils.AssertEquals(t, len(mounter.Actions), 1)
+	testutils.AssertEquals(t, mounter.MountPoints[targetPath], "/staging")
+	testutils.AssertEquals(t, strings.Join(mounter.Options[targetPath], ","), "bind,ro")
+
+	unpublishReq := &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: targetPath}
+	for i := 0; i < 2; i++ {
+		if _, err := ns.NodeUnpublishVolume(context.Background(), unpublishReq); err != nil {
+			t.Fatalf("failed to unpublish volume: %s", err)
+		}
+	}
+	if _, ok := mounter.MountPoints[targetPath]; ok {
+		t.Errorf("expected %s to be unmounted", targetPath)
+	}
+}
+
+func TestNodePublishVolumeSingleNodeReaderOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	targetPath := filepath.Join(dir, "target")
+
+	ns := newTestNode()
+	mounter := ns.driver.mounter.(*utils.FakeMounter)
+	// The access mode makes the volume read-only even if the pod doesn't ask for it
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: "/staging",
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)[0],
+	}
+	if _, err := ns.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to publish volume: %s", err)
+	}
+	testutils.AssertEquals(t, strings.Join(mounter.Options[targetPath], ","), "bind,ro")
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	resp, err := newTestNode().NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("failed to get node info: %s", err)
+	}
+	testutils.AssertEquals(t, resp.GetNodeId(), "1.2.3.4")
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	resp, err := newTestNode().NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("failed to get node capabilities: %s", err)
+	}
+	caps := resp.GetCapabilities()
+	if len(caps) != 2 || caps[0].GetRpc().GetType() != csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME ||
+		caps[1].GetRpc().GetType() != csi.NodeServiceCapability_RPC_EXPAND_VOLUME {
+		t.Errorf("expected the STAGE_UNSTAGE_VOLUME and EXPAND_VOLUME capabilities, but got %v", caps)
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *csi.NodeExpandVolumeRequest
+		expected codes.Code
+	}{
+		{
+			name:     "no volume id in request",
+			req:      &csi.NodeExpandVolumeRequest{VolumePath: "/target"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name:     "no volume path in request",
+			req:      &csi.NodeExpandVolumeRequest{VolumeId: "vol_1"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name: "block volume whose device is gone",
+			req: &csi.NodeExpandVolumeRequest{
+				VolumeId:   "vol_1",
+				VolumePath: "/dev/block",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				},
+			},
+			expected: codes.NotFound,
+		},
+	}
+	ns := newTestNode()
+	for _, test := range tests {
+		_, err := ns.NodeExpandVolume(context.Background(), test.req)
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %s \n received: %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package resources
 import (
 	"fmt"
 	"os"
+	"time"
 )
 
 // Constants
@@ -40,6 +41,13 @@ const (
 	MountDir       = "mountDir"
 	DriverJSONArgs = "jsonArgs"
 
+	// Keys of the connection info in the publish context, next to the device path
+	TargetWWNs       = "targetWWNs"
+	TargetLUN        = "targetLUN"
+	DriverVolumeType = "driverVolumeType"
+	// WWN of the volume, which the node checks the attached device against
+	VolumeWWN = "volumeWWN"
+
 	// Kuberenets args
 	K8sArgFSType   = "kubernetes.io/fsType"
 	K8sArgMountRW  = "kubernetes.io/readwrite"
@@ -49,11 +57,24 @@ const (
 	K8sArgPV       = "kubernetes.io/pvOrVolumeName"
 	K8sCreatedBy   = "kubernetes.io/createdby"
 
+	// Kubernetes zone labels, the beta label is still used by older clusters
+	K8sLabelZone     = "topology.kubernetes.io/zone"
+	K8sLabelZoneBeta = "failure-domain.beta.kubernetes.io/zone"
+
 	// Openstack args
-	OsArgsVolID         = "volumeID"
-	OsArgsVolWWN        = "wwn"
-	OsArgsMountRW       = "actualReadWrite"
-	OsK8sVolumeNameMeta = "k8s_pvOrVolumeName"
+	OsArgsVolID           = "volumeID"
+	OsArgsSnapshotID      = "snapshotID"
+	OsArgsSourceVolID     = "sourceVolumeID"
+	OsArgsVolWWN          = "wwn"
+	OsArgsMountRW         = "actualReadWrite"
+	OsK8sVolumeNameMeta   = "k8s_pvOrVolumeName"
+	OsK8sPVCUIDMeta       = "k8s_pvcUID"
+	OsK8sClusterIDMeta    = "k8s_clusterID"
+	OsK8sPVNameMeta       = "k8s_pvName"
+	OsK8sPVCNamespaceMeta = "k8s_pvcNamespace"
+	OsK8sPVCNameMeta      = "k8s_pvcName"
+	OsK8sProvisionerMeta  = "k8s_provisioner"
+	OsK8sAttachErrorMeta  = "k8s_attachError"
 
 	// Result status
 	ResultStatusSuccess     = "Success"
@@ -77,15 +98,21 @@ const (
 	StorageHostTypeGPFS = "gpfs"
 	StorageHostTypeXIV  = "xiv"
 
+	// The driver_volume_type of the connection info of the volumes the node has to connect to
+	DriverVolumeTypeISCSI  = "iscsi"
+	DriverVolumeTypeNVMeoF = "nvmeof"
+
 	FlexPluginVendor    = "ibm"
 	ScsiPath            = "/sys/class/scsi_host/"
 	AttachedVolumeDir   = "/dev/disk/by-id/"
+	ByPathDir           = "/dev/disk/by-path/"
 	DirNamePVMVIOS      = "wwn-0x"
 	DirNamePrefixPVMLIO = "wwn-0x6001405"
 	DirNamePrefixPVMXIV = "scsi-2"
 	DirNamePrefixKVM    = "scsi-0QEMU_QEMU_HARDDISK_"
 	PathPVMVIOS         = AttachedVolumeDir + DirNamePVMVIOS
 
+	ProcMountInfo          = "/proc/self/mountinfo"
 	CMDSudo                = "/usr/bin/sudo"
 	CMDLsBlk               = "/bin/lsblk"
 	CMDMkDir               = "/bin/mkdir"
@@ -97,6 +124,11 @@ const (
 	CMDUdevAdm             = "/sbin/udevadm"
 	CMDUdevAdmParamSettle  = "settle"
 	CMDUdevAdmParamTrigger = "trigger"
+	CMDMultipathd          = "/usr/sbin/multipathd"
+	CMDISCSIAdm            = "/sbin/iscsiadm"
+	CMDNVMe                = "/usr/sbin/nvme"
+	CMDResize2FS           = "/sbin/resize2fs"
+	CMDXFSGrowFS           = "/sbin/xfs_growfs"
 
 	OSUser          = "OS_USERNAME"
 	OSPassword      = "OS_PASSWORD"
@@ -106,12 +138,83 @@ const (
 	OSProjectID     = "OS_TENANT_ID"
 	OSAuthURL       = "OS_AUTH_URL"
 	OSCACert        = "OS_CACERT"
+	OSDomainName    = "OS_DOMAIN_NAME"
+	OSProjectNameV3 = "OS_PROJECT_NAME"
+	OSProjectIDV3   = "OS_PROJECT_ID"
+	OSCACertData    = "OS_CACERT_DATA"
+	OSUserID        = "OS_USERID"
+	OSDomainID      = "OS_DOMAIN_ID"
+	OSAuthType      = "OS_AUTH_TYPE"
+	OSToken         = "OS_TOKEN"
+	OSRegionName    = "OS_REGION_NAME"
+	OSInterface     = "OS_INTERFACE"
+
+	// The domains of the user and of the project by ID, next to the names above
+	OSUserDomainID    = "OS_USER_DOMAIN_ID"
+	OSProjectDomainID = "OS_PROJECT_DOMAIN_ID"
+
+	// Select the cloud of a clouds.yaml file instead of setting each of the values above
+	OSCloud            = "OS_CLOUD"
+	OSClientConfigFile = "OS_CLIENT_CONFIG_FILE"
+
+	// JSON file of the device resolvers to add to the built-in ones, and the sources of their device names
+	DeviceResolversFile     = "DEVICE_RESOLVERS_FILE"
+	DeviceResolverSourceID  = "id"
+	DeviceResolverSourceWWN = "wwn"
+
+	// Set to true to use the attached device without checking that its identifiers are those of the volume,
+	// for storage whose devices don't report them
+	SkipDeviceIdentityCheck = "SKIP_DEVICE_IDENTITY_CHECK"
+
+	OSAppCredentialID     = "OS_APPLICATION_CREDENTIAL_ID"
+	OSAppCredentialName   = "OS_APPLICATION_CREDENTIAL_NAME"
+	OSAppCredentialSecret = "OS_APPLICATION_CREDENTIAL_SECRET"
+
+	// The ways to authenticate with Keystone, named like the auth types of the OpenStack clients
+	AuthTypePassword      = "password"
+	AuthTypeAppCredential = "v3applicationcredential"
+	AuthTypeToken         = "v3token"
+
+	// StorageClass parameters naming the secret with the OpenStack credentials for the volumes of the class
+	ParamProvisionerSecretName      = "provisioner-secret-name"
+	ParamProvisionerSecretNamespace = "provisioner-secret-namespace"
 
 	URIProjects = "/v3/projects"
 
+	// Cinder only allows extending volumes that are attached starting with this microversion
+	CinderInUseExtendMicroversion = "3.42"
+
+	// The attachments API, which returns the connection info of the volume attachments, needs this microversion
+	CinderAttachmentsMicroversion = "3.27"
+
+	// CSI driver
+	CSIDriverName        = "ibm-powervc-csi"
+	CSIDriverVersion     = "1.1.0"
+	CSIDefaultEndpoint   = "unix:///csi/csi.sock"
+	CSIParamPrefix       = "csi.storage.k8s.io/"
+	CSIDefaultVolumeSize = 1
+
+	// Passed by the external-provisioner when it runs with --extra-create-metadata
+	CSIParamPVName       = CSIParamPrefix + "pv/name"
+	CSIParamPVCName      = CSIParamPrefix + "pvc/name"
+	CSIParamPVCNamespace = CSIParamPrefix + "pvc/namespace"
+
+	// Volume snapshots
+	SnapshotAPIGroup   = "snapshot.storage.k8s.io"
+	SnapshotAPIVersion = "v1beta1"
+	SnapshotKind       = "VolumeSnapshot"
+
 	MaxAttemptsToFindVolume = 24
 	MaxAttemptsToTryLock    = 24
 	ScsiScanLock            = "power-openstack-k8s-scsiscan.lck"
+
+	// Waits up to 5 minutes in all, polling every 5 seconds, for a volume and its devices to be detached
+	WaitForDetachTimeout = 5 * time.Minute
+
+	// Keystone token shared by the invocations of the FlexVolume plugin on a node
+	MaxAttemptsToTryTokenLock = 60
+	TokenCacheLock            = "power-openstack-k8s-token.lck"
+	TokenCacheFile            = "/run/power-openstack-k8s/token.json"
 )
 
 // FSTYPES : All linux file systems
@@ -111,4 +111,52 @@ type OSVolume struct {
 	OSVolumeAttrsExt
 }
 
+// VolumeConnection : The connection info Cinder gave for the attachment of a volume to a VM, which tells
+// where the volume shows up on the VM
+type VolumeConnection struct {
+	DriverVolumeType string
+	// WWPNs of the storage ports of a fibre channel attachment
+	TargetWWNs []string
+	// LUN of the volume, or -1 if it isn't known
+	TargetLUN int
+	// Portals of the paths of an iSCSI attachment, with the IQN and LUN of each path
+	TargetPortals []string
+	TargetIQNs    []string
+	TargetLUNs    []int
+	// CHAP credentials of an iSCSI attachment, which must not be logged
+	AuthMethod   string
+	AuthUsername string
+	AuthPassword string
+	// Subsystem and portals of an NVMe over Fabrics attachment, and the namespace of the volume in the
+	// subsystem, found by its NGUID or UUID, or else by its ID if it is not 0
+	TargetNQN   string
+	NVMePortals []NVMePortal
+	VolumeNGUID string
+	VolumeUUID  string
+	NamespaceID int
+}
+
+// NVMePortal : A portal of an NVMe over Fabrics subsystem
+type NVMePortal struct {
+	Address   string
+	Port      string
+	Transport string
+}
+
+// VolumeSnapshot : The parts of the snapshot.storage.k8s.io VolumeSnapshot we need to find its snapshot
+type VolumeSnapshot struct {
+	Status *struct {
+		BoundVolumeSnapshotContentName *string `json:"boundVolumeSnapshotContentName,omitempty"`
+		ReadyToUse                     *bool   `json:"readyToUse,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// VolumeSnapshotContent : The parts of the snapshot.storage.k8s.io VolumeSnapshotContent we need to find its snapshot
+type VolumeSnapshotContent struct {
+	Status *struct {
+		// The ID of the Cinder snapshot
+		SnapshotHandle *string `json:"snapshotHandle,omitempty"`
+	} `json:"status,omitempty"`
+}
+
 /********************** Structure definitions end ************************/
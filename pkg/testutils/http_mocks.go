@@ -15,6 +15,7 @@
 package testutils
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -55,6 +56,63 @@ func MuxHandleCreate(t *testing.T) {
 	})
 }
 
+// Register mux for handling volume create, copying the metadata the volume is created with into volumeMeta
+func MuxHandleCreateWithMetadata(t *testing.T, volumeMeta map[string]string) {
+	Mux.HandleFunc("/volumes", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Volume struct {
+				Metadata map[string]string `json:"metadata"`
+			} `json:"volume"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode the volume create request: %s", err)
+		}
+		for key, value := range body.Volume.Metadata {
+			volumeMeta[key] = value
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `
+{
+  "volume": {
+    "id": "icp-test",
+    "status": "available"
+  }
+}
+    `)
+	})
+}
+
+// Register mux for handling the volume list, returning no volumes
+func MuxHandleListEmpty(t *testing.T) {
+	Mux.HandleFunc("/volumes/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"volumes": []}`)
+	})
+}
+
+// Register mux for handling the volume list, returning the one volume
+func MuxHandleListVolume(t *testing.T, volumeID string, name string, status string, volumeMeta map[string]string) {
+	metadata := marshalMetadata(t, volumeMeta)
+	Mux.HandleFunc("/volumes/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+{
+  "volumes": [
+    {
+      "id": "%s",
+      "name": "%s",
+      "status": "%s",
+      "size": 1,
+      "metadata": %s
+    }
+  ]
+}
+    `, volumeID, name, status, metadata)
+	})
+}
+
 // Register mux for handling volume delete of given volumeID
 func MuxHandleDelete(t *testing.T, volumeID string) {
 	volumePath := fmt.Sprintf("/volumes/%s", volumeID)
@@ -63,6 +121,78 @@ func MuxHandleDelete(t *testing.T, volumeID string) {
 	})
 }
 
+// Register mux for handling volume get of given volumeID
+func MuxHandleGetVolume(t *testing.T, volumeID string, size int, volumeType string) {
+	volumePath := fmt.Sprintf("/volumes/%s", volumeID)
+	Mux.HandleFunc(volumePath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+{
+  "volume": {
+    "id": "%s",
+    "status": "available",
+    "size": %d,
+    "volume_type": "%s"
+  }
+}
+    `, volumeID, size, volumeType)
+	})
+}
+
+// Register mux for handling volume get and delete of given volumeID, which is tagged with the metadata
+func MuxHandleGetAndDeleteVolume(t *testing.T, volumeID string, volumeMeta map[string]string) {
+	metadata := marshalMetadata(t, volumeMeta)
+	volumePath := fmt.Sprintf("/volumes/%s", volumeID)
+	Mux.HandleFunc(volumePath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+{
+  "volume": {
+    "id": "%s",
+    "status": "available",
+    "size": 1,
+    "metadata": %s
+  }
+}
+    `, volumeID, metadata)
+	})
+}
+
+func marshalMetadata(t *testing.T, volumeMeta map[string]string) string {
+	if volumeMeta == nil {
+		volumeMeta = map[string]string{}
+	}
+	metadata, err := json.Marshal(volumeMeta)
+	if err != nil {
+		t.Fatalf("failed to marshal volume metadata: %s", err)
+	}
+	return string(metadata)
+}
+
+// Register mux for handling snapshot get of given snapshotID
+func MuxHandleGetSnapshot(t *testing.T, snapshotID string, size int) {
+	snapshotPath := fmt.Sprintf("/snapshots/%s", snapshotID)
+	Mux.HandleFunc(snapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+{
+  "snapshot": {
+    "id": "%s",
+    "status": "available",
+    "size": %d
+  }
+}
+    `, snapshotID, size)
+	})
+}
+
 func AssertEquals(t *testing.T, received interface{}, expected interface{}) {
 	if received != expected {
 		t.Errorf("expected: %s \n receieved: %s", expected, received)
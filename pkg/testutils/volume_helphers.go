@@ -17,6 +17,8 @@ package testutils
 import (
 	"strings"
 
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 
 	"k8s.io/api/core/v1"
@@ -65,6 +67,41 @@ func MockPVC(testFlags ...string) *v1.PersistentVolumeClaim {
 	return claim
 }
 
+// Creates a data source referring to the VolumeSnapshot with the given name
+func MockSnapshotDataSource(name string) *v1.TypedLocalObjectReference {
+	apiGroup := resources.SnapshotAPIGroup
+	return &v1.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     resources.SnapshotKind,
+		Name:     name,
+	}
+}
+
+// Creates a bound source PVC and its PV, provisioned as the given Cinder volume, to clone from
+func MockSourcePVC(name string, volumeID string, capacity string, claimNamespace string) (*v1.PersistentVolumeClaim, *v1.PersistentVolume) {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-" + name},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv-" + name,
+			Annotations: map[string]string{
+				resources.K8sCreatedBy: resources.ProvisionerNameOnly,
+				resources.OsArgsVolID:  volumeID,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): resource.MustParse(capacity),
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: claimNamespace, Name: name},
+		},
+	}
+	return claim, pv
+}
+
 // Creates a new Persistent Volume resource we can test on
 func MockPV() *v1.PersistentVolume {
 	pv := &v1.PersistentVolume{
@@ -79,7 +116,7 @@ func MockPV() *v1.PersistentVolume {
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeSource: v1.PersistentVolumeSource{
-				FlexVolume: &v1.FlexVolumeSource{
+				FlexVolume: &v1.FlexPersistentVolumeSource{
 					Driver:   "ibm/power-openstack-k8s-volume-flex",
 					ReadOnly: true,
 					Options: map[string]string{
@@ -0,0 +1,132 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// Clients which haven't been used for this long are dropped, like the ones of credentials that were rotated
+const clientIdleTimeout = time.Hour
+
+// ClientCache : Holds one authenticated OpenStack client per set of credentials, so that callers share
+// the token instead of authenticating to Keystone on every call. It is safe for concurrent use.
+type ClientCache struct {
+	lock    sync.Mutex
+	clients map[string]*cachedClient
+	// The clients of secrets are dropped once they are idle for this long
+	idleTimeout time.Duration
+	// newClient authenticates with the secret data, or with the process configuration when it is nil
+	newClient func(secretData map[string]string) (OpenstackCloudI, error)
+}
+
+// cachedClient : The client of one set of credentials, whose lock is held while authenticating so that
+// only the callers of these credentials wait for Keystone
+type cachedClient struct {
+	lock   sync.Mutex
+	client OpenstackCloudI
+	// Guarded by the lock of the cache
+	lastUsed time.Time
+}
+
+// NewClientCache : Returns an empty cache which authenticates with the OpenStack configuration or secrets
+func NewClientCache() *ClientCache {
+	return &ClientCache{
+		clients:     make(map[string]*cachedClient),
+		idleTimeout: clientIdleTimeout,
+		newClient: func(secretData map[string]string) (OpenstackCloudI, error) {
+			if secretData == nil {
+				return CreateOpenstackClient()
+			}
+			return CreateOpenstackClientFromSecret(secretData)
+		},
+	}
+}
+
+// GetOpenstackClient : Returns the client for the credentials in the secret data, or for the process
+// configuration when it is nil, authenticating only the first time the credentials are seen
+func (c *ClientCache) GetOpenstackClient(secretData map[string]string) (OpenstackCloudI, error) {
+	key := credentialsKey(secretData)
+	c.lock.Lock()
+	now := time.Now()
+	c.dropIdleClients(now)
+	entry, ok := c.clients[key]
+	if !ok {
+		entry = &cachedClient{}
+		c.clients[key] = entry
+	}
+	entry.lastUsed = now
+	c.lock.Unlock()
+
+	// Concurrent workers with the same credentials wait for a single authentication, while the
+	// workers of other credentials go on
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+	if entry.client == nil {
+		client, err := c.newClient(secretData)
+		if err != nil {
+			return nil, err
+		}
+		entry.client = client
+	}
+	return entry.client, nil
+}
+
+// dropIdleClients : Drops the clients of the secrets which haven't been used for the idle timeout. The client
+// of the process configuration is kept. Must be called with the lock of the cache held.
+func (c *ClientCache) dropIdleClients(now time.Time) {
+	for key, entry := range c.clients {
+		if key != "" && now.Sub(entry.lastUsed) > c.idleTimeout {
+			delete(c.clients, key)
+		}
+	}
+}
+
+// GetCinderClient : Returns a Cinder client sharing the token of the cached client for the credentials
+func (c *ClientCache) GetCinderClient(secretData map[string]string) (*gophercloud.ServiceClient, error) {
+	client, err := c.GetOpenstackClient(secretData)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewVolumeV3()
+}
+
+// credentialsKey : Returns the cache key of the credentials, which is a hash of the secret data so that
+// an updated secret gets a new client and the credentials aren't kept around as map keys
+func credentialsKey(secretData map[string]string) string {
+	if secretData == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(secretData))
+	for key := range secretData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		// Separate the fields so that moving characters between a key and its value changes the hash
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(secretData[key]))
+		hash.Write([]byte{0})
+	}
+	return "secret-" + hex.EncodeToString(hash.Sum(nil))
+}
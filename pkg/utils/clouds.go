@@ -0,0 +1,158 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cloudsFile : The parts of an OpenStack clouds.yaml file that the drivers use
+type cloudsFile struct {
+	Clouds map[string]cloudEntry `yaml:"clouds"`
+}
+
+type cloudEntry struct {
+	Auth       cloudAuth `yaml:"auth"`
+	AuthType   string    `yaml:"auth_type"`
+	RegionName string    `yaml:"region_name"`
+	Interface  string    `yaml:"interface"`
+	CACert     string    `yaml:"cacert"`
+	Verify     *bool     `yaml:"verify"`
+}
+
+type cloudAuth struct {
+	AuthURL                     string `yaml:"auth_url"`
+	Username                    string `yaml:"username"`
+	UserID                      string `yaml:"user_id"`
+	Password                    string `yaml:"password"`
+	ProjectName                 string `yaml:"project_name"`
+	ProjectID                   string `yaml:"project_id"`
+	DomainName                  string `yaml:"domain_name"`
+	DomainID                    string `yaml:"domain_id"`
+	UserDomainName              string `yaml:"user_domain_name"`
+	UserDomainID                string `yaml:"user_domain_id"`
+	ProjectDomainName           string `yaml:"project_domain_name"`
+	ProjectDomainID             string `yaml:"project_domain_id"`
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialName   string `yaml:"application_credential_name"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	Token                       string `yaml:"token"`
+}
+
+// toConfig : Returns the settings of the cloud under the names of the OpenStack environment variables
+func (cloud *cloudEntry) toConfig() map[string]string {
+	config := map[string]string{
+		resources.OSAuthURL:             cloud.Auth.AuthURL,
+		resources.OSUser:                cloud.Auth.Username,
+		resources.OSUserID:              cloud.Auth.UserID,
+		resources.OSPassword:            cloud.Auth.Password,
+		resources.OSProjectNameV3:       cloud.Auth.ProjectName,
+		resources.OSProjectIDV3:         cloud.Auth.ProjectID,
+		resources.OSDomainName:          cloud.Auth.DomainName,
+		resources.OSDomainID:            cloud.Auth.DomainID,
+		resources.OSUserDomain:          cloud.Auth.UserDomainName,
+		resources.OSUserDomainID:        cloud.Auth.UserDomainID,
+		resources.OSProjectDomain:       cloud.Auth.ProjectDomainName,
+		resources.OSProjectDomainID:     cloud.Auth.ProjectDomainID,
+		resources.OSAppCredentialID:     cloud.Auth.ApplicationCredentialID,
+		resources.OSAppCredentialName:   cloud.Auth.ApplicationCredentialName,
+		resources.OSAppCredentialSecret: cloud.Auth.ApplicationCredentialSecret,
+		resources.OSToken:               cloud.Auth.Token,
+		resources.OSAuthType:            cloud.AuthType,
+		resources.OSRegionName:          cloud.RegionName,
+		resources.OSInterface:           cloud.Interface,
+		resources.OSCACert:              cloud.CACert,
+	}
+	// The clouds.yaml auth types use underscores where the environment variable ones don't
+	if cloud.AuthType == "v3_application_credential" || cloud.AuthType == "application_credential" {
+		config[resources.OSAuthType] = resources.AuthTypeAppCredential
+	} else if cloud.AuthType == "token" {
+		config[resources.OSAuthType] = resources.AuthTypeToken
+	}
+	// Leave out what isn't set so it can still come from the environment
+	for key, value := range config {
+		if value == "" {
+			delete(config, key)
+		}
+	}
+	// Without a certificate we don't verify the server, whatever the environment says
+	if cloud.Verify != nil && !*cloud.Verify {
+		config[resources.OSCACert] = ""
+	}
+	return config
+}
+
+// cloudsFilePaths : Returns where to look for the clouds.yaml file, in the order the OpenStack clients look
+func cloudsFilePaths() []string {
+	if path := os.Getenv(resources.OSClientConfigFile); path != "" {
+		return []string{path}
+	}
+	cmdDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	paths := []string{"clouds.yaml", filepath.Join(cmdDir, "clouds.yaml")}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	return append(paths, "/etc/openstack/clouds.yaml")
+}
+
+// loadCloudConfig : Returns the settings of the named cloud from the first clouds.yaml file found
+func loadCloudConfig(cloudName string) (map[string]string, error) {
+	for _, path := range cloudsFilePaths() {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read clouds file %s. Error is %s", path, err)
+		}
+		var clouds cloudsFile
+		if err := yaml.Unmarshal(data, &clouds); err != nil {
+			return nil, fmt.Errorf("Could not parse clouds file %s. Error is %s", path, err)
+		}
+		cloud, ok := clouds.Clouds[cloudName]
+		if !ok {
+			return nil, fmt.Errorf("Cloud %s is not in clouds file %s", cloudName, path)
+		}
+		log.Debugf("Using cloud %s from clouds file %s", cloudName, path)
+		return cloud.toConfig(), nil
+	}
+	return nil, fmt.Errorf("Could not find a clouds.yaml file for cloud %s", cloudName)
+}
+
+// configFromEnv : Returns how to look up the OpenStack settings of the process, which come from the cloud
+// named by OS_CLOUD in clouds.yaml if set, and otherwise or when not in the cloud from the environment
+func configFromEnv() (func(string) string, error) {
+	cloudName := os.Getenv(resources.OSCloud)
+	if cloudName == "" {
+		return os.Getenv, nil
+	}
+	cloudConfig, err := loadCloudConfig(cloudName)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) string {
+		if value, ok := cloudConfig[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}, nil
+}
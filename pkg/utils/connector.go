@@ -0,0 +1,74 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"sort"
+	"sync"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+)
+
+// Connector : Connects the node to the storage targets of the volumes whose connection type needs it, as
+// these volumes don't show up on the node after a SCSI rescan like the vSCSI, NPIV and virtio ones do
+type Connector interface {
+	// ConnectVolume connects to the targets of the connection and returns the device of the volume,
+	// which is the multipath device if the volume has several paths
+	ConnectVolume(conn *resources.VolumeConnection) (string, error)
+	// PrepareDisconnect returns the function which disconnects from the targets of the devices once the
+	// devices are removed from the node, or nil if the devices aren't connected through this connector
+	PrepareDisconnect(devices []string) func() error
+}
+
+var (
+	connectorsLock sync.RWMutex
+	// Connectors keyed by the driver_volume_type of the connection info
+	connectors = map[string]Connector{}
+)
+
+func init() {
+	RegisterConnector(resources.DriverVolumeTypeISCSI, NewISCSIConnector(NewExec()))
+	RegisterConnector(resources.DriverVolumeTypeNVMeoF, NewNVMeConnector(NewExec()))
+}
+
+// RegisterConnector : Registers the connector of the driver volume type, replacing the one registered before
+func RegisterConnector(driverVolumeType string, connector Connector) {
+	connectorsLock.Lock()
+	defer connectorsLock.Unlock()
+	connectors[driverVolumeType] = connector
+}
+
+// GetConnector : Returns the connector of the driver volume type, or nil if its volumes show up on their own
+func GetConnector(driverVolumeType string) Connector {
+	connectorsLock.RLock()
+	defer connectorsLock.RUnlock()
+	return connectors[driverVolumeType]
+}
+
+// Connectors : Returns the registered connectors, in the order of their driver volume types
+func Connectors() []Connector {
+	connectorsLock.RLock()
+	defer connectorsLock.RUnlock()
+	var types []string
+	for driverVolumeType := range connectors {
+		types = append(types, driverVolumeType)
+	}
+	sort.Strings(types)
+	var registered []Connector
+	for _, driverVolumeType := range types {
+		registered = append(registered, connectors[driverVolumeType])
+	}
+	return registered
+}
@@ -0,0 +1,193 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+)
+
+// DeviceResolver : Predicts the path where an attached volume will show up on the VM
+type DeviceResolver interface {
+	DevicePath(volume *resources.OSVolume) string
+}
+
+// ByIDResolver : Resolves the device path to a /dev/disk/by-id link named after the volume ID or WWN.
+// It is the resolver of the built-in backends and of the ones added through the configuration file.
+type ByIDResolver struct {
+	// The hypervisor type and storage host type the resolver is for. An empty storage host type
+	// makes it the default of the hypervisor type.
+	HypervisorType  string `json:"hypervisorType"`
+	StorageHostType string `json:"storageHostType,omitempty"`
+	// Prefix of the name of the link, like wwn-0x
+	Prefix string `json:"prefix"`
+	// Source of the rest of the name, either the volume "id" or its "wwn"
+	Source string `json:"source"`
+	// Transform of the source, applied in this order
+	StripDashes bool `json:"stripDashes,omitempty"`
+	Lowercase   bool `json:"lowercase,omitempty"`
+	Length      int  `json:"length,omitempty"`
+}
+
+// DevicePath : Returns the by-id link of the volume
+func (r *ByIDResolver) DevicePath(volume *resources.OSVolume) string {
+	var value string
+	if r.Source == resources.DeviceResolverSourceID {
+		value = volume.ID
+	} else {
+		value = volume.Metadata["volume_wwn"]
+	}
+	if r.StripDashes {
+		value = strings.Replace(value, "-", "", -1)
+	}
+	if r.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if r.Length > 0 && len(value) > r.Length {
+		value = value[:r.Length]
+	}
+	return resources.AttachedVolumeDir + r.Prefix + value
+}
+
+// validate : Checks a resolver read from the configuration file
+func (r *ByIDResolver) validate() error {
+	if r.HypervisorType == "" || r.Prefix == "" {
+		return fmt.Errorf("Device resolver %+v needs a hypervisor type and a prefix", *r)
+	}
+	if r.Source != resources.DeviceResolverSourceID && r.Source != resources.DeviceResolverSourceWWN {
+		return fmt.Errorf("Device resolver %+v has source %q, it should be %q or %q", *r, r.Source,
+			resources.DeviceResolverSourceID, resources.DeviceResolverSourceWWN)
+	}
+	return nil
+}
+
+var (
+	deviceResolversLock sync.RWMutex
+	// Resolvers keyed by hypervisor type and then storage host type
+	deviceResolvers      = map[string]map[string]DeviceResolver{}
+	loadDeviceResolvers  sync.Once
+	builtinByIDResolvers = []ByIDResolver{
+		// The serial number QEMU gives the disk is limited to 20 characters
+		{HypervisorType: resources.HypTypeLibvirt,
+			Prefix: resources.DirNamePrefixKVM, Source: resources.DeviceResolverSourceID, Length: 20},
+		{HypervisorType: resources.HypTypeKVM,
+			Prefix: resources.DirNamePrefixKVM, Source: resources.DeviceResolverSourceID, Length: 20},
+		{HypervisorType: resources.HypTypePvmKVM,
+			Prefix: resources.DirNamePrefixKVM, Source: resources.DeviceResolverSourceID, Length: 20},
+		// PowerVM VIOS with SVC, which is also used when the storage host isn't registered
+		{HypervisorType: resources.HypTypePhyp,
+			Prefix: resources.DirNamePVMVIOS, Source: resources.DeviceResolverSourceWWN, Lowercase: true},
+		{HypervisorType: resources.HypTypePvm,
+			Prefix: resources.DirNamePVMVIOS, Source: resources.DeviceResolverSourceWWN, Lowercase: true},
+		// PowerVM LIO
+		{HypervisorType: resources.HypTypePhyp, StorageHostType: resources.StorageHostTypeGPFS,
+			Prefix: resources.DirNamePrefixPVMLIO, Source: resources.DeviceResolverSourceID, StripDashes: true, Length: 25},
+		{HypervisorType: resources.HypTypePvm, StorageHostType: resources.StorageHostTypeGPFS,
+			Prefix: resources.DirNamePrefixPVMLIO, Source: resources.DeviceResolverSourceID, StripDashes: true, Length: 25},
+		// PowerVM VIOS with XIV
+		{HypervisorType: resources.HypTypePhyp, StorageHostType: resources.StorageHostTypeXIV,
+			Prefix: resources.DirNamePrefixPVMXIV, Source: resources.DeviceResolverSourceWWN, Lowercase: true},
+		{HypervisorType: resources.HypTypePvm, StorageHostType: resources.StorageHostTypeXIV,
+			Prefix: resources.DirNamePrefixPVMXIV, Source: resources.DeviceResolverSourceWWN, Lowercase: true},
+	}
+)
+
+func init() {
+	for i := range builtinByIDResolvers {
+		resolver := &builtinByIDResolvers[i]
+		RegisterDeviceResolver(resolver.HypervisorType, resolver.StorageHostType, resolver)
+	}
+}
+
+// RegisterDeviceResolver : Registers the resolver of the hypervisor type and storage host type, replacing the
+// one registered before. An empty storage host type registers the default resolver of the hypervisor type.
+func RegisterDeviceResolver(hypervisorType string, storageHostType string, resolver DeviceResolver) {
+	deviceResolversLock.Lock()
+	defer deviceResolversLock.Unlock()
+	if deviceResolvers[hypervisorType] == nil {
+		deviceResolvers[hypervisorType] = map[string]DeviceResolver{}
+	}
+	deviceResolvers[hypervisorType][storageHostType] = resolver
+}
+
+// FindDeviceResolver : Returns the resolver of the hypervisor type and storage host type, or the default of
+// the hypervisor type if the storage host type has none. It is nil if the hypervisor type has no resolver.
+func FindDeviceResolver(hypervisorType string, storageHostType string) DeviceResolver {
+	loadDeviceResolvers.Do(loadDeviceResolversFromConfig)
+	deviceResolversLock.RLock()
+	defer deviceResolversLock.RUnlock()
+	resolvers := deviceResolvers[hypervisorType]
+	if resolver, ok := resolvers[storageHostType]; ok {
+		return resolver
+	}
+	return resolvers[""]
+}
+
+// HasStorageDeviceResolvers : Tells if the resolver of the hypervisor type depends on the storage host type,
+// in which case the storage host registration of the volume has to be looked up
+func HasStorageDeviceResolvers(hypervisorType string) bool {
+	loadDeviceResolvers.Do(loadDeviceResolversFromConfig)
+	deviceResolversLock.RLock()
+	defer deviceResolversLock.RUnlock()
+	for storageHostType := range deviceResolvers[hypervisorType] {
+		if storageHostType != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDeviceResolversFromConfig : Registers the resolvers of the JSON file named by the configuration,
+// which is a list of ByIDResolver
+func loadDeviceResolversFromConfig() {
+	configFile := os.Getenv(resources.DeviceResolversFile)
+	if configFile == "" {
+		return
+	}
+	resolvers, err := ReadDeviceResolvers(configFile)
+	if err != nil {
+		log.Errorf("Could not load the device resolvers. Error is %s", err)
+		return
+	}
+	for _, resolver := range resolvers {
+		log.Infof("Adding device resolver of hypervisor type %s and storage host type %s",
+			resolver.HypervisorType, resolver.StorageHostType)
+		RegisterDeviceResolver(resolver.HypervisorType, resolver.StorageHostType, resolver)
+	}
+}
+
+// ReadDeviceResolvers : Returns the resolvers of the JSON file
+func ReadDeviceResolvers(configFile string) ([]*ByIDResolver, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read device resolvers file %s. Error is %s", configFile, err)
+	}
+	var resolvers []*ByIDResolver
+	if err := json.Unmarshal(data, &resolvers); err != nil {
+		return nil, fmt.Errorf("Could not parse device resolvers file %s. Error is %s", configFile, err)
+	}
+	for _, resolver := range resolvers {
+		if err := resolver.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return resolvers, nil
+}
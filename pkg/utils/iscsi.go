@@ -0,0 +1,229 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+)
+
+// The session a SCSI device belongs to is in the sysfs path of the device, like
+// /sys/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb
+var iscsiSessionPattern = regexp.MustCompile(`/(session[0-9]+)/`)
+
+// ISCSIConnector : Logs in to the iSCSI targets of the volumes, and out of them once they have no LUN left
+type ISCSIConnector struct {
+	exec Exec
+	// The directories of the /dev/disk/by-path links and of sysfs, which the tests replace
+	byPathDir string
+	sysDir    string
+	// The time to wait between two looks for the LUN
+	interval time.Duration
+}
+
+// NewISCSIConnector : Returns the iSCSI connector running iscsiadm with the Exec
+func NewISCSIConnector(exec Exec) *ISCSIConnector {
+	return &ISCSIConnector{exec: exec, byPathDir: resources.ByPathDir, sysDir: "/sys", interval: 5 * time.Second}
+}
+
+// iscsiPath : A path to the LUN of a volume
+type iscsiPath struct {
+	portal string
+	iqn    string
+	lun    int
+}
+
+// paths : Returns the paths of the connection. Targets with the same IQN on all their portals only give
+// it once, and the LUN of every path is the same unless the connection lists them.
+func (c *ISCSIConnector) paths(conn *resources.VolumeConnection) []iscsiPath {
+	var paths []iscsiPath
+	for i, portal := range conn.TargetPortals {
+		path := iscsiPath{portal: portal, lun: conn.TargetLUN}
+		if i < len(conn.TargetIQNs) {
+			path.iqn = conn.TargetIQNs[i]
+		} else if len(conn.TargetIQNs) > 0 {
+			path.iqn = conn.TargetIQNs[0]
+		}
+		if i < len(conn.TargetLUNs) {
+			path.lun = conn.TargetLUNs[i]
+		}
+		if path.iqn != "" && path.lun >= 0 {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// byPathLink : Returns the link udev creates for the LUN of the path
+func (c *ISCSIConnector) byPathLink(path iscsiPath) string {
+	return filepath.Join(c.byPathDir, fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", path.portal, path.iqn, path.lun))
+}
+
+// iscsiadm : Runs iscsiadm on the node record of the path
+func (c *ISCSIConnector) iscsiadm(path iscsiPath, args ...string) (string, error) {
+	args = append([]string{"-m", "node", "-T", path.iqn, "-p", path.portal}, args...)
+	stdout, stderr, err := c.exec.Run(resources.CMDISCSIAdm, args...)
+	if err != nil {
+		return stdout, fmt.Errorf("%s %s", err, strings.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
+
+// login : Logs in to the target of the path, with CHAP if the connection has credentials, or rescans the
+// session if we are already logged in so that a LUN mapped since then shows up
+func (c *ISCSIConnector) login(path iscsiPath, conn *resources.VolumeConnection) error {
+	// The node record may exist already from an earlier volume of the target
+	if _, err := c.iscsiadm(path, "-o", "new"); err != nil {
+		log.Debugf("Could not create node record of %s at %s. Error is %s", path.iqn, path.portal, err)
+	}
+	var settings [][]string
+	if conn.AuthMethod != "" {
+		settings = append(settings,
+			[]string{"node.session.auth.authmethod", conn.AuthMethod},
+			[]string{"node.session.auth.username", conn.AuthUsername},
+			[]string{"node.session.auth.password", conn.AuthPassword})
+	}
+	// Log in again after a reboot of the node, until we log out
+	settings = append(settings, []string{"node.startup", "automatic"})
+	for _, setting := range settings {
+		if _, err := c.iscsiadm(path, "-o", "update", "-n", setting[0], "-v", setting[1]); err != nil {
+			// Don't log the error, which holds the password
+			return fmt.Errorf("Could not set %s of node record of %s at %s", setting[0], path.iqn, path.portal)
+		}
+	}
+	_, err := c.iscsiadm(path, "--login")
+	if err != nil && strings.Contains(err.Error(), "already present") {
+		log.Debugf("Already logged in to %s at %s, rescanning its session", path.iqn, path.portal)
+		_, err = c.iscsiadm(path, "--rescan")
+	}
+	if err != nil {
+		return fmt.Errorf("Could not log in to %s at %s. Error is %s", path.iqn, path.portal, err)
+	}
+	return nil
+}
+
+// ConnectVolume : Logs in to all the portals of the connection and waits for the LUN to show up on them
+func (c *ISCSIConnector) ConnectVolume(conn *resources.VolumeConnection) (string, error) {
+	paths := c.paths(conn)
+	if len(paths) == 0 {
+		return "", fmt.Errorf("The iSCSI connection has no target portal, IQN and LUN")
+	}
+	// A path which can't log in is only an error if no path can
+	var loggedIn []iscsiPath
+	var loginErr error
+	for _, path := range paths {
+		if err := c.login(path, conn); err != nil {
+			log.Warningf("%s", err)
+			loginErr = err
+			continue
+		}
+		loggedIn = append(loggedIn, path)
+	}
+	if len(loggedIn) == 0 {
+		return "", loginErr
+	}
+
+	for i := 0; i < resources.MaxAttemptsToFindVolume; i++ {
+		if i > 0 {
+			time.Sleep(c.interval)
+		}
+		var found []string
+		for _, path := range loggedIn {
+			if _, err := os.Stat(c.byPathLink(path)); err == nil {
+				found = append(found, c.byPathLink(path))
+			}
+		}
+		// Give multipathd the time to put the other paths together with the first one
+		if len(found) == 0 || (len(found) < len(loggedIn) && i < resources.MaxAttemptsToFindVolume/2) {
+			log.Debugf("Found %d of the %d paths of the iSCSI volume", len(found), len(loggedIn))
+			continue
+		}
+		devicePath := FindAttachedVolumeDirectoryPath(found[0])
+		if devicePath == "" {
+			return "", fmt.Errorf("Could not find the device of %s", found[0])
+		}
+		log.Debugf("Found device %s of the iSCSI volume at %s", devicePath, found[0])
+		return devicePath, nil
+	}
+	return "", fmt.Errorf("Could not find LUN %d of the iSCSI volume on target %s", loggedIn[0].lun, loggedIn[0].iqn)
+}
+
+// PrepareDisconnect : Finds the iSCSI sessions of the devices, and returns the function logging out of the
+// sessions which have no LUN left
+func (c *ISCSIConnector) PrepareDisconnect(devices []string) func() error {
+	sessions := make(map[string]bool)
+	for _, device := range devices {
+		devicePath, err := filepath.EvalSymlinks(filepath.Join(c.sysDir, "block", filepath.Base(device)))
+		if err != nil {
+			continue
+		}
+		if match := iscsiSessionPattern.FindStringSubmatch(devicePath); match != nil {
+			sessions[match[1]] = true
+		}
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+	return func() error {
+		for session := range sessions {
+			if err := c.logoutIfUnused(session); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// logoutIfUnused : Logs out of the session if none of its LUNs is left on the node, and deletes the node
+// record of the session so that the node doesn't log in again after a reboot
+func (c *ISCSIConnector) logoutIfUnused(session string) error {
+	sessionDir := filepath.Join(c.sysDir, "class", "iscsi_session", session)
+	luns, _ := filepath.Glob(filepath.Join(sessionDir, "device", "target*", "*:*:*:*"))
+	if len(luns) > 0 {
+		log.Debugf("iSCSI %s still has %d LUNs, staying logged in", session, len(luns))
+		return nil
+	}
+	iqn, err := ioutil.ReadFile(filepath.Join(sessionDir, "targetname"))
+	if err != nil {
+		// The session is gone already
+		return nil
+	}
+	connectionDir := filepath.Join(c.sysDir, "class", "iscsi_connection",
+		strings.Replace(session, "session", "connection", 1)+":0")
+	addressData, _ := ioutil.ReadFile(filepath.Join(connectionDir, "persistent_address"))
+	portData, _ := ioutil.ReadFile(filepath.Join(connectionDir, "persistent_port"))
+	address, port := strings.TrimSpace(string(addressData)), strings.TrimSpace(string(portData))
+	// IPv6 addresses are in brackets in the portals of iscsiadm
+	if strings.Contains(address, ":") {
+		address = "[" + address + "]"
+	}
+	path := iscsiPath{portal: address + ":" + port, iqn: strings.TrimSpace(string(iqn))}
+
+	log.Infof("Logging out of %s at %s, which has no LUN left", path.iqn, path.portal)
+	if _, err := c.iscsiadm(path, "--logout"); err != nil {
+		return fmt.Errorf("Could not log out of %s at %s. Error is %s", path.iqn, path.portal, err)
+	}
+	if _, err := c.iscsiadm(path, "-o", "delete"); err != nil {
+		log.Warningf("Could not delete node record of %s at %s. Error is %s", path.iqn, path.portal, err)
+	}
+	return nil
+}
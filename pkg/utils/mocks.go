@@ -15,7 +15,11 @@
 package util
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/gophercloud/gophercloud"
+	snapshots_v3 "github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
 	volumes_v3 "github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/hypervisors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
@@ -40,10 +44,19 @@ VM2 represents KVM virtio-scsi
 VM3 represents PowerVM VIOS for XIV
 VM4 represents PowerVM LIO
 VM5 represents Openstack VM on PowerVM
+
+Snapshots:
+snap_1 : { volume: vol_1, size: 1 }
+snap_2 : { volume: vol_2, size: 5 }
 */
 
 // OpenstackCloudMock : Our mock that we will plug in for tests.
-type OpenstackCloudMock struct{}
+type OpenstackCloudMock struct {
+	// Volumes whose kubernetes volume name was removed from their metadata
+	unnamedVolumes map[string]bool
+	// Error of the Nova lookup of the attachments
+	AttachedErr error
+}
 
 /*****  Implement OpenstackCloudI interface methods  *****/
 
@@ -52,6 +65,11 @@ func (opnStk *OpenstackCloudMock) GetProviderClient() *gophercloud.ProviderClien
 	return nil
 }
 
+// NewVolumeV3 : Returns the fake cinder service client backed by FakeServer
+func (opnStk *OpenstackCloudMock) NewVolumeV3() (*gophercloud.ServiceClient, error) {
+	return FakeServiceClient(), nil
+}
+
 // AttachVolumeToVM :
 func (opnStk *OpenstackCloudMock) AttachVolumeToVM(vmID string, volumeID string, volume *resources.OSVolume) (bool, error) {
 	if vmID == "vm_1" && volumeID == "vol_1" {
@@ -67,6 +85,9 @@ func (opnStk *OpenstackCloudMock) DetachVolumeFromVM(vmID string, volumeID strin
 
 // IsVolumeAttached :
 func (opnStk *OpenstackCloudMock) IsVolumeAttached(vmID string, volumeID string) (bool, error) {
+	if opnStk.AttachedErr != nil {
+		return false, opnStk.AttachedErr
+	}
 	if vmID == "vm_1" && volumeID == "vol_1" {
 		return true, nil
 	}
@@ -77,6 +98,9 @@ func (opnStk *OpenstackCloudMock) IsVolumeAttached(vmID string, volumeID string)
 func (opnStk *OpenstackCloudMock) GetVolumeByMetadataProperty(
 	volumeMeta map[string]string) (*[]resources.OSVolume, error) {
 	volID := volumeMeta[resources.OsK8sVolumeNameMeta]
+	if opnStk.unnamedVolumes[volID] {
+		return nil, VolumeMappingNotFoundError{VolumeMeta: volumeMeta}
+	}
 	vol, _ := GetOSVolumeByID(opnStk, volID)
 	vols := []resources.OSVolume{*vol}
 	return &vols, nil
@@ -84,6 +108,12 @@ func (opnStk *OpenstackCloudMock) GetVolumeByMetadataProperty(
 
 // UpdateVolumeMetadata :
 func (opnStk *OpenstackCloudMock) UpdateVolumeMetadata(volumeID string, volumeMeta map[string]string, isDelete bool) error {
+	if _, ok := volumeMeta[resources.OsK8sVolumeNameMeta]; ok && isDelete {
+		if opnStk.unnamedVolumes == nil {
+			opnStk.unnamedVolumes = make(map[string]bool)
+		}
+		opnStk.unnamedVolumes[volumeID] = true
+	}
 	return nil
 }
 
@@ -176,6 +206,7 @@ func (opnStk *OpenstackCloudMock) GetOSVolumeByID(volumeID string) (*resources.O
 			ID:          "05a0a13c-f839-4c67-bd02-28b6fb6fada3",
 			Metadata:    map[string]string{"volume_wwn": "wwn_1"},
 			Attachments: []volumes_v3.Attachment{volAttachment},
+			Status:      "in-use",
 		}
 		attrs := resources.OSVolumeAttrsExt{
 			BackendHost: "svc",
@@ -187,6 +218,7 @@ func (opnStk *OpenstackCloudMock) GetOSVolumeByID(volumeID string) (*resources.O
 			ID:          "9ddd4949-5117-4ad8-82b2-8ab37b690078",
 			Metadata:    map[string]string{"volume_wwn": "wwn_2"},
 			Attachments: []volumes_v3.Attachment{volAttachment},
+			Status:      "in-use",
 		}
 		attrs := resources.OSVolumeAttrsExt{
 			BackendHost: "gpfs_host",
@@ -198,6 +230,7 @@ func (opnStk *OpenstackCloudMock) GetOSVolumeByID(volumeID string) (*resources.O
 			ID:          "9ddd4949-5117-4ad8-82b2-8ab37b690079",
 			Metadata:    map[string]string{"volume_wwn": "wwn_3"},
 			Attachments: []volumes_v3.Attachment{volAttachment},
+			Status:      "in-use",
 		}
 		attrs := resources.OSVolumeAttrsExt{
 			BackendHost: "xiv_host",
@@ -209,6 +242,7 @@ func (opnStk *OpenstackCloudMock) GetOSVolumeByID(volumeID string) (*resources.O
 			ID:          "9ddd4949-5117-4ad8-82b2-8ab37b690080",
 			Metadata:    map[string]string{"volume_wwn": "wwn_4"},
 			Attachments: []volumes_v3.Attachment{volAttachment},
+			Status:      "in-use",
 		}
 		attrs := resources.OSVolumeAttrsExt{
 			BackendHost: "gpfs_host",
@@ -220,6 +254,7 @@ func (opnStk *OpenstackCloudMock) GetOSVolumeByID(volumeID string) (*resources.O
 			ID:          "9ddd4949-5117-4ad8-82b2-8ab37b690081",
 			Metadata:    map[string]string{"volume_wwn": "wwn_5"},
 			Attachments: []volumes_v3.Attachment{volAttachment},
+			Status:      "in-use",
 		}
 		attrs := resources.OSVolumeAttrsExt{
 			BackendHost: "generic",
@@ -244,3 +279,166 @@ func (opnStk *OpenstackCloudMock) GetStorageHostRegistration(hostname string) (*
 	}
 	return &regData, nil
 }
+
+// GetVolumeConnection :
+func (opnStk *OpenstackCloudMock) GetVolumeConnection(volumeID string, vmID string) (*resources.VolumeConnection, error) {
+	if vmID == "vm_1" && volumeID == "vol_1" {
+		return &resources.VolumeConnection{
+			DriverVolumeType: "fibre_channel",
+			TargetWWNs:       []string{"500507680b215660", "500507680b225660"},
+			TargetLUN:        1,
+		}, nil
+	}
+	return nil, nil
+}
+
+// CreateSnapshot :
+func (opnStk *OpenstackCloudMock) CreateSnapshot(volumeID string, name string, snapMeta map[string]string) (*snapshots_v3.Snapshot, error) {
+	snapshot := snapshots_v3.Snapshot{
+		ID:       "snap_" + name,
+		Name:     name,
+		VolumeID: volumeID,
+		Status:   "available",
+		Size:     1,
+		Metadata: snapMeta,
+	}
+	return &snapshot, nil
+}
+
+// GetSnapshotByID :
+func (opnStk *OpenstackCloudMock) GetSnapshotByID(snapshotID string) (*snapshots_v3.Snapshot, error) {
+	snaps, _ := opnStk.ListSnapshots(snapshots_v3.ListOpts{})
+	for _, snap := range *snaps {
+		if snap.ID == snapshotID {
+			return &snap, nil
+		}
+	}
+	return nil, gophercloud.ErrDefault404{}
+}
+
+// ListSnapshots :
+func (opnStk *OpenstackCloudMock) ListSnapshots(snapOpts snapshots_v3.ListOpts) (*[]snapshots_v3.Snapshot, error) {
+	snap1 := snapshots_v3.Snapshot{ID: "snap_1", Name: "snap_1", VolumeID: "vol_1", Status: "available", Size: 1}
+	snap2 := snapshots_v3.Snapshot{ID: "snap_2", Name: "snap_2", VolumeID: "vol_2", Status: "available", Size: 5}
+	snaps := []snapshots_v3.Snapshot{}
+	for _, snap := range []snapshots_v3.Snapshot{snap1, snap2} {
+		if (snapOpts.VolumeID == "" || snapOpts.VolumeID == snap.VolumeID) &&
+			(snapOpts.Name == "" || snapOpts.Name == snap.Name) {
+			snaps = append(snaps, snap)
+		}
+	}
+	return &snaps, nil
+}
+
+// DeleteSnapshot :
+func (opnStk *OpenstackCloudMock) DeleteSnapshot(snapshotID string) error {
+	if _, err := opnStk.GetSnapshotByID(snapshotID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ExtendVolume :
+func (opnStk *OpenstackCloudMock) ExtendVolume(volumeID string, newSizeGB int) (*resources.OSVolume, error) {
+	vol, _ := opnStk.GetOSVolumeByID(volumeID)
+	if vol.ID == "" {
+		return nil, gophercloud.ErrDefault404{}
+	}
+	vol.Size = newSizeGB
+	return vol, nil
+}
+
+/*****  Implement Mounter interface methods  *****/
+
+// FakeMounter : Keeps the mounts in memory so the node operations can be tested without touching the node
+type FakeMounter struct {
+	// MountPoints maps the mounted targets to their source
+	MountPoints map[string]string
+	// Options holds the mount options of each target
+	Options map[string][]string
+	// FileSystems maps the formatted devices to their file system type
+	FileSystems map[string]string
+	// Actions records the operations in the order they were called, like "mount /dev/sdb /mnt"
+	Actions []string
+	// Err, when set, is returned by all the operations that change the mounts
+	Err error
+}
+
+// NewFakeMounter : Returns a FakeMounter without any mounts
+func NewFakeMounter() *FakeMounter {
+	return &FakeMounter{
+		MountPoints: make(map[string]string),
+		Options:     make(map[string][]string),
+		FileSystems: make(map[string]string),
+	}
+}
+
+// Mount :
+func (m *FakeMounter) Mount(source string, target string, fsType string, options []string) error {
+	m.Actions = append(m.Actions, fmt.Sprintf("mount %s %s %s", source, target, strings.Join(options, ",")))
+	if m.Err != nil {
+		return m.Err
+	}
+	m.MountPoints[target] = source
+	m.Options[target] = options
+	return nil
+}
+
+// Unmount :
+func (m *FakeMounter) Unmount(target string) error {
+	m.Actions = append(m.Actions, "unmount "+target)
+	if m.Err != nil {
+		return m.Err
+	}
+	if _, ok := m.MountPoints[target]; !ok {
+		return fmt.Errorf("Could not unmount volume directory %s. Error is not mounted", target)
+	}
+	delete(m.MountPoints, target)
+	delete(m.Options, target)
+	return nil
+}
+
+// FormatAndMount :
+func (m *FakeMounter) FormatAndMount(source string, target string, fsType string, options []string) error {
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if _, ok := m.FileSystems[source]; !ok {
+		m.Actions = append(m.Actions, fmt.Sprintf("format %s %s", source, fsType))
+		if m.Err != nil {
+			return m.Err
+		}
+		m.FileSystems[source] = fsType
+	}
+	return m.Mount(source, target, fsType, options)
+}
+
+// IsLikelyNotMountPoint :
+func (m *FakeMounter) IsLikelyNotMountPoint(path string) (bool, error) {
+	_, ok := m.MountPoints[path]
+	return !ok, nil
+}
+
+// GetDeviceFromMount :
+func (m *FakeMounter) GetDeviceFromMount(path string) (string, error) {
+	source, ok := m.MountPoints[path]
+	if !ok {
+		return "", fmt.Errorf("Directory %s is not a mount point", path)
+	}
+	return source, nil
+}
+
+// GetMountRefs :
+func (m *FakeMounter) GetMountRefs(path string) ([]string, error) {
+	source, ok := m.MountPoints[path]
+	if !ok {
+		return nil, nil
+	}
+	var refs []string
+	for target, other := range m.MountPoints {
+		if other == source && target != path {
+			refs = append(refs, target)
+		}
+	}
+	return refs, nil
+}
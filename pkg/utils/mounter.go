@@ -0,0 +1,218 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+)
+
+// Mounter : Mounts and unmounts the volumes on the node
+type Mounter interface {
+	// Mount mounts the source at the target, creating the target directory if it doesn't exist.
+	// The options are the mount options, with "bind" for a bind mount and "ro" for a read-only one.
+	Mount(source string, target string, fsType string, options []string) error
+	// Unmount unmounts the target
+	Unmount(target string) error
+	// FormatAndMount creates a file system of the type on the device if it has none yet, and then mounts it
+	FormatAndMount(source string, target string, fsType string, options []string) error
+	// IsLikelyNotMountPoint tells if the path is not a mount point. Bind mounts of a directory on
+	// the same file system are not detected.
+	IsLikelyNotMountPoint(path string) (bool, error)
+	// GetDeviceFromMount returns the block device or multipath device mounted at the path
+	GetDeviceFromMount(path string) (string, error)
+	// GetMountRefs returns the other paths the file system mounted at the path is mounted at
+	GetMountRefs(path string) ([]string, error)
+}
+
+// LinuxMounter : Mounts the volumes by running the Linux commands on the node
+type LinuxMounter struct {
+	exec Exec
+	// The file listing the mounts of the node
+	mountInfoPath string
+}
+
+// NewMounter : Returns the Mounter of the node
+func NewMounter() Mounter {
+	return NewLinuxMounter(NewExec())
+}
+
+// NewLinuxMounter : Returns a Mounter running its commands with the Exec
+func NewLinuxMounter(exec Exec) *LinuxMounter {
+	return &LinuxMounter{exec: exec, mountInfoPath: resources.ProcMountInfo}
+}
+
+// Mount : Mounts the source at the target with the options
+func (m *LinuxMounter) Mount(source string, target string, fsType string, options []string) error {
+	// Create mount directory as specified by target
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		if _, _, err := m.exec.Run(resources.CMDMkDir, "-p", target); err != nil {
+			log.Errorf("Could not create directory %s to mount attached volume", target)
+			return fmt.Errorf("Could not create directory %s to mount attached volume. Error is %s", target, err)
+		}
+		log.Debugf("Created directory %s for mounting volume ", target)
+	}
+
+	bind, readOnly := false, false
+	var mountOpts []string
+	for _, option := range options {
+		switch option {
+		case "bind":
+			bind = true
+		case "ro":
+			readOnly = true
+		default:
+			mountOpts = append(mountOpts, option)
+		}
+	}
+	// The read-only flag is ignored on the initial bind, so it has to be applied with a remount
+	if readOnly && !bind {
+		mountOpts = append(mountOpts, "ro")
+	}
+	var args []string
+	if fsType != "" {
+		args = append(args, "-t", fsType)
+	}
+	if bind {
+		args = append(args, "--bind")
+	}
+	if len(mountOpts) > 0 {
+		args = append(args, "-o", strings.Join(mountOpts, ","))
+	}
+	args = append(args, source, target)
+	if _, cmdErr, err := m.exec.Run(resources.CMDMount, args...); err != nil {
+		log.Errorf("Could not mount %s at %s. Error is %s %s", source, target, err, cmdErr)
+		return fmt.Errorf("Could not mount %s at %s. Error is %s %s", source, target, err, strings.TrimSpace(cmdErr))
+	}
+	if bind && readOnly {
+		if _, _, err := m.exec.Run(resources.CMDMount, "-o", "remount,bind,ro", target); err != nil {
+			log.Errorf("Could not remount %s as read-only. Error is %s", target, err)
+			return fmt.Errorf("Could not remount %s as read-only. Error is %s", target, err)
+		}
+	}
+	log.Debugf("Mounted %s at %s", source, target)
+	return nil
+}
+
+// Unmount : Unmounts the target
+func (m *LinuxMounter) Unmount(target string) error {
+	if _, _, err := m.exec.Run(resources.CMDUnmount, target); err != nil {
+		log.Errorf("Could not unmount volume directory %s. Error is %s", target, err)
+		return fmt.Errorf("Could not unmount volume directory %s. Error is %s", target, err)
+	}
+	return nil
+}
+
+// FormatAndMount : Creates a file system on the device if it doesn't have one yet and then mounts it
+func (m *LinuxMounter) FormatAndMount(source string, target string, fsType string, options []string) error {
+	if fsType == "" {
+		// Assume default
+		fsType = "ext4"
+	}
+	// We should create FS only if there is no FS installed on volume
+	if hasFS, _ := m.hasFileSystem(source); !hasFS {
+		if err := m.makeFileSystem(source, fsType); err != nil {
+			return err
+		}
+	}
+	err := m.Mount(source, target, "", options)
+	// Check if the file system is bad
+	if err != nil && strings.Contains(err.Error(), "bad superblock") {
+		log.Debugf("Corrupted file system found. Creating file system again..")
+		if err := m.makeFileSystem(source, fsType); err != nil {
+			// Still can not create.. return error
+			return err
+		}
+	}
+	return err
+}
+
+// IsLikelyNotMountPoint : A mount point is on another device than its parent directory
+func (m *LinuxMounter) IsLikelyNotMountPoint(path string) (bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return true, err
+	}
+	parentStat, err := os.Stat(filepath.Dir(strings.TrimSuffix(path, "/")))
+	if err != nil {
+		return true, err
+	}
+	return stat.Sys().(*syscall.Stat_t).Dev == parentStat.Sys().(*syscall.Stat_t).Dev, nil
+}
+
+// GetDeviceFromMount : Returns the device mounted at the path from the mount table of the node
+func (m *LinuxMounter) GetDeviceFromMount(path string) (string, error) {
+	mounts, err := ReadMountInfo(m.mountInfoPath)
+	if err != nil {
+		return "", err
+	}
+	mount := FindMount(mounts, path)
+	if mount == nil {
+		return "", fmt.Errorf("Directory %s is not a mount point", path)
+	}
+	device := SourceDevice(mount)
+	log.Debugf("Device mounted on the %s directory is %s", path, device)
+	return device, nil
+}
+
+// GetMountRefs : Returns the other mount points of the file system mounted at the path
+func (m *LinuxMounter) GetMountRefs(path string) ([]string, error) {
+	mounts, err := ReadMountInfo(m.mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	return MountRefs(mounts, path), nil
+}
+
+// hasFileSystem : Determines if there is a Linux file system on the device
+func (m *LinuxMounter) hasFileSystem(devicePath string) (bool, error) {
+	cmdOutput, cmdError, err := m.exec.Run(resources.CMDLsBlk, devicePath, "--noheadings", "-o", "FSTYPE", "-f")
+	if err != nil {
+		log.Errorf("Could not get file system of %s. Error is %s %s", devicePath, err, cmdError)
+		return false, err
+	}
+	cmdOutput = strings.ToLower(strings.TrimSpace(cmdOutput))
+	// Check that the output has existence of a linux fliesystem
+	if cmdOutput != "" {
+		for _, fsType := range resources.FSTYPES {
+			if strings.Contains(cmdOutput, strings.ToLower(fsType)) {
+				log.Debugf("Attached Volume has FS %s", cmdOutput)
+				return true, nil
+			}
+		}
+	}
+	log.Debugf("Attached Volume does not has a file system %s", cmdOutput)
+	return false, nil
+}
+
+// makeFileSystem : Creates a file system of the given type on the device
+func (m *LinuxMounter) makeFileSystem(devicePath string, fsType string) error {
+	args := []string{devicePath}
+	// We want to force the filesystem create if the command has the option, but very few actually do
+	if strings.HasPrefix(fsType, "ext") || strings.HasPrefix(fsType, "ntfs") {
+		args = append(args, "-F")
+	}
+	if _, _, err := m.exec.Run(resources.CMDMkFS+fsType, args...); err != nil {
+		log.Errorf("Could not create file system on attached volume directory %s. Error is %s", devicePath, err)
+		return fmt.Errorf("Could not create file system on attached volume directory %s. Error is %s", devicePath, err)
+	}
+	log.Debugf("Created %s file system at %s", fsType, devicePath)
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MountInfo : A mount of the node, as listed in /proc/<pid>/mountinfo
+type MountInfo struct {
+	ID       int
+	ParentID int
+	// Device holds the major:minor number of the device of the mounted file system
+	Device string
+	// Root is the directory of the file system which is mounted, which is / except for bind mounts
+	// of a subdirectory
+	Root       string
+	MountPoint string
+	FsType     string
+	Source     string
+}
+
+// ParseMountInfo : Parses the lines of a mountinfo file, which look like this
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+// The optional fields before the - separator vary in number, and paths have their spaces escaped.
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator == -1 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("Could not parse mountinfo line %q", line)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse mount ID of mountinfo line %q", line)
+		}
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse parent ID of mountinfo line %q", line)
+		}
+		mount := MountInfo{
+			ID:         id,
+			ParentID:   parentID,
+			Device:     fields[2],
+			Root:       unescapeMountPath(fields[3]),
+			MountPoint: unescapeMountPath(fields[4]),
+			FsType:     fields[separator+1],
+			Source:     unescapeMountPath(fields[separator+2]),
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// ReadMountInfo : Returns the mounts listed in the mountinfo file
+func ReadMountInfo(mountInfoPath string) ([]MountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the mounts from %s. Error is %s", mountInfoPath, err)
+	}
+	defer file.Close()
+	return ParseMountInfo(file)
+}
+
+// FindMount : Returns the mount at the path, which is the last one when several were mounted on top of
+// each other, or nil if nothing is mounted there
+func FindMount(mounts []MountInfo, path string) *MountInfo {
+	path = filepath.Clean(path)
+	var found *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == path {
+			found = &mounts[i]
+		}
+	}
+	return found
+}
+
+// SourceDevice : Returns the block device of the mount. File systems like overlay don't name a device as
+// their source, so the device is looked up by its number for those.
+func SourceDevice(mount *MountInfo) string {
+	if strings.HasPrefix(mount.Source, "/dev/") {
+		return mount.Source
+	}
+	if name, err := os.Readlink(filepath.Join("/sys/dev/block", mount.Device)); err == nil {
+		return filepath.Join("/dev", filepath.Base(name))
+	}
+	return mount.Source
+}
+
+// MountRefs : Returns the other mount points of the file system mounted at the path, such as its bind mounts
+func MountRefs(mounts []MountInfo, path string) []string {
+	mount := FindMount(mounts, path)
+	if mount == nil {
+		return nil
+	}
+	var refs []string
+	for _, other := range mounts {
+		if other.ID != mount.ID && other.Device == mount.Device && other.MountPoint != mount.MountPoint {
+			refs = append(refs, other.MountPoint)
+		}
+	}
+	return refs
+}
+
+// unescapeMountPath : The kernel escapes spaces, tabs, newlines and backslashes in the paths of
+// mountinfo as octal, like \040 for a space
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
@@ -0,0 +1,207 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+)
+
+// The block devices of NVMe namespaces, like nvme0n1. The hidden paths of a namespace with native
+// multipath, like nvme0c1n1, aren't block devices we can use.
+var nvmeNamespacePattern = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+
+// NVMeConnector : Connects to the NVMe over Fabrics subsystems of the volumes, and disconnects from them
+// once they have no namespace left in use
+type NVMeConnector struct {
+	exec Exec
+	// The sysfs directory, which the tests replace
+	sysDir string
+	// The time to wait between two looks for the namespace
+	interval time.Duration
+}
+
+// NewNVMeConnector : Returns the NVMe over Fabrics connector running nvme with the Exec
+func NewNVMeConnector(exec Exec) *NVMeConnector {
+	return &NVMeConnector{exec: exec, sysDir: "/sys", interval: 5 * time.Second}
+}
+
+// nvme : Runs the nvme command
+func (c *NVMeConnector) nvme(args ...string) error {
+	_, stderr, err := c.exec.Run(resources.CMDNVMe, args...)
+	if err != nil {
+		return fmt.Errorf("%s %s", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// ConnectVolume : Connects to all the portals of the subsystem of the connection and waits for the namespace
+// of the volume to show up. With native NVMe multipath the kernel puts the paths together in one device.
+func (c *NVMeConnector) ConnectVolume(conn *resources.VolumeConnection) (string, error) {
+	if conn.TargetNQN == "" || len(conn.NVMePortals) == 0 {
+		return "", fmt.Errorf("The NVMe connection has no subsystem NQN and portal")
+	}
+	if conn.VolumeNGUID == "" && conn.VolumeUUID == "" && conn.NamespaceID == 0 {
+		return "", fmt.Errorf("The NVMe connection has no NGUID, UUID or ID of the namespace of the volume")
+	}
+	// A portal which can't connect is only an error if no portal can
+	var connected int
+	var connectErr error
+	for _, portal := range conn.NVMePortals {
+		err := c.nvme("connect", "-t", portal.Transport, "-a", portal.Address, "-s", portal.Port, "-n", conn.TargetNQN)
+		if err != nil && !strings.Contains(err.Error(), "already") {
+			connectErr = fmt.Errorf("Could not connect to %s at %s:%s. Error is %s", conn.TargetNQN, portal.Address, portal.Port, err)
+			log.Warningf("%s", connectErr)
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		return "", connectErr
+	}
+
+	for i := 0; i < resources.MaxAttemptsToFindVolume; i++ {
+		if i > 0 {
+			time.Sleep(c.interval)
+		}
+		subsystem := c.findSubsystem(conn.TargetNQN)
+		if subsystem == "" {
+			log.Debugf("Subsystem %s is not on the node yet", conn.TargetNQN)
+			continue
+		}
+		for _, namespace := range c.namespaces(subsystem) {
+			if c.isVolumeNamespace(namespace, conn) {
+				devicePath := "/dev/" + filepath.Base(namespace)
+				log.Debugf("Found device %s of the NVMe volume in subsystem %s", devicePath, conn.TargetNQN)
+				return devicePath, nil
+			}
+		}
+		log.Debugf("Namespace of the volume is not in subsystem %s yet", conn.TargetNQN)
+	}
+	return "", fmt.Errorf("Could not find the namespace of the NVMe volume in subsystem %s", conn.TargetNQN)
+}
+
+// findSubsystem : Returns the sysfs directory of the subsystem with the NQN, or "" if the node has none
+func (c *NVMeConnector) findSubsystem(nqn string) string {
+	subsystems, _ := filepath.Glob(filepath.Join(c.sysDir, "class", "nvme-subsystem", "nvme-subsys*"))
+	for _, subsystem := range subsystems {
+		if readSysAttr(subsystem, "subsysnqn") == nqn {
+			return subsystem
+		}
+	}
+	return ""
+}
+
+// namespaces : Returns the sysfs directories of the namespaces of the subsystem, which are in the subsystem
+// with native multipath and in its controllers without it
+func (c *NVMeConnector) namespaces(subsystem string) []string {
+	var namespaces []string
+	for _, pattern := range []string{"nvme*", filepath.Join("nvme*", "nvme*")} {
+		matches, _ := filepath.Glob(filepath.Join(subsystem, pattern))
+		for _, match := range matches {
+			if nvmeNamespacePattern.MatchString(filepath.Base(match)) {
+				namespaces = append(namespaces, match)
+			}
+		}
+	}
+	return namespaces
+}
+
+// isVolumeNamespace : Tells if the namespace is the one of the volume, by its NGUID or UUID if the
+// connection has it, or else by its ID
+func (c *NVMeConnector) isVolumeNamespace(namespace string, conn *resources.VolumeConnection) bool {
+	// The kernel shows the NGUID like a UUID, with dashes, while Cinder may not have them
+	normalize := func(id string) string {
+		return strings.ToLower(strings.Replace(id, "-", "", -1))
+	}
+	if conn.VolumeNGUID != "" {
+		return normalize(readSysAttr(namespace, "nguid")) == normalize(conn.VolumeNGUID)
+	}
+	if conn.VolumeUUID != "" {
+		return normalize(readSysAttr(namespace, "uuid")) == normalize(conn.VolumeUUID)
+	}
+	nsid, err := strconv.Atoi(readSysAttr(namespace, "nsid"))
+	return err == nil && nsid == conn.NamespaceID
+}
+
+// PrepareDisconnect : Finds the subsystems of the NVMe devices, and returns the function disconnecting from
+// the subsystems which have no namespace left but the ones of the devices
+func (c *NVMeConnector) PrepareDisconnect(devices []string) func() error {
+	unmounted := make(map[string]bool)
+	subsystems := make(map[string]bool)
+	all, _ := filepath.Glob(filepath.Join(c.sysDir, "class", "nvme-subsystem", "nvme-subsys*"))
+	for _, device := range devices {
+		name := filepath.Base(device)
+		if !nvmeNamespacePattern.MatchString(name) {
+			continue
+		}
+		unmounted[name] = true
+		for _, subsystem := range all {
+			for _, namespace := range c.namespaces(subsystem) {
+				if filepath.Base(namespace) == name {
+					subsystems[subsystem] = true
+				}
+			}
+		}
+	}
+	if len(subsystems) == 0 {
+		return nil
+	}
+	return func() error {
+		for subsystem := range subsystems {
+			if err := c.disconnectIfUnused(subsystem, unmounted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// disconnectIfUnused : Disconnects from the subsystem if all its namespaces on the node are unmounted, which
+// removes the namespaces and the controllers of all the portals of the subsystem from the node
+func (c *NVMeConnector) disconnectIfUnused(subsystem string, unmounted map[string]bool) error {
+	for _, namespace := range c.namespaces(subsystem) {
+		if !unmounted[filepath.Base(namespace)] {
+			log.Debugf("NVMe %s still has namespace %s, staying connected", filepath.Base(subsystem), filepath.Base(namespace))
+			return nil
+		}
+	}
+	nqn := readSysAttr(subsystem, "subsysnqn")
+	if nqn == "" {
+		// The subsystem is gone already
+		return nil
+	}
+	log.Infof("Disconnecting from %s, which has no namespace left", nqn)
+	if err := c.nvme("disconnect", "-n", nqn); err != nil {
+		return fmt.Errorf("Could not disconnect from %s. Error is %s", nqn, err)
+	}
+	return nil
+}
+
+// readSysAttr : Returns the trimmed value of the sysfs attribute, or "" if it can't be read
+func readSysAttr(dir string, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -19,6 +19,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,8 +41,12 @@ import (
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
+	snapshots_v3 "github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
 	volumes_v3 "github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	tokens2 "github.com/gophercloud/gophercloud/openstack/identity/v2/tokens"
+	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 	ports_v2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
 )
 
@@ -56,6 +62,7 @@ type OpenstackCloudI interface {
 	GetAllOSVMs() (*[]resources.OSServer, error)
 	GetOSVolumeByID(volumeID string) (*resources.OSVolume, error)
 	GetStorageHostRegistration(hostname string) (*resources.StorageRegistration, error)
+	GetVolumeConnection(volumeID string, vmID string) (*resources.VolumeConnection, error)
 	AttachVolumeToVM(vmID string, volumeID string, volume *resources.OSVolume) (bool, error)
 	DetachVolumeFromVM(vmID string, volumeID string, volume *resources.OSVolume) (bool, error)
 	IsVolumeAttached(vmID string, volumeID string) (bool, error)
@@ -64,11 +71,21 @@ type OpenstackCloudI interface {
 	ListHypervisors() (*[]hypervisors.Hypervisor, error)
 	GetServerIDFromNodeName(nodeName string) (string, error)
 	GetProviderClient() *gophercloud.ProviderClient
+	NewVolumeV3() (*gophercloud.ServiceClient, error)
+	CreateSnapshot(volumeID string, name string, snapMeta map[string]string) (*snapshots_v3.Snapshot, error)
+	GetSnapshotByID(snapshotID string) (*snapshots_v3.Snapshot, error)
+	ListSnapshots(snapOpts snapshots_v3.ListOpts) (*[]snapshots_v3.Snapshot, error)
+	DeleteSnapshot(snapshotID string) error
+	ExtendVolume(volumeID string, newSizeGB int) (*resources.OSVolume, error)
 }
 
 // OpenstackCloud : Reference to openstack provider
 type OpenstackCloud struct {
 	Provider *gophercloud.ProviderClient
+	// The region and interface of the endpoints of the service clients
+	EndpointOpts gophercloud.EndpointOpts
+	// The project the token is scoped to, whose servers and volumes are listed
+	ProjectID string
 }
 
 // Fake Endpoint object to help with any tests run
@@ -86,20 +103,178 @@ func FakeServiceClient() *gophercloud.ServiceClient {
 
 // CreateOpenstackClient : Create an OpenStack Client and Authenticate to OpenStack
 func CreateOpenstackClient(testParam ...string) (OpenstackCloudI, error) {
+	opts, endpointOpts, certData, err := openstackConfig()
+	if err != nil {
+		return nil, err
+	}
+	return newOpenstackCloud(opts, endpointOpts, certData)
+}
+
+// openstackConfig : Returns the authentication options, endpoint options and certificate of the process configuration
+func openstackConfig() (gophercloud.AuthOptions, gophercloud.EndpointOpts, []byte, error) {
 	// Load the Environment Variables from the Configuration File
 	loadConfigFile()
-	// The configuration info is in environment variables with the openstack names
-	opts, err := openstack.AuthOptionsFromEnv()
+	// The configuration info is in environment variables with the openstack names or in clouds.yaml
+	getConfig, err := configFromEnv()
+	if err != nil {
+		return gophercloud.AuthOptions{}, gophercloud.EndpointOpts{}, nil, fmt.Errorf("Error while reading config options %s", err.Error())
+	}
+	opts, err := authOptionsFromConfig(getConfig)
+	if err != nil {
+		return opts, gophercloud.EndpointOpts{}, nil, fmt.Errorf("Error while reading config options %s", err.Error())
+	}
+	endpointOpts, err := endpointOptsFromConfig(getConfig)
 	if err != nil {
-		return nil, fmt.Errorf("Error while reading config options %s", err.Error())
+		return opts, endpointOpts, nil, fmt.Errorf("Error while reading config options %s", err.Error())
+	}
+	return opts, endpointOpts, readCertificateFromConfig(getConfig), nil
+}
+
+// CreateOpenstackClientFromSecret : Create an OpenStack Client and Authenticate to OpenStack with the
+// credentials in the data of a Kubernetes secret rather than the ones of the process
+func CreateOpenstackClientFromSecret(secretData map[string]string) (OpenstackCloudI, error) {
+	opts, err := AuthOptionsFromSecret(secretData)
+	if err != nil {
+		return nil, err
+	}
+	endpointOpts, err := endpointOptsFromConfig(func(key string) string {
+		return secretData[key]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newOpenstackCloud(opts, endpointOpts, formatCertificate([]byte(secretData[resources.OSCACertData])))
+}
+
+// AuthOptionsFromSecret : Returns the authentication options in the data of a Kubernetes secret, whose
+// keys are named after the OpenStack environment variables
+func AuthOptionsFromSecret(secretData map[string]string) (gophercloud.AuthOptions, error) {
+	return authOptionsFromConfig(func(key string) string {
+		return secretData[key]
+	})
+}
+
+// authOptionsFromConfig : Returns the authentication options for the auth type in the configuration,
+// which is either a password, a Keystone application credential or a token issued beforehand
+func authOptionsFromConfig(getConfig func(string) string) (gophercloud.AuthOptions, error) {
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: getConfig(resources.OSAuthURL),
+		DomainID:         getConfig(resources.OSDomainID),
+		DomainName:       getConfig(resources.OSDomainName),
+		TenantID:         getConfig(resources.OSProjectIDV3),
+		TenantName:       getConfig(resources.OSProjectNameV3),
+	}
+	// The same fallbacks as the OpenStack clients have, Keystone takes either the ID or the name of the domain
+	if opts.DomainID == "" && opts.DomainName == "" {
+		opts.DomainID = getConfig(resources.OSUserDomainID)
+	}
+	if opts.DomainName == "" && opts.DomainID == "" {
+		opts.DomainName = getConfig(resources.OSUserDomain)
+	}
+	if opts.TenantID == "" {
+		opts.TenantID = getConfig(resources.OSProjectID)
+	}
+	if opts.TenantName == "" {
+		opts.TenantName = getConfig(resources.OSProjectName)
+	}
+	if opts.IdentityEndpoint == "" {
+		return opts, fmt.Errorf("OpenStack configuration is missing %s", resources.OSAuthURL)
 	}
+
+	switch authType := strings.ToLower(getConfig(resources.OSAuthType)); authType {
+	case "", resources.AuthTypePassword:
+		opts.Username = getConfig(resources.OSUser)
+		opts.UserID = getConfig(resources.OSUserID)
+		opts.Password = getConfig(resources.OSPassword)
+		if opts.Username == "" && opts.UserID == "" {
+			return opts, fmt.Errorf("OpenStack configuration is missing %s", resources.OSUser)
+		}
+		if opts.Password == "" {
+			return opts, fmt.Errorf("OpenStack configuration is missing %s", resources.OSPassword)
+		}
+		opts.Scope = projectScope(opts, getConfig)
+	case resources.AuthTypeAppCredential:
+		opts.ApplicationCredentialID = getConfig(resources.OSAppCredentialID)
+		opts.ApplicationCredentialName = getConfig(resources.OSAppCredentialName)
+		opts.ApplicationCredentialSecret = getConfig(resources.OSAppCredentialSecret)
+		// A credential is looked up by name within the user who owns it
+		if opts.ApplicationCredentialID == "" {
+			opts.Username = getConfig(resources.OSUser)
+			opts.UserID = getConfig(resources.OSUserID)
+			if opts.ApplicationCredentialName == "" || (opts.Username == "" && opts.UserID == "") {
+				return opts, fmt.Errorf("OpenStack configuration is missing %s, or %s and %s",
+					resources.OSAppCredentialID, resources.OSAppCredentialName, resources.OSUser)
+			}
+		}
+		if opts.ApplicationCredentialSecret == "" {
+			return opts, fmt.Errorf("OpenStack configuration is missing %s", resources.OSAppCredentialSecret)
+		}
+		// The credential is bound to the project it was created in, and Keystone refuses a scope with it
+		opts.TenantID, opts.TenantName = "", ""
+	case resources.AuthTypeToken:
+		opts.TokenID = getConfig(resources.OSToken)
+		if opts.TokenID == "" {
+			return opts, fmt.Errorf("OpenStack configuration is missing %s", resources.OSToken)
+		}
+		// The token already names the user and its domain, and Keystone refuses them next to it, so only
+		// the project the new token is scoped to is sent, with the domain of the project
+		opts.Scope = projectScope(opts, getConfig)
+		opts.DomainID, opts.DomainName, opts.TenantID, opts.TenantName = "", "", "", ""
+	default:
+		return opts, fmt.Errorf("OpenStack configuration has unknown %s %s", resources.OSAuthType, authType)
+	}
+	return opts, nil
+}
+
+// projectScope : Returns the scope of the project in the configuration, which is looked up by name in the
+// domain of the project if it is set and otherwise in the domain of the user, or nil if there is no project
+func projectScope(opts gophercloud.AuthOptions, getConfig func(string) string) *gophercloud.AuthScope {
+	if opts.TenantID != "" {
+		return &gophercloud.AuthScope{ProjectID: opts.TenantID}
+	}
+	if opts.TenantName == "" {
+		return nil
+	}
+	scope := &gophercloud.AuthScope{ProjectName: opts.TenantName}
+	if scope.DomainID = getConfig(resources.OSProjectDomainID); scope.DomainID == "" {
+		if scope.DomainName = getConfig(resources.OSProjectDomain); scope.DomainName == "" {
+			scope.DomainID, scope.DomainName = opts.DomainID, opts.DomainName
+			if scope.DomainID != "" {
+				scope.DomainName = ""
+			}
+		}
+	}
+	return scope
+}
+
+// endpointOptsFromConfig : Returns the region and interface of the endpoints to use from the configuration,
+// which default to the first region in the catalog and the public interface
+func endpointOptsFromConfig(getConfig func(string) string) (gophercloud.EndpointOpts, error) {
+	endpointOpts := gophercloud.EndpointOpts{Region: getConfig(resources.OSRegionName)}
+	// The OpenStack clients also accept the interface names of the old v2 catalog
+	switch iface := strings.TrimSuffix(strings.ToLower(getConfig(resources.OSInterface)), "url"); iface {
+	case "":
+	case string(gophercloud.AvailabilityPublic), string(gophercloud.AvailabilityInternal), string(gophercloud.AvailabilityAdmin):
+		endpointOpts.Availability = gophercloud.Availability(iface)
+	default:
+		return endpointOpts, fmt.Errorf("OpenStack configuration has unknown %s %s", resources.OSInterface, iface)
+	}
+	return endpointOpts, nil
+}
+
+// newOpenstackCloud : Authenticates to OpenStack with the options, validating the server with the certificate if given
+func newOpenstackCloud(opts gophercloud.AuthOptions, endpointOpts gophercloud.EndpointOpts, certData []byte) (OpenstackCloudI, error) {
 	// Construct a new OpenStack Rest Client with the Authentication URL
 	providerClient, err := openstack.NewClient(opts.IdentityEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("Error while constructing client from openstack %s", err.Error())
 	}
 	// Update the Rest Client to set the Certificate to use for Validation
-	setCertificateOnClient(providerClient)
+	setCertificateOnClient(providerClient, certData)
+	// Get a new token when the current one expires, which only works with credentials that aren't a token
+	// themselves. The lock keeps concurrent callers of a shared client from all reauthenticating at once.
+	opts.AllowReauth = opts.TokenID == ""
+	providerClient.UseTokenLock()
 	// Authenticate to Keystone on the OpenStack controller before using
 	err = openstack.Authenticate(providerClient, opts)
 	if err != nil {
@@ -107,11 +282,30 @@ func CreateOpenstackClient(testParam ...string) (OpenstackCloudI, error) {
 	}
 	log.Debugf("Authentication with openstack succcessful")
 	openStackController := OpenstackCloud{
-		Provider: providerClient,
+		Provider:     providerClient,
+		EndpointOpts: endpointOpts,
+		ProjectID:    authProjectID(providerClient),
 	}
 	return &openStackController, nil
 }
 
+// authProjectID : Returns the ID of the project Keystone scoped the token of the provider client to, which can
+// differ from the configuration when the project is named or the credentials are bound to one
+func authProjectID(providerClient *gophercloud.ProviderClient) string {
+	switch result := providerClient.GetAuthResult().(type) {
+	case tokens3.CreateResult:
+		if project, err := result.ExtractProject(); err == nil && project != nil {
+			return project.ID
+		}
+	case tokens2.CreateResult:
+		if token, err := result.ExtractToken(); err == nil {
+			return token.Tenant.ID
+		}
+	}
+	log.Warningf("Could not find the project the OpenStack token is scoped to")
+	return ""
+}
+
 // CreateCinderClient : Create a Cinder Service Client and Authenticate to OpenStack
 func CreateCinderClient(testParam ...string) (*gophercloud.ServiceClient, error) {
 	// testParam[0] will be "test" if we are testing, where we want to return a fake client,
@@ -123,13 +317,17 @@ func CreateCinderClient(testParam ...string) (*gophercloud.ServiceClient, error)
 	if err != nil {
 		return nil, err
 	}
-	// Get a Cinder ServiceClient
-	serviceClient, err := openstack.NewBlockStorageV3(
-		openstackClient.GetProviderClient(), gophercloud.EndpointOpts{})
+	return openstackClient.NewVolumeV3()
+}
+
+// CreateCinderClientFromSecret : Create a Cinder Service Client and Authenticate to OpenStack with the
+// credentials in the data of a Kubernetes secret
+func CreateCinderClientFromSecret(secretData map[string]string) (*gophercloud.ServiceClient, error) {
+	openstackClient, err := CreateOpenstackClientFromSecret(secretData)
 	if err != nil {
 		return nil, err
 	}
-	return serviceClient, nil
+	return openstackClient.NewVolumeV3()
 }
 
 // GetProviderClient : Returns back the embedded ProviderClient in the Interface
@@ -144,7 +342,7 @@ func (opnStk *OpenstackCloud) GetAllOSVMs() (*[]resources.OSServer, error) {
 		return nil, err
 	}
 	listOpts := servers.ListOpts{
-		TenantID: os.Getenv("OS_PROJECT_NAME"),
+		TenantID: opnStk.ProjectID,
 	}
 
 	var vmList []resources.OSServer
@@ -192,6 +390,165 @@ func GetCinderVolume(cinderClient *gophercloud.ServiceClient, volumeID string) (
 	return &volume, nil
 }
 
+// ExtendVolume : Extends the volume to the new size and waits for it to finish extending
+func (opnStk *OpenstackCloud) ExtendVolume(volumeID string, newSizeGB int) (*resources.OSVolume, error) {
+	cinderClient, err := opnStk.NewVolumeV3()
+	if err != nil {
+		return nil, err
+	}
+	return ExtendCinderVolume(cinderClient, volumeID, newSizeGB)
+}
+
+// ExtendCinderVolume : Extends the volume to the new size and waits for it to finish extending
+func ExtendCinderVolume(cinderClient *gophercloud.ServiceClient, volumeID string, newSizeGB int) (*resources.OSVolume, error) {
+	volume, err := GetCinderVolume(cinderClient, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing to do if the volume is already big enough, which also covers retries
+	if volume.Size >= newSizeGB {
+		log.Infof("Volume %s is already %dGB", volumeID, volume.Size)
+		return volume, nil
+	}
+	// Attached volumes can only be extended starting with a newer microversion, so we
+	// use a copy of the client to keep it from affecting the other calls
+	extendClient := *cinderClient
+	if volume.Status == "in-use" {
+		extendClient.Microversion = resources.CinderInUseExtendMicroversion
+	}
+	extendOpts := volumeactions.ExtendSizeOpts{NewSize: newSizeGB}
+	err = volumeactions.ExtendSize(&extendClient, volumeID, extendOpts).ExtractErr()
+	if err != nil {
+		log.Errorf("Failed to extend volume %s to %dGB. Error is %s", volumeID, newSizeGB, err)
+		return nil, err
+	}
+	return GetExtendedCinderVolume(cinderClient, volumeID)
+}
+
+// GetExtendedCinderVolume : Function returns volume given volume id once it has finished extending
+func GetExtendedCinderVolume(cinderClient *gophercloud.ServiceClient, volumeID string) (*resources.OSVolume, error) {
+	var volume resources.OSVolume
+	// Same as with creating, we wait and loop until the volume is no longer extending
+	for i := 0; i < 100; i++ {
+		res := volumes_v3.Get(cinderClient, volumeID)
+		err := res.ExtractInto(&volume)
+		if err != nil {
+			log.Errorf("Could not get volume info. Error is %s", err)
+			return nil, err
+		}
+		if volume.Status == "error_extending" {
+			return nil, fmt.Errorf("Could not extend volume %s", volumeID)
+		}
+		if volume.Status != "extending" {
+			return &volume, nil
+		}
+		time.Sleep(3 * time.Second)
+	}
+	return nil, fmt.Errorf("Timed out waiting for volume %s to finish extending", volumeID)
+}
+
+// CreateSnapshot : Takes a snapshot of the volume and waits for it to finish creating
+func (opnStk *OpenstackCloud) CreateSnapshot(volumeID string, name string, snapMeta map[string]string) (*snapshots_v3.Snapshot, error) {
+	cinderClient, err := opnStk.NewVolumeV3()
+	if err != nil {
+		return nil, err
+	}
+	// Force is needed so that volumes which are attached (in-use) can be snapshotted as well
+	createOpts := snapshots_v3.CreateOpts{
+		VolumeID: volumeID,
+		Name:     name,
+		Metadata: snapMeta,
+		Force:    true,
+	}
+	snapshot, err := snapshots_v3.Create(cinderClient, createOpts).Extract()
+	if err != nil {
+		log.Errorf("Failed to create snapshot of volume %s. Error is %s", volumeID, err)
+		return nil, err
+	}
+	snapshot, err = GetCinderSnapshot(cinderClient, snapshot.ID)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Status == "error" {
+		// Clean up the snapshot since it will be orphaned otherwise
+		snapshots_v3.Delete(cinderClient, snapshot.ID)
+		return nil, fmt.Errorf("Could not create snapshot %s of volume %s", snapshot.ID, volumeID)
+	}
+	return snapshot, nil
+}
+
+// GetSnapshotByID : Function returns snapshot given snapshot id
+func (opnStk *OpenstackCloud) GetSnapshotByID(snapshotID string) (*snapshots_v3.Snapshot, error) {
+	cinderClient, err := opnStk.NewVolumeV3()
+	if err != nil {
+		return nil, err
+	}
+	return snapshots_v3.Get(cinderClient, snapshotID).Extract()
+}
+
+// GetCinderSnapshot : Function returns snapshot given snapshot id once it is no longer being created
+func GetCinderSnapshot(cinderClient *gophercloud.ServiceClient, snapshotID string) (*snapshots_v3.Snapshot, error) {
+	var snapshot *snapshots_v3.Snapshot
+	var err error
+	// Same as with volumes, the snapshot isn't ready until it has finished creating
+	for i := 0; i < 100; i++ {
+		snapshot, err = snapshots_v3.Get(cinderClient, snapshotID).Extract()
+		if err != nil {
+			log.Errorf("Could not get snapshot info. Error is %s", err)
+			return nil, err
+		}
+		if snapshot.Status != "creating" {
+			return snapshot, nil
+		}
+		time.Sleep(3 * time.Second)
+	}
+	return snapshot, nil
+}
+
+// ListSnapshots : Returns the snapshots matching the list options
+func (opnStk *OpenstackCloud) ListSnapshots(snapOpts snapshots_v3.ListOpts) (*[]snapshots_v3.Snapshot, error) {
+	var snapList []snapshots_v3.Snapshot
+	cinderClient, err := opnStk.NewVolumeV3()
+	if err != nil {
+		return nil, err
+	}
+	err = snapshots_v3.List(cinderClient, snapOpts).EachPage(
+		func(page pagination.Page) (bool, error) {
+			snapSubList, err := snapshots_v3.ExtractSnapshots(page)
+			if err != nil {
+				log.Errorf("Could not extract snapshot details. Err is %s", err)
+				return false, err
+			}
+			snapList = append(snapList, snapSubList...)
+			return true, nil
+		})
+	if err != nil {
+		log.Errorf("Could not get list of snapshots. Err is %s", err)
+		return nil, err
+	}
+	return &snapList, nil
+}
+
+// DeleteSnapshot : Deletes the snapshot
+func (opnStk *OpenstackCloud) DeleteSnapshot(snapshotID string) error {
+	cinderClient, err := opnStk.NewVolumeV3()
+	if err != nil {
+		return err
+	}
+	err = snapshots_v3.Delete(cinderClient, snapshotID).ExtractErr()
+	if err != nil {
+		log.Errorf("Failed to delete snapshot %s. Error is %s", snapshotID, err)
+		return err
+	}
+	return nil
+}
+
+// IsNotFoundError : Determines if the error returned from OpenStack was because the resource doesn't exist
+func IsNotFoundError(err error) bool {
+	_, ok := err.(gophercloud.ErrDefault404)
+	return ok
+}
+
 // AttachVolumeToVM : attaches volume to VM
 func (opnStk *OpenstackCloud) AttachVolumeToVM(vmID string, volumeID string, volume *resources.OSVolume) (bool, error) {
 	// Attach the volume now
@@ -229,7 +586,11 @@ func (opnStk *OpenstackCloud) IsVolumeAttached(vmID string, volumeID string) (bo
 		return false, err
 	}
 	attachment, err := volumeattach.Get(novaClient, vmID, volumeID).Extract()
-	if err != nil {
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		// Nova has no attachment of the volume to the VM
+		log.Infof("Volume %s is not attached to VM %s", volumeID, vmID)
+		return false, nil
+	} else if err != nil {
 		log.Errorf("Error querying if volume %s is attached to VM %s. Error is %s", volumeID, vmID, err)
 		return false, err
 	}
@@ -246,6 +607,16 @@ func (opnStk *OpenstackCloud) IsVolumeAttached(vmID string, volumeID string) (bo
 	return false, nil
 }
 
+// VolumeMappingNotFoundError : Returned when no volume has the metadata looked up, like the name of a volume
+// whose attachment was rolled back
+type VolumeMappingNotFoundError struct {
+	VolumeMeta map[string]string
+}
+
+func (e VolumeMappingNotFoundError) Error() string {
+	return fmt.Sprintf("Can't find volume mapping for %s.", e.VolumeMeta)
+}
+
 // GetVolumeByMetadataProperty : Retrieves Openstack cinder volume by querying its metadata
 func (opnStk *OpenstackCloud) GetVolumeByMetadataProperty(volumeMeta map[string]string) (*[]resources.OSVolume, error) {
 	var volList []resources.OSVolume
@@ -255,7 +626,7 @@ func (opnStk *OpenstackCloud) GetVolumeByMetadataProperty(volumeMeta map[string]
 	}
 	reqOptList := volumes_v3.ListOpts{
 		Metadata:   volumeMeta,
-		TenantID:   os.Getenv("OS_PROJECT_NAME"),
+		TenantID:   opnStk.ProjectID,
 		AllTenants: false,
 	}
 	err = volumes_v3.List(cinderClient, reqOptList).EachPage(
@@ -276,8 +647,7 @@ func (opnStk *OpenstackCloud) GetVolumeByMetadataProperty(volumeMeta map[string]
 		return nil, err
 	}
 	if len(volList) == 0 {
-		err = errors.New(fmt.Sprintf("Can't find volume mapping for %s.", volumeMeta))
-		return nil, err
+		return nil, VolumeMappingNotFoundError{VolumeMeta: volumeMeta}
 	}
 	// If there was more than one volume matching, something must have went wrong, so can't figure out which
 	if len(volList) > 1 {
@@ -296,7 +666,7 @@ func (opnStk *OpenstackCloud) UpdateVolumeMetadata(volumeID string,
 		return err
 	}
 	reqOpts := gophercloud.RequestOpts{OkCodes: []int{200}}
-	metaKey, result := resources.OsK8sVolumeNameMeta, gophercloud.Result{}
+	result := gophercloud.Result{}
 	metaURL := fmt.Sprintf("%s/volumes/%s/metadata", cinderClient.ResourceBaseURL(), volumeID)
 	// Depending on if this is a delete or an update we need to call a different Metadata operation
 	if !isDelete {
@@ -307,7 +677,13 @@ func (opnStk *OpenstackCloud) UpdateVolumeMetadata(volumeID string,
 			return err
 		}
 	} else {
-		_, err = cinderClient.Delete(metaURL+"/"+metaKey, &reqOpts)
+		// Only the keys are used for a delete, and keys which are already gone are skipped
+		for metaKey := range volumeMeta {
+			_, err = cinderClient.Delete(metaURL+"/"+metaKey, &reqOpts)
+			if _, ok := err.(gophercloud.ErrDefault404); err != nil && !ok {
+				return err
+			}
+		}
 	}
 	log.Debugf("Updated volume metadata details ")
 	return nil
@@ -367,6 +743,115 @@ func (opnStk *OpenstackCloud) GetStorageHostRegistration(hostname string) (*reso
 	return nil, nil
 }
 
+// GetVolumeConnection : Returns the connection info of the attachment of the volume to the VM, or nil
+// if the volume isn't attached to it
+func (opnStk *OpenstackCloud) GetVolumeConnection(volumeID string, vmID string) (*resources.VolumeConnection, error) {
+	cinderClient, err := opnStk.NewVolumeV3()
+	if err != nil {
+		return nil, err
+	}
+	// Use a copy of the client to keep the microversion from affecting the other calls
+	attachmentsClient := *cinderClient
+	attachmentsClient.Microversion = resources.CinderAttachmentsMicroversion
+	r := gophercloud.Result{}
+	url := fmt.Sprintf("%sattachments/detail?volume_id=%s", attachmentsClient.ResourceBaseURL(), volumeID)
+	_, r.Err = attachmentsClient.Get(url, &r.Body, nil)
+	if r.Err != nil {
+		log.Errorf("Could not get the attachments of volume %s. Error is %s", volumeID, r.Err)
+		return nil, r.Err
+	}
+	var attachments struct {
+		Attachments []struct {
+			Instance       string                     `json:"instance"`
+			ConnectionInfo map[string]json.RawMessage `json:"connection_info"`
+		} `json:"attachments"`
+	}
+	if err := r.ExtractInto(&attachments); err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments.Attachments {
+		if attachment.Instance == vmID && attachment.ConnectionInfo != nil {
+			return ParseConnectionInfo(attachment.ConnectionInfo), nil
+		}
+	}
+	return nil, nil
+}
+
+// ParseConnectionInfo : Returns the connection of the connection info of a Cinder attachment, whose properties
+// are either at the top or under data, next to driver_volume_type. The target_wwn is a string or a list.
+// Fibre channel attachments have target_wwn, iSCSI ones target_portal and target_iqn, and NVMe over Fabrics
+// ones target_nqn with either a list of portals or a single target_portal and target_port.
+func ParseConnectionInfo(connectionInfo map[string]json.RawMessage) *resources.VolumeConnection {
+	conn := &resources.VolumeConnection{TargetLUN: -1}
+	json.Unmarshal(connectionInfo["driver_volume_type"], &conn.DriverVolumeType)
+	properties := connectionInfo
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(connectionInfo["data"], &data); err == nil && data != nil {
+		properties = data
+	}
+	var wwn string
+	if err := json.Unmarshal(properties["target_wwn"], &wwn); err == nil && wwn != "" {
+		conn.TargetWWNs = []string{wwn}
+	} else {
+		json.Unmarshal(properties["target_wwn"], &conn.TargetWWNs)
+	}
+	var lun int
+	if err := json.Unmarshal(properties["target_lun"], &lun); err == nil {
+		conn.TargetLUN = lun
+	}
+	// An iSCSI attachment with several paths lists them, next to the first path as target_portal
+	json.Unmarshal(properties["target_portals"], &conn.TargetPortals)
+	json.Unmarshal(properties["target_iqns"], &conn.TargetIQNs)
+	json.Unmarshal(properties["target_luns"], &conn.TargetLUNs)
+	var portal, iqn string
+	if len(conn.TargetPortals) == 0 && json.Unmarshal(properties["target_portal"], &portal) == nil && portal != "" {
+		conn.TargetPortals = []string{portal}
+	}
+	if len(conn.TargetIQNs) == 0 && json.Unmarshal(properties["target_iqn"], &iqn) == nil && iqn != "" {
+		conn.TargetIQNs = []string{iqn}
+	}
+	json.Unmarshal(properties["auth_method"], &conn.AuthMethod)
+	json.Unmarshal(properties["auth_username"], &conn.AuthUsername)
+	json.Unmarshal(properties["auth_password"], &conn.AuthPassword)
+	if conn.DriverVolumeType == resources.DriverVolumeTypeNVMeoF {
+		parseNVMeConnectionInfo(properties, conn)
+	}
+	return conn
+}
+
+// parseNVMeConnectionInfo : Sets the subsystem, portals and namespace of an NVMe over Fabrics connection.
+// The ports and namespace ID are strings or numbers, and each of the portals is an address, port and transport.
+func parseNVMeConnectionInfo(properties map[string]json.RawMessage, conn *resources.VolumeConnection) {
+	rawString := func(raw json.RawMessage) string {
+		return strings.Trim(strings.TrimSpace(string(raw)), `"`)
+	}
+	if json.Unmarshal(properties["target_nqn"], &conn.TargetNQN); conn.TargetNQN == "" {
+		json.Unmarshal(properties["nqn"], &conn.TargetNQN)
+	}
+	var portals [][]json.RawMessage
+	json.Unmarshal(properties["portals"], &portals)
+	for _, portal := range portals {
+		if len(portal) < 2 {
+			continue
+		}
+		nvmePortal := resources.NVMePortal{Address: rawString(portal[0]), Port: rawString(portal[1]), Transport: "tcp"}
+		if len(portal) > 2 {
+			nvmePortal.Transport = rawString(portal[2])
+		}
+		conn.NVMePortals = append(conn.NVMePortals, nvmePortal)
+	}
+	if len(conn.NVMePortals) == 0 && len(conn.TargetPortals) > 0 {
+		nvmePortal := resources.NVMePortal{Address: conn.TargetPortals[0], Port: rawString(properties["target_port"]), Transport: "tcp"}
+		json.Unmarshal(properties["transport_type"], &nvmePortal.Transport)
+		conn.NVMePortals = append(conn.NVMePortals, nvmePortal)
+	}
+	// The single portal is an NVMe portal, not an iSCSI one
+	conn.TargetPortals = nil
+	json.Unmarshal(properties["volume_nguid"], &conn.VolumeNGUID)
+	json.Unmarshal(properties["vol_uuid"], &conn.VolumeUUID)
+	conn.NamespaceID, _ = strconv.Atoi(rawString(properties["ns_id"]))
+}
+
 // GetServerIDFromNodeName : Returns VM ID given its IP
 func (opnStk *OpenstackCloud) GetServerIDFromNodeName(nodeName string) (string, error) {
 	var portList []ports_v2.Port
@@ -413,7 +898,7 @@ func (opnStk *OpenstackCloud) GetServerIDFromNodeName(nodeName string) (string,
 
 // NewComputeV2 :  Returns nova service client
 func (opnStk *OpenstackCloud) NewComputeV2() (*gophercloud.ServiceClient, error) {
-	client, err := openstack.NewComputeV2(opnStk.Provider, gophercloud.EndpointOpts{})
+	client, err := openstack.NewComputeV2(opnStk.Provider, opnStk.EndpointOpts)
 	if err != nil {
 		log.Errorf("Could not get openstack nova client. Error is %s", err)
 		return nil, err
@@ -423,7 +908,7 @@ func (opnStk *OpenstackCloud) NewComputeV2() (*gophercloud.ServiceClient, error)
 
 // NewVolumeV3 : Returns cinder service client
 func (opnStk *OpenstackCloud) NewVolumeV3() (*gophercloud.ServiceClient, error) {
-	client, err := openstack.NewBlockStorageV3(opnStk.Provider, gophercloud.EndpointOpts{})
+	client, err := openstack.NewBlockStorageV3(opnStk.Provider, opnStk.EndpointOpts)
 	if err != nil {
 		log.Errorf("Could not get openstack cinder client. Error is %s", err)
 		return nil, err
@@ -433,7 +918,7 @@ func (opnStk *OpenstackCloud) NewVolumeV3() (*gophercloud.ServiceClient, error)
 
 // NewNetworkV2 : Returns Neutron service client
 func (opnStk *OpenstackCloud) NewNetworkV2() (*gophercloud.ServiceClient, error) {
-	client, err := openstack.NewNetworkV2(opnStk.Provider, gophercloud.EndpointOpts{})
+	client, err := openstack.NewNetworkV2(opnStk.Provider, opnStk.EndpointOpts)
 	if err != nil {
 		log.Errorf("Could not get openstack neutron client. Error is %s", err)
 		return nil, err
@@ -441,19 +926,13 @@ func (opnStk *OpenstackCloud) NewNetworkV2() (*gophercloud.ServiceClient, error)
 	return client, nil
 }
 
-func setCertificateOnClient(client *gophercloud.ProviderClient) {
+func setCertificateOnClient(client *gophercloud.ProviderClient, certData []byte) {
 	config := &tls.Config{}
-	// If we were given a certificate file, use it, otherwise don't do validation
-	if certPath, ok := os.LookupEnv("OS_CACERT"); ok && certPath != "" {
-		certData := readCertificate(certPath)
-		// If the environment variable is set but the file is empty this also means don't use the certificate
-		if certData != nil && len(certData) > 0 {
-			caPool := x509.NewCertPool()
-			caPool.AppendCertsFromPEM(certData)
-			config.RootCAs = caPool
-		} else {
-			config.InsecureSkipVerify = true
-		}
+	// If we were given a certificate, use it, otherwise don't do validation
+	if len(certData) > 0 {
+		caPool := x509.NewCertPool()
+		caPool.AppendCertsFromPEM(certData)
+		config.RootCAs = caPool
 	} else {
 		config.InsecureSkipVerify = true
 	}
@@ -461,6 +940,15 @@ func setCertificateOnClient(client *gophercloud.ProviderClient) {
 	client.HTTPClient.Transport = netutil.SetOldTransportDefaults(&http.Transport{TLSClientConfig: config})
 }
 
+// readCertificateFromConfig : Read the certificate file named by the configuration, if there is one
+func readCertificateFromConfig(getConfig func(string) string) []byte {
+	// If the setting is there but the file is empty this also means don't use the certificate
+	if certPath := getConfig(resources.OSCACert); certPath != "" {
+		return readCertificate(certPath)
+	}
+	return nil
+}
+
 // readCertificate :  Read the openstack server certificate file
 func readCertificate(certFile string) []byte {
 	certData, err := ioutil.ReadFile(certFile)
@@ -468,9 +956,13 @@ func readCertificate(certFile string) []byte {
 		Log.Errorf("Could not load Openstack certificate. Error is %s", err)
 		return nil
 	}
-	// Since the golang x509 library doesn't properly handle spaces in the certificate
-	// rather than new lines, we will do some trickery to convert the spaces to new
-	// lines, but to do so need to temporarily replace real spaces so they don't get hit
+	return formatCertificate(certData)
+}
+
+// formatCertificate : Since the golang x509 library doesn't properly handle spaces in the certificate
+// rather than new lines, we will do some trickery to convert the spaces to new lines, but to do so
+// need to temporarily replace real spaces so they don't get hit
+func formatCertificate(certData []byte) []byte {
 	certDataStr := strings.Replace(string(certData), " CERTIFICATE", ".CERTIFICATE", -1)
 	certDataStr = strings.Replace(certDataStr, " ", "\n", -1)
 	certDataStr = strings.Replace(certDataStr, ".CERTIFICATE", " CERTIFICATE", -1)
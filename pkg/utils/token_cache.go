@@ -0,0 +1,237 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"github.com/nightlyone/lockfile"
+)
+
+// A cached token this close to expiring is replaced, so that it doesn't expire halfway through an operation
+const tokenExpiryMargin = 5 * time.Minute
+
+// cachedToken : A Keystone token saved on the node, with the service catalog that came with it
+type cachedToken struct {
+	// Key identifies the credentials the token was issued for
+	Key       string                 `json:"key"`
+	ID        string                 `json:"id"`
+	ExpiresAt time.Time              `json:"expires_at"`
+	Catalog   tokens3.ServiceCatalog `json:"catalog"`
+	ProjectID string                 `json:"project_id,omitempty"`
+}
+
+// CreateOpenstackClientWithTokenCache : Creates an OpenStack client with the process configuration, reusing the
+// token an earlier run saved in the cache file for as long as it is valid. It is meant for short-lived processes,
+// like the FlexVolume plugin, which would otherwise authenticate to Keystone every time they run.
+func CreateOpenstackClientWithTokenCache(cacheFile string) (OpenstackCloudI, error) {
+	opts, endpointOpts, certData, err := openstackConfig()
+	if err != nil {
+		return nil, err
+	}
+	// A token from the configuration is used as is, there is nothing to save
+	if opts.TokenID != "" {
+		return newOpenstackCloud(opts, endpointOpts, certData)
+	}
+
+	// Concurrent runs wait for the first one to authenticate and then all use its token
+	unlock := lockTokenCache()
+	defer unlock()
+	key := authOptionsKey(opts)
+	if token := readCachedToken(cacheFile, key); token != nil {
+		log.Debugf("Using the cached token which expires at %s", token.ExpiresAt)
+		return cloudFromCachedToken(cacheFile, token, opts, endpointOpts, certData)
+	}
+	cloud, err := newOpenstackCloud(opts, endpointOpts, certData)
+	if err != nil {
+		return nil, err
+	}
+	saveProviderToken(cacheFile, key, cloud.GetProviderClient())
+	return cloud, nil
+}
+
+// cloudFromCachedToken : Returns an OpenStack client using the cached token without authenticating
+func cloudFromCachedToken(cacheFile string, token *cachedToken, opts gophercloud.AuthOptions,
+	endpointOpts gophercloud.EndpointOpts, certData []byte) (OpenstackCloudI, error) {
+	providerClient, err := openstack.NewClient(opts.IdentityEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Error while constructing client from openstack %s", err.Error())
+	}
+	setCertificateOnClient(providerClient, certData)
+	providerClient.UseTokenLock()
+	providerClient.SetToken(token.ID)
+	catalog := token.Catalog
+	providerClient.EndpointLocator = func(eo gophercloud.EndpointOpts) (string, error) {
+		return openstack.V3EndpointURL(&catalog, eo)
+	}
+	// A revoked token fails the first request with a 401, after which we authenticate and replace the cached token
+	providerClient.ReauthFunc = func() error {
+		cloud, err := newOpenstackCloud(opts, endpointOpts, certData)
+		if err != nil {
+			return err
+		}
+		freshClient := cloud.GetProviderClient()
+		providerClient.CopyTokenFrom(freshClient)
+		providerClient.EndpointLocator = freshClient.EndpointLocator
+		unlock := lockTokenCache()
+		defer unlock()
+		saveProviderToken(cacheFile, token.Key, freshClient)
+		return nil
+	}
+	openStackController := OpenstackCloud{
+		Provider:     providerClient,
+		EndpointOpts: endpointOpts,
+		ProjectID:    token.ProjectID,
+	}
+	return &openStackController, nil
+}
+
+// lockTokenCache : Takes the lock shared by the processes using the token cache, returning the function
+// that releases it. If the lock can't be taken in time the caller goes ahead without it.
+func lockTokenCache() func() {
+	var pID = os.Getpid()
+	lock, err := lockfile.New(filepath.Join(os.TempDir(), resources.TokenCacheLock))
+	if err != nil {
+		log.Warningf("%d : Cannot init token cache lock. Reason : %v", pID, err)
+		return func() {}
+	}
+	for i := 0; i < resources.MaxAttemptsToTryTokenLock; i++ {
+		if err = lock.TryLock(); err == nil {
+			return func() { lock.Unlock() }
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	log.Warningf("%d : Could not get token cache lock, error is %v", pID, err)
+	return func() {}
+}
+
+// authOptionsKey : Returns the key of the credentials, so that a token isn't reused after the configuration changes
+func authOptionsKey(opts gophercloud.AuthOptions) string {
+	var scope gophercloud.AuthScope
+	if opts.Scope != nil {
+		scope = *opts.Scope
+	}
+	return credentialsKey(map[string]string{
+		"endpoint":        opts.IdentityEndpoint,
+		"userID":          opts.UserID,
+		"username":        opts.Username,
+		"password":        opts.Password,
+		"domainID":        opts.DomainID,
+		"domainName":      opts.DomainName,
+		"tenantID":        opts.TenantID,
+		"tenantName":      opts.TenantName,
+		"appCredentialID": opts.ApplicationCredentialID,
+		"appCredential":   opts.ApplicationCredentialName,
+		"appSecret":       opts.ApplicationCredentialSecret,
+		"scopeProjectID":  scope.ProjectID,
+		"scopeProject":    scope.ProjectName,
+		"scopeDomainID":   scope.DomainID,
+		"scopeDomain":     scope.DomainName,
+	})
+}
+
+// readCachedToken : Returns the token in the cache file if it was issued for the credentials and isn't about to
+// expire, or nil otherwise
+func readCachedToken(cacheFile string, key string) *cachedToken {
+	fileInfo, err := os.Stat(cacheFile)
+	if err != nil {
+		return nil
+	}
+	// Don't trust a file that anyone but its owner could have written or read
+	if fileInfo.Mode().Perm()&0077 != 0 {
+		log.Warningf("Ignoring token cache %s with permissions %s", cacheFile, fileInfo.Mode().Perm())
+		return nil
+	}
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil
+	}
+	var token cachedToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		log.Warningf("Could not parse token cache %s. Error is %s", cacheFile, err)
+		return nil
+	}
+	if token.Key != key || token.ID == "" || time.Now().Add(tokenExpiryMargin).After(token.ExpiresAt) {
+		return nil
+	}
+	return &token
+}
+
+// saveProviderToken : Saves the token the provider client authenticated with in the cache file
+func saveProviderToken(cacheFile string, key string, providerClient *gophercloud.ProviderClient) {
+	token, err := providerToken(providerClient)
+	if err == nil {
+		token.Key = key
+		err = writeCachedToken(cacheFile, token)
+	}
+	if err != nil {
+		log.Warningf("Could not save the token in %s. Error is %s", cacheFile, err)
+	}
+}
+
+// providerToken : Returns the token and service catalog the provider client got from Keystone
+func providerToken(providerClient *gophercloud.ProviderClient) (*cachedToken, error) {
+	// Only Keystone v3 tokens are saved, the catalog of v2 tokens has a different format
+	result, ok := providerClient.GetAuthResult().(tokens3.CreateResult)
+	if !ok {
+		return nil, errors.New("only Keystone v3 tokens can be saved")
+	}
+	token, err := result.ExtractToken()
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := result.ExtractServiceCatalog()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedToken{ID: providerClient.Token(), ExpiresAt: token.ExpiresAt, Catalog: *catalog,
+		ProjectID: authProjectID(providerClient)}, nil
+}
+
+// writeCachedToken : Writes the token to the cache file, readable by its owner only
+func writeCachedToken(cacheFile string, token *cachedToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file, created with 0600 permissions, and rename it so readers never see a partial file
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cacheFile), filepath.Base(cacheFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), cacheFile)
+}
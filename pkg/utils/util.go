@@ -23,9 +23,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
 
+	"github.com/gophercloud/gophercloud"
 	logging "github.com/op/go-logging"
 )
 
@@ -141,6 +144,79 @@ func IsVolumeAttached(cloud OpenstackCloudI, vmID string, volumeID string) (bool
 	return cloud.IsVolumeAttached(vmID, volumeID)
 }
 
+// GetVolumeConnection : Returns the connection info of the attachment of the volume to the VM
+func GetVolumeConnection(cloud OpenstackCloudI, volumeID string, vmID string) (*resources.VolumeConnection, error) {
+	return cloud.GetVolumeConnection(volumeID, vmID)
+}
+
+// CheckVolumeAttachable : Returns an error if the volume is attached to another VM and can't be attached
+// to a second one
+func CheckVolumeAttachable(vmID string, volume *resources.OSVolume) error {
+	if volume.Multiattach {
+		return nil
+	}
+	for _, attachment := range volume.Attachments {
+		if attachment.ServerID != "" && attachment.ServerID != vmID {
+			return fmt.Errorf("Volume %s is already attached to VM %s and is not multi-attach",
+				volume.ID, attachment.ServerID)
+		}
+	}
+	return nil
+}
+
+// WaitForVolumeDetached : Polls Nova and Cinder until the volume is no longer attached to the VM, which leaves
+// it available, or in-use by the other VMs of a multi-attach volume. The volume, if given, is checked first
+// to save a REST call. Errors of the REST calls are retried until the deadline, and the last one is returned.
+func WaitForVolumeDetached(cloud OpenstackCloudI, vmID string, volumeID string, volume *resources.OSVolume,
+	deadline time.Time) error {
+	var lastErr error
+	for i := 0; i == 0 || time.Now().Before(deadline); i++ {
+		if i > 0 {
+			time.Sleep(5 * time.Second)
+		}
+		if i > 0 || volume == nil {
+			var err error
+			volume, err = cloud.GetOSVolumeByID(volumeID)
+			if _, ok := err.(gophercloud.ErrDefault404); ok {
+				Log.Infof("Volume %s no longer exists", volumeID)
+				return nil
+			} else if err != nil {
+				lastErr = fmt.Errorf("Could not get volume %s. Error is %s", volumeID, err)
+				Log.Warningf("%s", lastErr)
+				continue
+			}
+		}
+		if volume.Status == "error_detaching" {
+			return fmt.Errorf("Volume %s failed to detach from VM %s", volumeID, vmID)
+		}
+		attachedToVM := false
+		for _, attachment := range volume.Attachments {
+			if attachment.ServerID == vmID {
+				attachedToVM = true
+			}
+		}
+		// Nova may still list the attachment after Cinder released it, and the other way around
+		if !attachedToVM && (volume.Status == "available" || volume.Status == "in-use") {
+			attached, err := cloud.IsVolumeAttached(vmID, volumeID)
+			if err != nil {
+				lastErr = fmt.Errorf("Could not check if volume %s is attached to VM %s. Error is %s", volumeID, vmID, err)
+				Log.Warningf("%s", lastErr)
+				continue
+			}
+			if !attached {
+				Log.Infof("Volume %s is detached from VM %s and %s", volumeID, vmID, volume.Status)
+				return nil
+			}
+		}
+		lastErr = nil
+		Log.Debugf("Volume %s is still %s on VM %s", volumeID, volume.Status, vmID)
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("Timed out waiting for volume %s to detach from VM %s", volumeID, vmID)
+}
+
 // DetachVolumeFromVM : detach volume on openstack
 func DetachVolumeFromVM(cloud OpenstackCloudI, vmID string,
 	volumeID string, volume resources.OSVolume) (bool, error) {
@@ -270,7 +346,7 @@ func ResolveNodeAddress(nodeName string) string {
 
 // RunCommand : Run shell command
 func RunCommand(cmdStr string, cmdArgs []string) (string, string, error) {
-	Log.Debugf("Running command %s %s", cmdStr, cmdArgs)
+	Log.Debugf("Running command %s %s", cmdStr, redactArgs(cmdArgs))
 	cmd := ExecCommand(cmdStr, cmdArgs...)
 	var cmdOutput, cmdError bytes.Buffer
 	cmd.Stdout = &cmdOutput
@@ -280,6 +356,48 @@ func RunCommand(cmdStr string, cmdArgs []string) (string, string, error) {
 	return cmdOutput.String(), cmdError.String(), err
 }
 
+// redactArgs : Hides the value following a password setting, like the CHAP password given to iscsiadm,
+// so that it doesn't end up in the log
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	hide := false
+	for i, arg := range args {
+		redacted[i] = arg
+		if hide && !strings.HasPrefix(arg, "-") {
+			redacted[i] = "****"
+			hide = false
+		}
+		if strings.Contains(strings.ToLower(arg), "password") {
+			hide = true
+		}
+	}
+	return redacted
+}
+
+// Exec : Runs commands on the node, so that the callers can be tested with a fake
+type Exec interface {
+	// Run runs the command and returns its output and error output
+	Run(cmd string, args ...string) (string, string, error)
+}
+
+// osExec : Runs the commands on the node, through sudo unless the process is root already
+type osExec struct {
+	useSudo bool
+}
+
+// NewExec : Returns the Exec running commands on the node
+func NewExec() Exec {
+	return &osExec{useSudo: os.Geteuid() != 0}
+}
+
+// Run : Runs the command on the node
+func (e *osExec) Run(cmd string, args ...string) (string, string, error) {
+	if e.useSudo {
+		return RunCommand(resources.CMDSudo, append([]string{cmd}, args...))
+	}
+	return RunCommand(cmd, args)
+}
+
 // RunPipedCommands : Run cmd1 | cmd2 on OS
 func RunPipedCommands(cmd1 string, cmd1Args []string, cmd2 string, cmd2Args []string) (string, string) {
 	Log.Debugf("Running command %s %s | %s %s", cmd1, cmd1Args, cmd2, cmd2Args)
@@ -15,12 +15,20 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/gophercloud/gophercloud"
+	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 )
 
 func setEnvVar() {
@@ -188,3 +196,1146 @@ func TestGetDirectoryName(t *testing.T) {
 		t.Errorf("Expected directory name to be %s, but got %s", expectedDirName, dirName)
 	}
 }
+
+func TestAuthOptionsFromSecret(t *testing.T) {
+	secretData := map[string]string{
+		resources.OSAuthURL:       "https://auth.url",
+		resources.OSUser:          "root",
+		resources.OSPassword:      "passw0rd",
+		resources.OSDomainName:    "Default",
+		resources.OSProjectNameV3: "ibm-default",
+	}
+	opts, err := AuthOptionsFromSecret(secretData)
+	if err != nil {
+		t.Fatalf("Error while getting the auth options. Error is %s", err)
+	}
+	if opts.IdentityEndpoint != "https://auth.url" || opts.Username != "root" || opts.Password != "passw0rd" ||
+		opts.DomainName != "Default" || opts.TenantName != "ibm-default" {
+		t.Errorf("Auth options %+v don't match the secret", opts)
+	}
+
+	// The older project variable is used when the newer one isn't set
+	delete(secretData, resources.OSProjectNameV3)
+	secretData[resources.OSProjectName] = "legacy"
+	opts, err = AuthOptionsFromSecret(secretData)
+	if err != nil {
+		t.Fatalf("Error while getting the auth options. Error is %s", err)
+	}
+	if opts.TenantName != "legacy" {
+		t.Errorf("Expected project legacy, but got %s", opts.TenantName)
+	}
+
+	delete(secretData, resources.OSPassword)
+	if _, err := AuthOptionsFromSecret(secretData); err == nil {
+		t.Errorf("Expected an error for a secret without a password")
+	}
+}
+
+func TestAuthOptionsFromConfigAuthTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		isValid bool
+	}{
+		{
+			name: "application credential by id",
+			config: map[string]string{
+				resources.OSAuthType:            resources.AuthTypeAppCredential,
+				resources.OSAppCredentialID:     "cred_1",
+				resources.OSAppCredentialSecret: "s3cret",
+			},
+			isValid: true,
+		},
+		{
+			name: "application credential by name of the user",
+			config: map[string]string{
+				resources.OSAuthType:            resources.AuthTypeAppCredential,
+				resources.OSAppCredentialName:   "k8s",
+				resources.OSUser:                "svc",
+				resources.OSAppCredentialSecret: "s3cret",
+			},
+			isValid: true,
+		},
+		{
+			name: "application credential by name without a user",
+			config: map[string]string{
+				resources.OSAuthType:            resources.AuthTypeAppCredential,
+				resources.OSAppCredentialName:   "k8s",
+				resources.OSAppCredentialSecret: "s3cret",
+			},
+			isValid: false,
+		},
+		{
+			name: "application credential without a secret",
+			config: map[string]string{
+				resources.OSAuthType:        resources.AuthTypeAppCredential,
+				resources.OSAppCredentialID: "cred_1",
+			},
+			isValid: false,
+		},
+		{
+			name:    "token",
+			config:  map[string]string{resources.OSAuthType: resources.AuthTypeToken, resources.OSToken: FakeToken},
+			isValid: true,
+		},
+		{
+			name:    "token auth without a token",
+			config:  map[string]string{resources.OSAuthType: resources.AuthTypeToken},
+			isValid: false,
+		},
+		{
+			name:    "unknown auth type",
+			config:  map[string]string{resources.OSAuthType: "kerberos"},
+			isValid: false,
+		},
+	}
+	for _, test := range tests {
+		// The domain is set like in the templates and examples
+		test.config[resources.OSAuthURL] = "https://auth.url"
+		test.config[resources.OSProjectNameV3] = "ibm-default"
+		test.config[resources.OSDomainName] = "Default"
+		opts, err := authOptionsFromConfig(func(key string) string { return test.config[key] })
+		if (err == nil) != test.isValid {
+			t.Errorf("%s: expected valid %t, but got error %v", test.name, test.isValid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// Keystone has to accept the request the options make
+		if _, err := opts.ToTokenV3CreateMap(nil); err != nil {
+			t.Errorf("%s: expected a valid token request, but got %s", test.name, err)
+		}
+		if _, err := opts.ToTokenV3ScopeMap(); err != nil {
+			t.Errorf("%s: expected a valid token scope, but got %s", test.name, err)
+		}
+		if test.config[resources.OSAuthType] == resources.AuthTypeToken &&
+			(opts.Scope == nil || opts.Scope.ProjectName != "ibm-default" || opts.Scope.DomainName != "Default") {
+			t.Errorf("%s: expected the token to be scoped to project ibm-default, but got %+v", test.name, opts.Scope)
+		}
+		if opts.Password != "" {
+			t.Errorf("%s: expected no password to be used", test.name)
+		}
+		// Application credentials are bound to their project
+		if test.config[resources.OSAuthType] == resources.AuthTypeAppCredential && opts.TenantName != "" {
+			t.Errorf("%s: expected no project scope, but got %s", test.name, opts.TenantName)
+		}
+	}
+}
+
+func TestConfigFromCloudsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clouds")
+	if err != nil {
+		t.Fatalf("Error while creating temp dir. Error is %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cloudsPath := filepath.Join(dir, "clouds.yaml")
+	clouds := `
+clouds:
+  powervc:
+    auth:
+      auth_url: https://powervc.example.com:5000/v3/
+      username: svc
+      project_name: ibm-default
+      user_domain_name: Default
+    region_name: RegionTwo
+    interface: internal
+    cacert: /etc/pki/powervc.crt
+  split-domains:
+    auth:
+      auth_url: https://powervc.example.com:5000/v3/
+      username: svc
+      user_domain_id: users-id
+      project_name: ibm-default
+      project_domain_name: Projects
+`
+	if err := ioutil.WriteFile(cloudsPath, []byte(clouds), 0600); err != nil {
+		t.Fatalf("Error while writing clouds file. Error is %s", err)
+	}
+	os.Setenv(resources.OSClientConfigFile, cloudsPath)
+	os.Setenv(resources.OSCloud, "powervc")
+	// Settings that aren't in the cloud still come from the environment
+	os.Setenv(resources.OSPassword, "passw0rd")
+	defer os.Unsetenv(resources.OSClientConfigFile)
+	defer os.Unsetenv(resources.OSCloud)
+	defer os.Unsetenv(resources.OSPassword)
+
+	getConfig, err := configFromEnv()
+	if err != nil {
+		t.Fatalf("Error while reading clouds file. Error is %s", err)
+	}
+	expected := map[string]string{
+		resources.OSAuthURL:    "https://powervc.example.com:5000/v3/",
+		resources.OSUser:       "svc",
+		resources.OSPassword:   "passw0rd",
+		resources.OSUserDomain: "Default",
+		resources.OSRegionName: "RegionTwo",
+		resources.OSInterface:  "internal",
+		resources.OSCACert:     "/etc/pki/powervc.crt",
+	}
+	for key, value := range expected {
+		if getConfig(key) != value {
+			t.Errorf("Expected %s to be %s, but got %s", key, value, getConfig(key))
+		}
+	}
+	opts, err := authOptionsFromConfig(getConfig)
+	if err != nil {
+		t.Fatalf("Error while getting the auth options. Error is %s", err)
+	}
+	if opts.DomainName != "Default" || opts.TenantName != "ibm-default" {
+		t.Errorf("Auth options %+v don't match the clouds file", opts)
+	}
+
+	// The project is looked up in its own domain, not in the one of the user
+	os.Setenv(resources.OSCloud, "split-domains")
+	if getConfig, err = configFromEnv(); err != nil {
+		t.Fatalf("Error while reading clouds file. Error is %s", err)
+	}
+	if opts, err = authOptionsFromConfig(getConfig); err != nil {
+		t.Fatalf("Error while getting the auth options. Error is %s", err)
+	}
+	if opts.DomainID != "users-id" || opts.DomainName != "" || opts.Scope == nil ||
+		opts.Scope.ProjectName != "ibm-default" || opts.Scope.DomainName != "Projects" || opts.Scope.DomainID != "" {
+		t.Errorf("Auth options %+v with scope %+v don't match the clouds file", opts, opts.Scope)
+	}
+	if _, err := opts.ToTokenV3ScopeMap(); err != nil {
+		t.Errorf("Expected a valid token scope, but got %s", err)
+	}
+
+	os.Setenv(resources.OSCloud, "missing")
+	if _, err := configFromEnv(); err == nil {
+		t.Errorf("Expected an error for a cloud that isn't in the clouds file")
+	}
+}
+
+func TestAuthProjectID(t *testing.T) {
+	result := tokens3.CreateResult{}
+	result.Body = map[string]interface{}{
+		"token": map[string]interface{}{"project": map[string]interface{}{"id": "project_1", "name": "ibm-default"}},
+	}
+	providerClient := &gophercloud.ProviderClient{}
+	providerClient.SetTokenAndAuthResult(result)
+	if projectID := authProjectID(providerClient); projectID != "project_1" {
+		t.Errorf("Expected project project_1, but got %s", projectID)
+	}
+	// Tokens set by hand have no result to take the project from
+	providerClient.SetToken(FakeToken)
+	if projectID := authProjectID(providerClient); projectID != "" {
+		t.Errorf("Expected no project, but got %s", projectID)
+	}
+}
+
+func TestEndpointOptsFromConfig(t *testing.T) {
+	tests := []struct {
+		region       string
+		iface        string
+		availability gophercloud.Availability
+		isValid      bool
+	}{
+		{region: "", iface: "", availability: "", isValid: true},
+		{region: "RegionTwo", iface: "internal", availability: gophercloud.AvailabilityInternal, isValid: true},
+		{region: "RegionOne", iface: "adminURL", availability: gophercloud.AvailabilityAdmin, isValid: true},
+		{region: "RegionOne", iface: "private", isValid: false},
+	}
+	for _, test := range tests {
+		config := map[string]string{resources.OSRegionName: test.region, resources.OSInterface: test.iface}
+		endpointOpts, err := endpointOptsFromConfig(func(key string) string { return config[key] })
+		if (err == nil) != test.isValid {
+			t.Errorf("Expected interface %s to be valid %t, but got error %v", test.iface, test.isValid, err)
+			continue
+		}
+		if err == nil && (endpointOpts.Region != test.region || endpointOpts.Availability != test.availability) {
+			t.Errorf("Expected region %s and interface %s, but got %+v", test.region, test.availability, endpointOpts)
+		}
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	var lock sync.Mutex
+	authenticated := make(map[string]int)
+	cache := NewClientCache()
+	cache.newClient = func(secretData map[string]string) (OpenstackCloudI, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		authenticated[secretData[resources.OSUser]]++
+		if secretData[resources.OSUser] == "bad" {
+			return nil, fmt.Errorf("authentication failed")
+		}
+		return &OpenstackCloudMock{}, nil
+	}
+
+	// Concurrent workers with the same credentials must share a single authentication
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.GetOpenstackClient(map[string]string{resources.OSUser: "alice"}); err != nil {
+				t.Errorf("Expected a client, but got error %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := cache.GetOpenstackClient(nil); err != nil {
+		t.Errorf("Expected a client for the process credentials, but got error %s", err)
+	}
+	if _, err := cache.GetOpenstackClient(map[string]string{resources.OSUser: "bob"}); err != nil {
+		t.Errorf("Expected a client, but got error %s", err)
+	}
+	// Failed authentications are not cached, so a fixed secret works on the next call
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetOpenstackClient(map[string]string{resources.OSUser: "bad"}); err == nil {
+			t.Errorf("Expected an error for credentials that fail to authenticate")
+		}
+	}
+	expected := map[string]int{"alice": 1, "": 1, "bob": 1, "bad": 2}
+	for user, count := range expected {
+		if authenticated[user] != count {
+			t.Errorf("Expected %d authentications for %q, but got %d", count, user, authenticated[user])
+		}
+	}
+
+	// The clients of secrets which are no longer used, like rotated ones, are dropped
+	cache.lock.Lock()
+	for key, entry := range cache.clients {
+		entry.lastUsed = entry.lastUsed.Add(-2 * clientIdleTimeout)
+		if key == credentialsKey(map[string]string{resources.OSUser: "bob"}) {
+			entry.lastUsed = time.Now()
+		}
+	}
+	cache.lock.Unlock()
+	cache.GetOpenstackClient(map[string]string{resources.OSUser: "bob"})
+	if len(cache.clients) != 2 {
+		t.Errorf("Expected only the clients of bob and the process credentials to be kept, but got %d clients", len(cache.clients))
+	}
+}
+
+func TestClientCacheSlowAuthentication(t *testing.T) {
+	cache := NewClientCache()
+	release := make(chan struct{})
+	cache.newClient = func(secretData map[string]string) (OpenstackCloudI, error) {
+		if secretData[resources.OSUser] == "slow" {
+			<-release
+		}
+		return &OpenstackCloudMock{}, nil
+	}
+	slowDone := make(chan struct{})
+	go func() {
+		cache.GetOpenstackClient(map[string]string{resources.OSUser: "slow"})
+		close(slowDone)
+	}()
+	// The other credentials don't wait for the slow Keystone call
+	done := make(chan struct{})
+	go func() {
+		cache.GetOpenstackClient(nil)
+		cache.GetOpenstackClient(map[string]string{resources.OSUser: "alice"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the other credentials to authenticate while the slow one is in progress")
+	}
+	close(release)
+	<-slowDone
+}
+
+func TestCredentialsKey(t *testing.T) {
+	if credentialsKey(nil) != "" {
+		t.Errorf("Expected the empty key for the process credentials")
+	}
+	key := credentialsKey(map[string]string{"a": "bc", "d": "e"})
+	if key == "" || key != credentialsKey(map[string]string{"d": "e", "a": "bc"}) {
+		t.Errorf("Expected the same key for the same secret data, but got %s", key)
+	}
+	if key == credentialsKey(map[string]string{"ab": "c", "d": "e"}) {
+		t.Errorf("Expected a different key when the secret data differs")
+	}
+	if credentialsKey(map[string]string{}) == "" {
+		t.Errorf("Expected empty secret data to get a key of its own")
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokencache")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "token", "token.json")
+
+	if readCachedToken(cacheFile, "key") != nil {
+		t.Errorf("Expected no token before one is saved")
+	}
+	token := &cachedToken{Key: "key", ID: "token_1", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := writeCachedToken(cacheFile, token); err != nil {
+		t.Fatalf("Could not write the token %s", err)
+	}
+	if fileInfo, err := os.Stat(cacheFile); err != nil || fileInfo.Mode().Perm() != 0600 {
+		t.Errorf("Expected the token file with permissions 0600, but got %v %v", fileInfo, err)
+	}
+	if cached := readCachedToken(cacheFile, "key"); cached == nil || cached.ID != "token_1" {
+		t.Errorf("Expected the saved token, but got %+v", cached)
+	}
+	if readCachedToken(cacheFile, "other") != nil {
+		t.Errorf("Expected no token for other credentials")
+	}
+
+	// Tokens about to expire are not reused
+	token.ExpiresAt = time.Now().Add(time.Minute)
+	if err := writeCachedToken(cacheFile, token); err != nil {
+		t.Fatalf("Could not write the token %s", err)
+	}
+	if readCachedToken(cacheFile, "key") != nil {
+		t.Errorf("Expected no token when it is about to expire")
+	}
+
+	// Files others could have tampered with are not trusted
+	token.ExpiresAt = time.Now().Add(time.Hour)
+	if err := writeCachedToken(cacheFile, token); err != nil {
+		t.Fatalf("Could not write the token %s", err)
+	}
+	os.Chmod(cacheFile, 0644)
+	if readCachedToken(cacheFile, "key") != nil {
+		t.Errorf("Expected no token from a file readable by others")
+	}
+}
+
+func TestAuthOptionsKey(t *testing.T) {
+	opts := gophercloud.AuthOptions{IdentityEndpoint: "https://keystone:5000/v3", Username: "user", Password: "pass"}
+	key := authOptionsKey(opts)
+	opts.Password = "changed"
+	if key == authOptionsKey(opts) {
+		t.Errorf("Expected a different key after the password changed")
+	}
+}
+
+// recordingExec : Records the commands instead of running them, failing the ones in failCmds
+type recordingExec struct {
+	cmds     [][]string
+	output   map[string]string
+	failCmds map[string]string
+}
+
+func (e *recordingExec) Run(cmd string, args ...string) (string, string, error) {
+	e.cmds = append(e.cmds, append([]string{cmd}, args...))
+	if cmdErr, ok := e.failCmds[cmd]; ok {
+		return "", cmdErr, fmt.Errorf("exit status 32")
+	}
+	return e.output[cmd], "", nil
+}
+
+func TestResizeFileSystemExec(t *testing.T) {
+	exec := &recordingExec{output: map[string]string{resources.CMDLsBlk: "ext4\n"}}
+	defer func(old Exec) { nodeExec = old }(nodeExec)
+	nodeExec = exec
+	mounter := NewFakeMounter()
+	mounter.MountPoints["/kubelet/mount/vol_1"] = "/dev/sdd"
+	if err := ResizeFileSystem(mounter, "/kubelet/mount/vol_1"); err != nil {
+		t.Fatalf("Expected the file system to be resized, but got %s", err)
+	}
+	expected := [][]string{
+		{resources.CMDLsBlk, "/dev/sdd", "--noheadings", "-o", "FSTYPE"},
+		{resources.CMDResize2FS, "/dev/sdd"},
+	}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %s, but got %s", expected, exec.cmds)
+	}
+
+	// The multipath commands go through the Exec as well
+	exec = &recordingExec{}
+	nodeExec = exec
+	if err := RemoveMultipathForDevice("/dev/dm-3"); err != nil {
+		t.Fatalf("Expected the multipath map to be removed, but got %s", err)
+	}
+	if err := UdevdHandleEvents("/dev/disk/by-id/missing"); err != nil {
+		t.Fatalf("Expected udev to handle the events, but got %s", err)
+	}
+	expected = [][]string{
+		{resources.CMDMultipath, "-f", "/dev/dm-3"},
+		{resources.CMDUdevAdm, resources.CMDUdevAdmParamSettle},
+		{resources.CMDUdevAdm, resources.CMDUdevAdmParamTrigger},
+	}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %s, but got %s", expected, exec.cmds)
+	}
+}
+
+func TestLinuxMounterFormatAndMount(t *testing.T) {
+	exec := &recordingExec{}
+	mounter := NewLinuxMounter(exec)
+	if err := mounter.FormatAndMount("/dev/sdd", "/kubelet/mount/vol_1", "", []string{"ro"}); err != nil {
+		t.Fatalf("Expected format and mount to succeed, but got %s", err)
+	}
+	expected := [][]string{
+		{resources.CMDLsBlk, "/dev/sdd", "--noheadings", "-o", "FSTYPE", "-f"},
+		{resources.CMDMkFS + "ext4", "/dev/sdd", "-F"},
+		{resources.CMDMkDir, "-p", "/kubelet/mount/vol_1"},
+		{resources.CMDMount, "-o", "ro", "/dev/sdd", "/kubelet/mount/vol_1"},
+	}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %s, but got %s", expected, exec.cmds)
+	}
+
+	// Devices with a file system are not formatted again
+	exec = &recordingExec{output: map[string]string{resources.CMDLsBlk: "xfs\n"}}
+	if err := NewLinuxMounter(exec).FormatAndMount("/dev/sdd", "/kubelet/mount/vol_1", "xfs", nil); err != nil {
+		t.Fatalf("Expected format and mount to succeed, but got %s", err)
+	}
+	for _, cmd := range exec.cmds {
+		if strings.HasPrefix(cmd[0], resources.CMDMkFS) {
+			t.Errorf("Expected no file system to be created, but ran %s", cmd)
+		}
+	}
+
+	exec = &recordingExec{failCmds: map[string]string{resources.CMDMount: "wrong fs type, bad option, bad superblock"}}
+	if err := NewLinuxMounter(exec).FormatAndMount("/dev/sdd", "/kubelet/mount/vol_1", "", nil); err == nil {
+		t.Errorf("Expected the mount to fail")
+	}
+	if last := exec.cmds[len(exec.cmds)-1]; last[0] != resources.CMDMkFS+"ext4" {
+		t.Errorf("Expected the file system to be created again after a bad superblock, but ran %s", last)
+	}
+}
+
+func TestLinuxMounterBindMount(t *testing.T) {
+	exec := &recordingExec{}
+	if err := NewLinuxMounter(exec).Mount("/staging", "/target", "", []string{"bind", "ro"}); err != nil {
+		t.Fatalf("Expected the bind mount to succeed, but got %s", err)
+	}
+	expected := [][]string{
+		{resources.CMDMkDir, "-p", "/target"},
+		{resources.CMDMount, "--bind", "/staging", "/target"},
+		{resources.CMDMount, "-o", "remount,bind,ro", "/target"},
+	}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %s, but got %s", expected, exec.cmds)
+	}
+}
+
+const testMountInfo = `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/rhel-root rw,seclabel,attr2
+40 22 0:5 / /dev rw,nosuid shared:2 - devtmpfs devtmpfs rw,seclabel,size=4052356k
+120 22 253:3 / /var/lib/kubelet/plugins/mounts/pv\040one rw,relatime shared:60 - ext4 /dev/mapper/mpathi rw,seclabel
+121 22 253:3 / /var/lib/kubelet/pods/uid/volumes/pv\040one rw,relatime shared:60 - ext4 /dev/mapper/mpathi rw,seclabel
+122 22 253:3 /data /var/lib/origin/pods/uid/data ro,relatime shared:60 master:3 - ext4 /dev/mapper/mpathi rw,seclabel
+130 22 8:16 / /var/lib/kubelet/plugins/mounts/pv2 rw,relatime shared:70 - ext4 /dev/sdb rw,seclabel
+131 130 8:32 / /var/lib/kubelet/plugins/mounts/pv2 rw,relatime shared:71 - xfs /dev/sdc rw,seclabel
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatalf("Could not parse mountinfo %s", err)
+	}
+	if len(mounts) != 7 {
+		t.Fatalf("Expected 7 mounts, but got %d", len(mounts))
+	}
+	mount := FindMount(mounts, "/var/lib/kubelet/plugins/mounts/pv one/")
+	if mount == nil || mount.ID != 120 || mount.Source != "/dev/mapper/mpathi" || mount.FsType != "ext4" ||
+		mount.Device != "253:3" {
+		t.Errorf("Expected the mount with the escaped space in its path, but got %+v", mount)
+	}
+	// The mount on top is the one that is used
+	if mount := FindMount(mounts, "/var/lib/kubelet/plugins/mounts/pv2"); mount == nil || SourceDevice(mount) != "/dev/sdc" {
+		t.Errorf("Expected the last of the stacked mounts, but got %+v", mount)
+	}
+	if FindMount(mounts, "/var/lib/kubelet/plugins/mounts/pv3") != nil {
+		t.Errorf("Expected no mount for a directory that isn't mounted")
+	}
+
+	refs := MountRefs(mounts, "/var/lib/kubelet/plugins/mounts/pv one")
+	if len(refs) != 2 || refs[0] != "/var/lib/kubelet/pods/uid/volumes/pv one" || refs[1] != "/var/lib/origin/pods/uid/data" {
+		t.Errorf("Expected the two bind mounts as references, but got %s", refs)
+	}
+
+	if _, err := ParseMountInfo(strings.NewReader("36 35 98:0 /mnt1 /mnt2 rw,noatime master:1\n")); err == nil {
+		t.Errorf("Expected an error for a line without the separator")
+	}
+}
+
+func TestLinuxMounterGetDeviceFromMount(t *testing.T) {
+	file, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Fatalf("Could not create temporary file %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(testMountInfo)
+	file.Close()
+
+	mounter := NewLinuxMounter(&recordingExec{})
+	mounter.mountInfoPath = file.Name()
+	device, err := mounter.GetDeviceFromMount("/var/lib/origin/pods/uid/data")
+	if err != nil || device != "/dev/mapper/mpathi" {
+		t.Errorf("Expected device /dev/mapper/mpathi, but got %s %v", device, err)
+	}
+	if _, err := mounter.GetDeviceFromMount("/var/lib/kubelet/plugins/mounts/pv3"); err == nil {
+		t.Errorf("Expected an error for a directory that isn't mounted")
+	}
+	if refs, err := mounter.GetMountRefs("/var/lib/kubelet/plugins/mounts/pv2"); err != nil || len(refs) != 0 {
+		t.Errorf("Expected no references, but got %s %v", refs, err)
+	}
+}
+
+func TestLinuxMounterIsLikelyNotMountPoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounter")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	mounter := NewLinuxMounter(&recordingExec{})
+	if notMnt, err := mounter.IsLikelyNotMountPoint(dir); err != nil || !notMnt {
+		t.Errorf("Expected %s not to be a mount point, but got %t %v", dir, notMnt, err)
+	}
+	if _, err := mounter.IsLikelyNotMountPoint(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error for a missing directory, but got %v", err)
+	}
+}
+
+func TestWaitForVolumeDetached(t *testing.T) {
+	cloud := &OpenstackCloudMock{}
+	volume, _ := cloud.GetOSVolumeByID("vol_2")
+	if err := WaitForVolumeDetached(cloud, "vm_1", "vol_2", volume, time.Now()); err != nil {
+		t.Errorf("Expected volume attached to another VM to be detached, but got %s", err)
+	}
+	volume.Attachments = nil
+	volume.Status = "available"
+	if err := WaitForVolumeDetached(cloud, "vm_2", "vol_2", volume, time.Now()); err != nil {
+		t.Errorf("Expected available volume to be detached, but got %s", err)
+	}
+	volume.Status = "error_detaching"
+	if err := WaitForVolumeDetached(cloud, "vm_2", "vol_2", volume, time.Now()); err == nil {
+		t.Errorf("Expected an error for a volume that failed to detach")
+	}
+	// A Nova error doesn't mean the volume is detached
+	volume.Status = "available"
+	cloud.AttachedErr = fmt.Errorf("nova is down")
+	if err := WaitForVolumeDetached(cloud, "vm_2", "vol_2", volume, time.Now()); err == nil || !strings.Contains(err.Error(), "nova is down") {
+		t.Errorf("Expected the Nova error at the deadline, but got %v", err)
+	}
+}
+
+func TestWaitForDetachedDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "detach")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := WaitForDetachedDevice(filepath.Join(dir, "wwn-0x1"), time.Now()); err != nil {
+		t.Errorf("Expected no error for a device that is gone, but got %s", err)
+	}
+}
+
+// vpdPage83 : Returns a device identification VPD page holding the binary NAA designator and an ASCII
+// T10 vendor designator
+func vpdPage83(naa []byte, vendorID string) []byte {
+	descriptors := append([]byte{0x01, 0x03, 0x00, byte(len(naa))}, naa...)
+	descriptors = append(descriptors, 0x02, 0x01, 0x00, byte(len(vendorID)))
+	descriptors = append(descriptors, vendorID...)
+	return append([]byte{0x00, 0x83, 0x00, byte(len(descriptors))}, descriptors...)
+}
+
+func TestParseVPDPages(t *testing.T) {
+	naa := []byte{0x60, 0x05, 0x07, 0x68, 0x01, 0x80, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+	designators, err := ParseVPDPage83(vpdPage83(naa, "IBM     2145    "))
+	if err != nil {
+		t.Fatalf("Could not parse VPD page 0x83 %s", err)
+	}
+	if strings.Join(designators, ",") != "60050768018000010203040506070809,IBM     2145" {
+		t.Errorf("Unexpected designators %v", designators)
+	}
+	if _, err := ParseVPDPage83([]byte{0x00, 0x80, 0x00, 0x00}); err == nil {
+		t.Errorf("Expected an error for a page which isn't 0x83")
+	}
+	serial, err := ParseVPDPage80(append([]byte{0x00, 0x80, 0x00, 0x08}, "0123abcd"...))
+	if err != nil || serial != "0123abcd" {
+		t.Errorf("Expected serial 0123abcd, but got %s %v", serial, err)
+	}
+}
+
+// testVolume : Returns a volume with the ID and WWN
+func testVolume(volumeID string, wwn string) *resources.OSVolume {
+	volume := &resources.OSVolume{}
+	volume.ID = volumeID
+	volume.Metadata = map[string]string{"volume_wwn": wwn}
+	return volume
+}
+
+func TestVerifyDeviceIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vpd")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	naa := []byte{0x60, 0x05, 0x07, 0x68, 0x01, 0x80, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+	os.MkdirAll(filepath.Join(dir, "sdb", "device"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sdb", "device", "vpd_pg83"), vpdPage83(naa, "IBM"), 0644)
+	os.MkdirAll(filepath.Join(dir, "dm-0", "slaves", "sdb"), 0755)
+
+	// SVC volumes are found by the WWN Cinder has for them, whatever the name of the link
+	svcVolume := ExpectedDeviceIdentifiers(testVolume("8d7bbbd6-2b9a-4e57-bb36-0c3c3d2b7c7a", "60050768018000010203040506070809"), nil)
+	if err := verifyDeviceIdentity(dir, svcVolume, "/dev/sdb"); err != nil {
+		t.Errorf("Expected the device to match, but got %s", err)
+	}
+	if err := verifyDeviceIdentity(dir, svcVolume, "/dev/dm-0"); err != nil {
+		t.Errorf("Expected the multipath device to match, but got %s", err)
+	}
+	otherVolume := ExpectedDeviceIdentifiers(testVolume("1f0e0b3a-5c4d-4e2f-8a9b-7c6d5e4f3a2b", "60050768018000010203040506070000"), nil)
+	if err := verifyDeviceIdentity(dir, otherVolume, "/dev/sdb"); err == nil {
+		t.Errorf("Expected an error for the device of another volume")
+	}
+	// The serial number QEMU gives the disk is in page 0x80
+	os.MkdirAll(filepath.Join(dir, "sdc", "device"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sdc", "device", "vpd_pg83"), []byte{0x00, 0x83, 0x00, 0x00}, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sdc", "device", "vpd_pg80"),
+		append([]byte{0x00, 0x80, 0x00, 0x14}, "3f8a2b4c-1d2e-4f5a-9"...), 0644)
+	kvmVolume := ExpectedDeviceIdentifiers(testVolume("3f8a2b4c-1d2e-4f5a-9b6c-0d1e2f3a4b5c", ""), nil)
+	if err := verifyDeviceIdentity(dir, kvmVolume, "/dev/sdc"); err != nil {
+		t.Errorf("Expected the KVM device to match, but got %s", err)
+	}
+	// NVMe namespaces are found by the NGUID of the connection
+	os.MkdirAll(filepath.Join(dir, "nvme0n1"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nvme0n1", "nguid"), []byte("6005076d-0281-0016-8000-000000000042\n"), 0644)
+	nvmeVolume := ExpectedDeviceIdentifiers(testVolume("1f0e0b3a-5c4d-4e2f-8a9b-7c6d5e4f3a2b", ""),
+		&resources.VolumeConnection{VolumeNGUID: "6005076D028100168000000000000042"})
+	if err := verifyDeviceIdentity(dir, nvmeVolume, "/dev/nvme0n1"); err != nil {
+		t.Errorf("Expected the NVMe device to match, but got %s", err)
+	}
+	// Devices without VPD pages can't be verified
+	if err := verifyDeviceIdentity(dir, svcVolume, "/dev/sdd"); err == nil {
+		t.Errorf("Expected an error for a device without VPD pages")
+	}
+	// Nor can volumes without identifiers
+	if err := verifyDeviceIdentity(dir, ExpectedDeviceIdentifiers(testVolume("", ""), nil), "/dev/sdb"); err == nil {
+		t.Errorf("Expected an error for a volume without identifiers")
+	}
+	// Unless the check is turned off
+	defer func(old string) { sysBlockDir = old }(sysBlockDir)
+	sysBlockDir = dir
+	os.Setenv(resources.SkipDeviceIdentityCheck, "true")
+	defer os.Unsetenv(resources.SkipDeviceIdentityCheck)
+	if err := VerifyDeviceIdentity(testVolume("8d7bbbd6-2b9a-4e57-bb36-0c3c3d2b7c7a", ""), nil, "/dev/sdd"); err != nil {
+		t.Errorf("Expected no error with the check turned off, but got %s", err)
+	}
+}
+
+// fakeConnector : Connector returning the same device for every volume
+type fakeConnector struct {
+	devicePath string
+}
+
+func (c *fakeConnector) ConnectVolume(conn *resources.VolumeConnection) (string, error) {
+	return c.devicePath, nil
+}
+
+func (c *fakeConnector) PrepareDisconnect(devices []string) func() error {
+	return nil
+}
+
+func TestWaitForAttachedDeviceVerifiesConnectorDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vpd")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	naa := []byte{0x60, 0x05, 0x07, 0x68, 0x01, 0x80, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+	os.MkdirAll(filepath.Join(dir, "sdb", "device"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sdb", "device", "vpd_pg83"), vpdPage83(naa, "IBM"), 0644)
+	defer func(old string) { sysBlockDir = old }(sysBlockDir)
+	sysBlockDir = dir
+
+	driverVolumeType := "fake"
+	RegisterConnector(driverVolumeType, &fakeConnector{devicePath: "/dev/sdb"})
+	defer func() {
+		connectorsLock.Lock()
+		delete(connectors, driverVolumeType)
+		connectorsLock.Unlock()
+	}()
+	conn := &resources.VolumeConnection{DriverVolumeType: driverVolumeType}
+
+	volume := testVolume("8d7bbbd6-2b9a-4e57-bb36-0c3c3d2b7c7a", "60050768018000010203040506070809")
+	devicePath, err := WaitForAttachedDevice(resources.PathPVMVIOS+"stale", volume, conn)
+	if err != nil || devicePath != "/dev/sdb" {
+		t.Errorf("Expected device /dev/sdb, but got %s %v", devicePath, err)
+	}
+	// The connector found the device of another LUN
+	otherVolume := testVolume("1f0e0b3a-5c4d-4e2f-8a9b-7c6d5e4f3a2b", "60050768018000010203040506070000")
+	if _, err := WaitForAttachedDevice(resources.PathPVMVIOS+"60050768018000010203040506070809", otherVolume, conn); err == nil {
+		t.Errorf("Expected an error for the device of another volume")
+	}
+}
+
+func TestDeviceResolvers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolvers")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "resolvers.json")
+	ioutil.WriteFile(configFile, []byte(`[{"hypervisorType": "powervm", "storageHostType": "ds8k",
+		"prefix": "scsi-3", "source": "id", "stripDashes": true, "length": 12}]`), 0644)
+	resolvers, err := ReadDeviceResolvers(configFile)
+	if err != nil || len(resolvers) != 1 {
+		t.Fatalf("Expected one device resolver, but got %v %v", resolvers, err)
+	}
+	volume := &resources.OSVolume{}
+	volume.ID = "05a0a13c-f839-4c67-bd02-28b6fb6fada3"
+	expected := resources.AttachedVolumeDir + "scsi-305a0a13cf839"
+	if path := resolvers[0].DevicePath(volume); path != expected {
+		t.Errorf("Expected device path %s, but got %s", expected, path)
+	}
+
+	// Storage host types without a resolver of their own get the default of the hypervisor type
+	if FindDeviceResolver(resources.HypTypePvm, "ds8k") != FindDeviceResolver(resources.HypTypePvm, "") {
+		t.Errorf("Expected the default resolver for a storage host type which isn't registered")
+	}
+	RegisterDeviceResolver(resources.HypTypePvm, "ds8k", resolvers[0])
+	defer func() {
+		deviceResolversLock.Lock()
+		delete(deviceResolvers[resources.HypTypePvm], "ds8k")
+		deviceResolversLock.Unlock()
+	}()
+	if FindDeviceResolver(resources.HypTypePvm, "ds8k") != resolvers[0] {
+		t.Errorf("Expected the registered resolver")
+	}
+	if FindDeviceResolver("hyperv", "") != nil {
+		t.Errorf("Expected no resolver for an unknown hypervisor type")
+	}
+
+	ioutil.WriteFile(configFile, []byte(`[{"hypervisorType": "powervm", "prefix": "wwn-0x", "source": "uuid"}]`), 0644)
+	if _, err := ReadDeviceResolvers(configFile); err == nil {
+		t.Errorf("Expected an error for an unknown source")
+	}
+}
+
+func TestParseConnectionInfo(t *testing.T) {
+	var connectionInfo map[string]json.RawMessage
+	json.Unmarshal([]byte(`{"driver_volume_type": "fibre_channel",
+		"data": {"target_wwn": ["500507680B215660", "500507680B225660"], "target_lun": 3}}`), &connectionInfo)
+	conn := ParseConnectionInfo(connectionInfo)
+	if conn.DriverVolumeType != "fibre_channel" || strings.Join(conn.TargetWWNs, ",") != "500507680B215660,500507680B225660" ||
+		conn.TargetLUN != 3 {
+		t.Errorf("Unexpected connection %+v", *conn)
+	}
+	connectionInfo = nil
+	json.Unmarshal([]byte(`{"driver_volume_type": "fibre_channel", "target_wwn": "500507680B215660"}`), &connectionInfo)
+	conn = ParseConnectionInfo(connectionInfo)
+	if strings.Join(conn.TargetWWNs, ",") != "500507680B215660" || conn.TargetLUN != -1 {
+		t.Errorf("Unexpected connection %+v", *conn)
+	}
+}
+
+func TestScsiTargetScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scsiscan")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// Two paths to the storage on hosts 1 and 2, and a port of other storage
+	rports := map[string][]string{
+		"rport-1:0-0": {"0x500507680b215660", "0"},
+		"rport-2:0-1": {"0x500507680b225660", "1"},
+		"rport-2:0-2": {"0x500507680b995660", "2"},
+	}
+	for rport, attrs := range rports {
+		os.MkdirAll(filepath.Join(dir, "fc_remote_ports", rport), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "fc_remote_ports", rport, "port_name"), []byte(attrs[0]+"\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "fc_remote_ports", rport, "scsi_target_id"), []byte(attrs[1]+"\n"), 0644)
+	}
+	os.MkdirAll(filepath.Join(dir, "scsi_host", "host1"), 0755)
+	os.MkdirAll(filepath.Join(dir, "scsi_host", "host2"), 0755)
+
+	conn := &resources.VolumeConnection{TargetWWNs: []string{"500507680B215660", "500507680B225660"}, TargetLUN: 4}
+	if scanned := scsiTargetScan(dir, conn); scanned != 2 {
+		t.Errorf("Expected 2 targets to be scanned, but got %d", scanned)
+	}
+	for host, expected := range map[string]string{"host1": "0 0 4", "host2": "0 1 4"} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "scsi_host", host, "scan"))
+		if string(data) != expected {
+			t.Errorf("Expected %s to scan %q, but got %q", host, expected, data)
+		}
+	}
+	// Without the LUN there is nothing to target
+	if scanned := scsiTargetScan(dir, &resources.VolumeConnection{TargetWWNs: conn.TargetWWNs, TargetLUN: -1}); scanned != 0 {
+		t.Errorf("Expected no scan without LUN, but got %d", scanned)
+	}
+
+	publishContext := map[string]string{}
+	AddVolumeConnection(publishContext, conn)
+	if fromContext := VolumeConnectionFromContext(publishContext); fromContext == nil ||
+		strings.Join(fromContext.TargetWWNs, ",") != "500507680B215660,500507680B225660" || fromContext.TargetLUN != 4 {
+		t.Errorf("Expected the connection from the publish context, but got %+v", fromContext)
+	}
+}
+
+func TestParseISCSIConnectionInfo(t *testing.T) {
+	var connectionInfo map[string]json.RawMessage
+	json.Unmarshal([]byte(`{"driver_volume_type": "iscsi", "data": {"target_portal": "10.0.0.1:3260",
+		"target_iqn": "iqn.1986-03.com.ibm:2145.a", "target_lun": 2,
+		"target_portals": ["10.0.0.1:3260", "10.0.0.2:3260"],
+		"target_iqns": ["iqn.1986-03.com.ibm:2145.a", "iqn.1986-03.com.ibm:2145.b"], "target_luns": [2, 5],
+		"auth_method": "CHAP", "auth_username": "user", "auth_password": "secret"}}`), &connectionInfo)
+	conn := ParseConnectionInfo(connectionInfo)
+	if conn.DriverVolumeType != resources.DriverVolumeTypeISCSI || conn.TargetLUN != 2 ||
+		strings.Join(conn.TargetPortals, ",") != "10.0.0.1:3260,10.0.0.2:3260" ||
+		strings.Join(conn.TargetIQNs, ",") != "iqn.1986-03.com.ibm:2145.a,iqn.1986-03.com.ibm:2145.b" ||
+		len(conn.TargetLUNs) != 2 || conn.TargetLUNs[1] != 5 ||
+		conn.AuthMethod != "CHAP" || conn.AuthUsername != "user" || conn.AuthPassword != "secret" {
+		t.Errorf("Unexpected connection %+v", *conn)
+	}
+	// A single portal is the only path
+	connectionInfo = nil
+	json.Unmarshal([]byte(`{"driver_volume_type": "iscsi", "data": {"target_portal": "10.0.0.1:3260",
+		"target_iqn": "iqn.1986-03.com.ibm:2145.a", "target_lun": 2}}`), &connectionInfo)
+	conn = ParseConnectionInfo(connectionInfo)
+	if strings.Join(conn.TargetPortals, ",") != "10.0.0.1:3260" || strings.Join(conn.TargetIQNs, ",") != "iqn.1986-03.com.ibm:2145.a" {
+		t.Errorf("Unexpected connection %+v", *conn)
+	}
+
+	// Only the type of the connection goes to the publish context, never the credentials
+	publishContext := map[string]string{}
+	AddVolumeConnection(publishContext, conn)
+	if len(publishContext) != 1 || publishContext[resources.DriverVolumeType] != resources.DriverVolumeTypeISCSI {
+		t.Errorf("Unexpected publish context %v", publishContext)
+	}
+	if fromContext := VolumeConnectionFromContext(publishContext); fromContext == nil ||
+		fromContext.DriverVolumeType != resources.DriverVolumeTypeISCSI {
+		t.Errorf("Expected the connection type from the publish context, but got %+v", fromContext)
+	}
+}
+
+func TestISCSIConnectorConnectVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "sdiscsi")
+	ioutil.WriteFile(device, nil, 0644)
+	link := filepath.Join(dir, "ip-10.0.0.1:3260-iscsi-iqn.1986-03.com.ibm:2145.a-lun-2")
+	os.Symlink(device, link)
+
+	// CHAP is set on the node record before logging in
+	exec := &recordingExec{}
+	connector := &ISCSIConnector{exec: exec, byPathDir: dir, sysDir: dir}
+	conn := &resources.VolumeConnection{DriverVolumeType: resources.DriverVolumeTypeISCSI, TargetLUN: 2,
+		TargetPortals: []string{"10.0.0.1:3260"}, TargetIQNs: []string{"iqn.1986-03.com.ibm:2145.a"},
+		AuthMethod: "CHAP", AuthUsername: "user", AuthPassword: "secret"}
+	devicePath, err := connector.ConnectVolume(conn)
+	if err != nil || devicePath != device {
+		t.Fatalf("Expected device %s, but got %s and %v", device, devicePath, err)
+	}
+	node := []string{resources.CMDISCSIAdm, "-m", "node", "-T", "iqn.1986-03.com.ibm:2145.a", "-p", "10.0.0.1:3260"}
+	expected := [][]string{
+		append(node, "-o", "new"),
+		append(node, "-o", "update", "-n", "node.session.auth.authmethod", "-v", "CHAP"),
+		append(node, "-o", "update", "-n", "node.session.auth.username", "-v", "user"),
+		append(node, "-o", "update", "-n", "node.session.auth.password", "-v", "secret"),
+		append(node, "-o", "update", "-n", "node.startup", "-v", "automatic"),
+		append(node, "--login"),
+	}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %v, but got %v", expected, exec.cmds)
+	}
+
+	// Nothing to log in to
+	if _, err := connector.ConnectVolume(&resources.VolumeConnection{TargetLUN: 2}); err == nil {
+		t.Errorf("Expected connection without portal to fail")
+	}
+	// Login fails on every portal
+	exec = &recordingExec{failCmds: map[string]string{resources.CMDISCSIAdm: "iscsiadm: initiator reported error"}}
+	connector.exec = exec
+	if _, err := connector.ConnectVolume(conn); err == nil {
+		t.Errorf("Expected connection to fail when no portal can log in")
+	}
+
+	if redacted := redactArgs(expected[3][1:]); redacted[len(redacted)-1] != "****" ||
+		strings.Contains(strings.Join(redacted, " "), "secret") {
+		t.Errorf("Expected the password to be hidden, but got %v", redacted)
+	}
+}
+
+func TestISCSIConnectorDisconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// sdb of session1 is the last LUN of its session, session2 still has 4:0:0:3
+	for session, lun := range map[string]string{"session1": "3:0:0:1", "session2": "4:0:0:1"} {
+		host := "host" + lun[:1]
+		target := "target" + lun[:5]
+		blockDir := filepath.Join(dir, "devices", "platform", host, session, target, lun, "block")
+		os.MkdirAll(blockDir, 0755)
+		sessionDir := filepath.Join(dir, "class", "iscsi_session", session)
+		os.MkdirAll(filepath.Join(sessionDir, "device"), 0755)
+		os.Symlink(filepath.Join(dir, "devices", "platform", host, session, target), filepath.Join(sessionDir, "device", target))
+		ioutil.WriteFile(filepath.Join(sessionDir, "targetname"), []byte("iqn.1986-03.com.ibm:"+session+"\n"), 0644)
+		connectionDir := filepath.Join(dir, "class", "iscsi_connection", strings.Replace(session, "session", "connection", 1)+":0")
+		os.MkdirAll(connectionDir, 0755)
+		ioutil.WriteFile(filepath.Join(connectionDir, "persistent_address"), []byte("fd00::1\n"), 0644)
+		ioutil.WriteFile(filepath.Join(connectionDir, "persistent_port"), []byte("3260\n"), 0644)
+	}
+	os.MkdirAll(filepath.Join(dir, "devices", "platform", "host4", "session2", "target4:0:0", "4:0:0:3"), 0755)
+	os.MkdirAll(filepath.Join(dir, "block"), 0755)
+	os.Symlink(filepath.Join(dir, "devices", "platform", "host3", "session1", "target3:0:0", "3:0:0:1", "block"),
+		filepath.Join(dir, "block", "sdb"))
+	os.Symlink(filepath.Join(dir, "devices", "platform", "host4", "session2", "target4:0:0", "4:0:0:1", "block"),
+		filepath.Join(dir, "block", "sdc"))
+
+	exec := &recordingExec{}
+	connector := &ISCSIConnector{exec: exec, byPathDir: dir, sysDir: dir}
+	// Devices which aren't iSCSI have nothing to disconnect
+	if disconnect := connector.PrepareDisconnect([]string{"/dev/sdz"}); disconnect != nil {
+		t.Errorf("Expected nothing to disconnect for a device without session")
+	}
+	disconnect := connector.PrepareDisconnect([]string{"/dev/sdb", "/dev/sdc"})
+	if disconnect == nil {
+		t.Fatalf("Expected the iSCSI sessions of the devices to be disconnected")
+	}
+	// The devices are removed before the sessions are looked at
+	os.RemoveAll(filepath.Join(dir, "devices", "platform", "host3", "session1", "target3:0:0", "3:0:0:1"))
+	os.RemoveAll(filepath.Join(dir, "devices", "platform", "host4", "session2", "target4:0:0", "4:0:0:1"))
+	if err := disconnect(); err != nil {
+		t.Fatalf("Expected disconnect to succeed, but got %s", err)
+	}
+	node := []string{resources.CMDISCSIAdm, "-m", "node", "-T", "iqn.1986-03.com.ibm:session1", "-p", "[fd00::1]:3260"}
+	expected := [][]string{append(node, "--logout"), append(node, "-o", "delete")}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %v, but got %v", expected, exec.cmds)
+	}
+}
+
+func TestParseNVMeConnectionInfo(t *testing.T) {
+	var connectionInfo map[string]json.RawMessage
+	json.Unmarshal([]byte(`{"driver_volume_type": "nvmeof", "data": {"target_nqn": "nqn.1986-03.com.ibm:nvme:2145.a",
+		"portals": [["10.0.0.1", "4420", "tcp"], ["10.0.0.2", 4420, "tcp"]],
+		"volume_nguid": "6005076810810261F800000000000A5B", "vol_uuid": "b2a3b2c1-7a4e-4f8e-9d6e-4a5b6c7d8e9f"}}`), &connectionInfo)
+	conn := ParseConnectionInfo(connectionInfo)
+	expected := []resources.NVMePortal{{Address: "10.0.0.1", Port: "4420", Transport: "tcp"}, {Address: "10.0.0.2", Port: "4420", Transport: "tcp"}}
+	if conn.DriverVolumeType != resources.DriverVolumeTypeNVMeoF || conn.TargetNQN != "nqn.1986-03.com.ibm:nvme:2145.a" ||
+		fmt.Sprint(conn.NVMePortals) != fmt.Sprint(expected) || conn.VolumeNGUID != "6005076810810261F800000000000A5B" ||
+		conn.VolumeUUID != "b2a3b2c1-7a4e-4f8e-9d6e-4a5b6c7d8e9f" {
+		t.Errorf("Unexpected connection %+v", *conn)
+	}
+	// The single portal of the older connection info
+	connectionInfo = nil
+	json.Unmarshal([]byte(`{"driver_volume_type": "nvmeof", "data": {"nqn": "nqn.1986-03.com.ibm:nvme:2145.a",
+		"target_portal": "10.0.0.1", "target_port": 4420, "transport_type": "tcp", "ns_id": "3"}}`), &connectionInfo)
+	conn = ParseConnectionInfo(connectionInfo)
+	if conn.TargetNQN != "nqn.1986-03.com.ibm:nvme:2145.a" || fmt.Sprint(conn.NVMePortals) != fmt.Sprint(expected[:1]) ||
+		conn.NamespaceID != 3 || len(conn.TargetPortals) != 0 {
+		t.Errorf("Unexpected connection %+v", *conn)
+	}
+}
+
+// nvmeSubsystem : Creates the sysfs directory of a subsystem with native multipath and its namespaces,
+// keyed by name with their NGUID
+func nvmeSubsystem(dir string, subsystem string, nqn string, namespaces map[string]string) {
+	subsystemDir := filepath.Join(dir, "class", "nvme-subsystem", subsystem)
+	os.MkdirAll(filepath.Join(subsystemDir, "nvme0"), 0755)
+	ioutil.WriteFile(filepath.Join(subsystemDir, "subsysnqn"), []byte(nqn+"\n"), 0644)
+	for name, nguid := range namespaces {
+		os.MkdirAll(filepath.Join(subsystemDir, name), 0755)
+		ioutil.WriteFile(filepath.Join(subsystemDir, name, "nguid"), []byte(nguid+"\n"), 0644)
+		// The hidden path of the namespace through the controller
+		os.MkdirAll(filepath.Join(subsystemDir, "nvme0", "nvme0c0"+name[strings.LastIndex(name, "n"):]), 0755)
+	}
+}
+
+func TestNVMeConnectorConnectVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvme")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	nvmeSubsystem(dir, "nvme-subsys0", "nqn.1986-03.com.ibm:nvme:2145.b", map[string]string{"nvme0n1": "60050768-1081-0261-f800-000000000a5b"})
+	nvmeSubsystem(dir, "nvme-subsys1", "nqn.1986-03.com.ibm:nvme:2145.a", map[string]string{
+		"nvme1n1": "60050768-1081-0261-f800-000000000a5a", "nvme1n2": "60050768-1081-0261-f800-000000000a5b"})
+
+	// The namespace is found by its NGUID, whatever the case and dashes
+	exec := &recordingExec{}
+	connector := &NVMeConnector{exec: exec, sysDir: dir}
+	conn := &resources.VolumeConnection{DriverVolumeType: resources.DriverVolumeTypeNVMeoF, TargetLUN: -1,
+		TargetNQN:   "nqn.1986-03.com.ibm:nvme:2145.a",
+		NVMePortals: []resources.NVMePortal{{Address: "10.0.0.1", Port: "4420", Transport: "tcp"}, {Address: "10.0.0.2", Port: "4420", Transport: "tcp"}},
+		VolumeNGUID: "6005076810810261F800000000000A5B"}
+	devicePath, err := connector.ConnectVolume(conn)
+	if err != nil || devicePath != "/dev/nvme1n2" {
+		t.Fatalf("Expected device /dev/nvme1n2, but got %s and %v", devicePath, err)
+	}
+	expected := [][]string{
+		{resources.CMDNVMe, "connect", "-t", "tcp", "-a", "10.0.0.1", "-s", "4420", "-n", "nqn.1986-03.com.ibm:nvme:2145.a"},
+		{resources.CMDNVMe, "connect", "-t", "tcp", "-a", "10.0.0.2", "-s", "4420", "-n", "nqn.1986-03.com.ibm:nvme:2145.a"},
+	}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %v, but got %v", expected, exec.cmds)
+	}
+	connector.exec = &recordingExec{failCmds: map[string]string{resources.CMDNVMe: "Failed to write to /dev/nvme-fabrics: Operation already in progress"}}
+	if devicePath, err := connector.ConnectVolume(conn); err != nil || devicePath != "/dev/nvme1n2" {
+		t.Errorf("Expected device /dev/nvme1n2 when connected already, but got %s and %v", devicePath, err)
+	}
+
+	// Nothing to connect to
+	if _, err := connector.ConnectVolume(&resources.VolumeConnection{TargetNQN: conn.TargetNQN, VolumeNGUID: conn.VolumeNGUID}); err == nil {
+		t.Errorf("Expected connection without portal to fail")
+	}
+	connector.exec = &recordingExec{failCmds: map[string]string{resources.CMDNVMe: "Failed to write to /dev/nvme-fabrics: Connection refused"}}
+	if _, err := connector.ConnectVolume(conn); err == nil {
+		t.Errorf("Expected connection to fail when no portal can connect")
+	}
+}
+
+func TestNVMeConnectorDisconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvme")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	nvmeSubsystem(dir, "nvme-subsys0", "nqn.1986-03.com.ibm:nvme:2145.b", map[string]string{"nvme0n1": "60050768-1081-0261-f800-000000000a5b"})
+	nvmeSubsystem(dir, "nvme-subsys1", "nqn.1986-03.com.ibm:nvme:2145.a", map[string]string{
+		"nvme1n1": "60050768-1081-0261-f800-000000000a5a", "nvme1n2": "60050768-1081-0261-f800-000000000a5b"})
+
+	exec := &recordingExec{}
+	connector := &NVMeConnector{exec: exec, sysDir: dir}
+	// SCSI devices have nothing to disconnect
+	if disconnect := connector.PrepareDisconnect([]string{"/dev/sdb"}); disconnect != nil {
+		t.Errorf("Expected nothing to disconnect for a SCSI device")
+	}
+	// nvme1n1 is still on the node, so only the subsystem of nvme0n1 is disconnected
+	disconnect := connector.PrepareDisconnect([]string{"/dev/nvme0n1", "/dev/nvme1n2"})
+	if disconnect == nil {
+		t.Fatalf("Expected the NVMe subsystems of the devices to be disconnected")
+	}
+	if err := disconnect(); err != nil {
+		t.Fatalf("Expected disconnect to succeed, but got %s", err)
+	}
+	expected := [][]string{{resources.CMDNVMe, "disconnect", "-n", "nqn.1986-03.com.ibm:nvme:2145.b"}}
+	if fmt.Sprint(exec.cmds) != fmt.Sprint(expected) {
+		t.Errorf("Expected commands %v, but got %v", expected, exec.cmds)
+	}
+}
+
+func TestBlockDeviceOfNumber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysdev")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "devices", "pci", "host0", "block", "sdb"), 0755)
+	os.MkdirAll(filepath.Join(dir, "devices", "virtual", "block", "dm-3", "dm"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "devices", "virtual", "block", "dm-3", "dm", "name"), []byte("mpatha\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "dev", "block"), 0755)
+	os.Symlink(filepath.Join(dir, "devices", "pci", "host0", "block", "sdb"), filepath.Join(dir, "dev", "block", "8:16"))
+	os.Symlink(filepath.Join(dir, "devices", "virtual", "block", "dm-3"), filepath.Join(dir, "dev", "block", "253:3"))
+
+	for number, expected := range map[[2]uint64]string{{8, 16}: "/dev/sdb", {253, 3}: "/dev/mapper/mpatha"} {
+		if device, err := blockDeviceOfNumber(dir, number[0], number[1]); err != nil || device != expected {
+			t.Errorf("Expected device %s for %d:%d, but got %s and %v", expected, number[0], number[1], device, err)
+		}
+	}
+	if _, err := blockDeviceOfNumber(dir, 8, 32); err == nil {
+		t.Errorf("Expected no device for 8:32")
+	}
+	if _, err := BlockDeviceOfPath(dir); err == nil {
+		t.Errorf("Expected a directory not to be a block device")
+	}
+}
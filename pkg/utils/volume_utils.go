@@ -19,11 +19,24 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/nightlyone/lockfile"
 )
 
+// The scsi scan lock file is owned by our PID, so a long running driver serving requests
+// concurrently also needs to serialize the scans between its own goroutines
+var scsiScanMutex sync.Mutex
+
+// Runs the multipath, udev and file system commands on the node, which the tests replace
+var nodeExec = NewExec()
+
 // GetVolumeDirectoryName : Given VM IP and volume ID, this function determines the directory name
 // on the VM where the volume will show up after SCSI rescan.
 func GetVolumeDirectoryName(cloud OpenstackCloudI, nodeAddr string, volumeID string, volume *resources.OSVolume) (string, error) {
@@ -49,86 +62,27 @@ func GetVolumeDirectoryName(cloud OpenstackCloudI, nodeAddr string, volumeID str
 		vmHostName := vm.HypervisorHostname
 		if host, ok := hostMap[vmHostName]; ok {
 			hypType := host.HypervisorType
-			if hypType == resources.HypTypeLibvirt || hypType == resources.HypTypeKVM || hypType == resources.HypTypePvmKVM {
-				log.Debug("Looking for directory name for KVM")
-				directoryName = getDirectoryNameKVM(volume)
-			} else if hypType == resources.HypTypePhyp || hypType == resources.HypTypePvm {
-				// Get volume's storage host
-				volHost := volume.BackendHost
-				regData, err := cloud.GetStorageHostRegistration(volHost)
+			// Only look up the storage host of the volume if the hypervisor has a resolver for it
+			var storageHostType string
+			if HasStorageDeviceResolvers(hypType) {
+				regData, err := cloud.GetStorageHostRegistration(volume.BackendHost)
 				if err != nil {
 					return "", err
 				}
 				if regData != nil {
-					if regData.HostType == resources.StorageHostTypeGPFS {
-						// PowerVM LIO
-						log.Debug("Looking for directory name for PowerVM LIO")
-						directoryName = getDirectoryNamePvmLIO(volume)
-					} else if regData.HostType == resources.StorageHostTypeXIV {
-						// Handle XIV
-						log.Debug("Looking for directory name for PowerVM VIOS for XIV storage")
-						directoryName = getDirectoryNamePvmXiv(volume)
-					} else {
-						// PowerVM VIOS
-						log.Debug("Looking for directory name for PowerVM VIOS")
-						directoryName = getDirectoryNameForPhyp(volume)
-					}
-				} else {
-					// Default to PowerVM VIOS
-					log.Debug("No registration data. Looking for directory name for PowerVM VIOS")
-					directoryName = getDirectoryNameForPhyp(volume)
+					storageHostType = regData.HostType
 				}
 			}
+			if resolver := FindDeviceResolver(hypType, storageHostType); resolver != nil {
+				log.Debugf("Looking for directory name for hypervisor type %s and storage host type %s", hypType, storageHostType)
+				directoryName = resolver.DevicePath(volume)
+				log.Debugf("Expected path of volume is %s", directoryName)
+			}
 		}
 	}
 	return directoryName, nil
 }
 
-// GetDirectoryNameForPhyp : For SVC backed volume, this method returns
-// the directory path where the volume will show up as a directory on the VM
-func getDirectoryNameForPhyp(vol *resources.OSVolume) string {
-	wwn := vol.Metadata["volume_wwn"]
-	volPath := getDirectoryNameForPhypByWWN(wwn)
-	return volPath
-}
-
-// GetDirectoryNameForPhypByWWN : Given Volume's WWN, this method returns
-// the directory path where the volume will show up as a directory on the VM
-func getDirectoryNameForPhypByWWN(wwn string) string {
-	volPath := string(resources.PathPVMVIOS)
-	if wwn != "" {
-		volPath += strings.ToLower(wwn)
-	}
-	Log.Debugf("Expected path of volume is %s", volPath)
-	return volPath
-}
-
-func getDirectoryNamePvmLIO(vol *resources.OSVolume) string {
-	volPath := string(resources.AttachedVolumeDir)
-	volumeID := vol.ID
-	volPath += fmt.Sprintf(resources.DirNamePrefixPVMLIO+"%s", strings.Replace(volumeID, "-", "", -1)[:25])
-	Log.Debugf("Expected path of volume is %s", volPath)
-	return volPath
-}
-
-func getDirectoryNamePvmXiv(vol *resources.OSVolume) string {
-	volPath := string(resources.AttachedVolumeDir)
-	wwn := vol.Metadata["volume_wwn"]
-	if wwn != "" {
-		volPath += resources.DirNamePrefixPVMXIV + strings.ToLower(wwn)
-	}
-	Log.Debugf("Expected path of volume is %s", volPath)
-	return volPath
-}
-
-func getDirectoryNameKVM(vol *resources.OSVolume) string {
-	volPath := string(resources.AttachedVolumeDir)
-	volumeID := vol.ID
-	volPath += fmt.Sprintf(resources.DirNamePrefixKVM+"%s", volumeID[:20])
-	Log.Debugf("Expected path of volume is %s", volPath)
-	return volPath
-}
-
 // FindAttachedVolumeDirectoryPath : Returns directory path of attached volume
 // For multipath device, return device mapper parent
 func FindAttachedVolumeDirectoryPath(dirName string) string {
@@ -160,65 +114,6 @@ func FindAttachedVolumeDirectoryPath(dirName string) string {
 	return devicePath
 }
 
-// HasFSOnVolumeDevice : Determines the File System installed
-// on attached volume
-func HasFSOnVolumeDevice(volPath string) (bool, error) {
-	cmdStrs := []string{resources.CMDLsBlk, volPath}
-	cmdStrs = append(cmdStrs, "--noheadings", "-o", "FSTYPE", "-f")
-	cmdOutput, cmdError, err := RunCommand(resources.CMDSudo, cmdStrs)
-	if err != nil {
-		log.Errorf("Error running %s", cmdStrs)
-		log.Error(cmdError)
-		return false, err
-	}
-	cmdOutput = strings.TrimSpace(cmdOutput)
-	// Check that the output has existence of a linux fliesystem
-	if cmdOutput != "" {
-		cmdOutput = strings.ToLower(cmdOutput)
-		for _, fsType := range resources.FSTYPES {
-			if strings.Contains(cmdOutput, strings.ToLower(fsType)) {
-				log.Debugf("Attached Volume has FS %s", cmdOutput)
-				return true, nil
-			}
-		}
-	}
-	// If we have not returned yet, it means that attached volume does not
-	// have a file system.
-	log.Debugf("Attached Volume does not has a file system %s", cmdOutput)
-	return false, nil
-}
-
-// GetDeviceOfMount Function to get the block device or multipath device of mounted directory
-func GetDeviceOfMount(volMountDir string) (string, error) {
-	// Run mount | grep -w mountDirectory
-	// cmdStrs := []string{fmt.Sprintf("%s | %s -w %s", resources.CMDMount, resources.CMDGrep, volMountDir)}
-	// res, _, err := RunCommand(resources.CMDSudo, cmdStrs)
-	res, err := RunPipedCommands(
-		resources.CMDSudo, []string{resources.CMDMount},
-		resources.CMDGrep, []string{"-w", volMountDir})
-	if err != "" {
-		return "", fmt.Errorf(err)
-	}
-	Log.Debugf("Mount check: %s", res)
-	// The result is something of this format
-	// /dev/mapper/mpathi on mountDirectory type ext4 (rw,relatime,seclabel,data=ordered)
-	// Validate that we have only one line and six tokens as part of it.
-	lines := strings.Split(string(res[:]), "\n")
-	if len(lines) != 2 {
-		Log.Errorf("Multiple mount points found %s", lines)
-		return "", fmt.Errorf("Directory is not a mount point")
-	}
-	fields := strings.Fields(lines[0])
-	if len(fields) != 6 {
-		Log.Errorf("Error tokening mount output %s", fields)
-		return "", fmt.Errorf("Error formatting mount output %d %s", len(fields), fields)
-	}
-	// The device is the first token
-	device := fields[0]
-	Log.Debugf("Device mounted on the %s directory is %s", volMountDir, device)
-	return device, nil
-}
-
 // GetAssociatedBlockDevices : Function to get associated block device
 // for a multipath device.
 // Returns device mapper parent and associated block devices names
@@ -231,8 +126,7 @@ func GetAssociatedBlockDevices(devicePath string) (string, []string, error) {
 	// Check if the device is a multipath device
 	if strings.Contains(devicePath, "/dev/mapper/mpath") {
 		// Run multipath -l devicePath
-		cmdStrs := []string{resources.CMDMultipath, "-l", devicePath}
-		res, _, err := RunCommand(resources.CMDSudo, cmdStrs)
+		res, _, err := nodeExec.Run(resources.CMDMultipath, "-l", devicePath)
 		if err != nil {
 			Log.Errorf("Error running multipath command %s", err)
 			return "", nil, err
@@ -289,8 +183,7 @@ func RemoveMultipathForDevice(devicePath string) error {
 	if strings.Contains(devicePath, "/dev/mapper") {
 		multipathName = strings.Split(devicePath, "/")[2]
 	}
-	cmdStrs := []string{resources.CMDMultipath, "-f", multipathName}
-	_, _, err := RunCommand(resources.CMDSudo, cmdStrs)
+	_, _, err := nodeExec.Run(resources.CMDMultipath, "-f", multipathName)
 	if err != nil {
 		Log.Errorf("Error clearing multipath:  %s", err)
 		return err
@@ -326,26 +219,391 @@ func ScsiHostScan() {
 	}
 }
 
+// ScsiTargetScan : Scans only the LUN of the volume on the fibre channel targets of its connection, returning
+// false if there was nothing to scan, like for a connection without LUN or targets the node isn't logged in to
+func ScsiTargetScan(conn *resources.VolumeConnection) bool {
+	return scsiTargetScan("/sys/class", conn) > 0
+}
+
+// scsiTargetScan : Finds the host, channel and target of the remote ports of the target WWNs, which are listed
+// as fc_remote_ports/rport-<host>:<channel>-<n>, and writes "<channel> <target> <lun>" to the scan file of the host
+func scsiTargetScan(sysClassDir string, conn *resources.VolumeConnection) int {
+	if conn == nil || conn.TargetLUN < 0 || len(conn.TargetWWNs) == 0 {
+		return 0
+	}
+	wwns := make(map[string]bool)
+	for _, wwn := range conn.TargetWWNs {
+		wwns[strings.TrimPrefix(strings.ToLower(wwn), "0x")] = true
+	}
+	rportsDir := filepath.Join(sysClassDir, "fc_remote_ports")
+	rports, err := ioutil.ReadDir(rportsDir)
+	if err != nil {
+		return 0
+	}
+	scanned := 0
+	for _, rport := range rports {
+		rportDir := filepath.Join(rportsDir, rport.Name())
+		portName, err := ioutil.ReadFile(filepath.Join(rportDir, "port_name"))
+		if err != nil || !wwns[strings.TrimPrefix(strings.TrimSpace(string(portName)), "0x")] {
+			continue
+		}
+		targetID, err := ioutil.ReadFile(filepath.Join(rportDir, "scsi_target_id"))
+		// The target ID is -1 while the port isn't a SCSI target
+		if err != nil || strings.HasPrefix(strings.TrimSpace(string(targetID)), "-") {
+			continue
+		}
+		var host, channel, number int
+		if _, err := fmt.Sscanf(rport.Name(), "rport-%d:%d-%d", &host, &channel, &number); err != nil {
+			continue
+		}
+		scanFile := filepath.Join(sysClassDir, "scsi_host", fmt.Sprintf("host%d", host), "scan")
+		data := fmt.Sprintf("%d %s %d", channel, strings.TrimSpace(string(targetID)), conn.TargetLUN)
+		if err := ioutil.WriteFile(scanFile, []byte(data), 0666); err != nil {
+			log.Warningf("Could not rescan file %s", scanFile)
+			continue
+		}
+		log.Debugf("Scsi scan of %s done for file %s", data, scanFile)
+		scanned++
+	}
+	return scanned
+}
+
+// AddVolumeConnection : Adds the targets of the connection to the publish context the controller passes to the
+// node. The properties of connections the node has to connect to, like iSCSI, aren't added as they may hold
+// credentials, so only their type is and the node gets the connection itself.
+func AddVolumeConnection(publishContext map[string]string, conn *resources.VolumeConnection) {
+	if conn == nil {
+		return
+	}
+	if GetConnector(conn.DriverVolumeType) != nil {
+		publishContext[resources.DriverVolumeType] = conn.DriverVolumeType
+		return
+	}
+	if conn.TargetLUN < 0 || len(conn.TargetWWNs) == 0 {
+		return
+	}
+	publishContext[resources.TargetWWNs] = strings.Join(conn.TargetWWNs, ",")
+	publishContext[resources.TargetLUN] = strconv.Itoa(conn.TargetLUN)
+}
+
+// VolumeConnectionFromContext : Returns the connection in the publish context, or nil if it has none
+func VolumeConnectionFromContext(publishContext map[string]string) *resources.VolumeConnection {
+	if driverVolumeType := publishContext[resources.DriverVolumeType]; driverVolumeType != "" {
+		return &resources.VolumeConnection{DriverVolumeType: driverVolumeType, TargetLUN: -1}
+	}
+	lun, err := strconv.Atoi(publishContext[resources.TargetLUN])
+	if err != nil || publishContext[resources.TargetWWNs] == "" {
+		return nil
+	}
+	return &resources.VolumeConnection{TargetWWNs: strings.Split(publishContext[resources.TargetWWNs], ","), TargetLUN: lun}
+}
+
 // UdevdHandleEvents : Indicate udevd to handle device creation and deletion events
 func UdevdHandleEvents(volPath string) error {
-	cmdStrs := []string{resources.CMDUdevAdm, resources.CMDUdevAdmParamSettle}
-	_, _, err := RunCommand(resources.CMDSudo, cmdStrs)
+	args := []string{resources.CMDUdevAdmParamSettle}
+	_, _, err := nodeExec.Run(resources.CMDUdevAdm, args...)
 	if err != nil {
-		log.Errorf("Error running %s", cmdStrs)
+		log.Errorf("Error running %s %s", resources.CMDUdevAdm, args)
 		return err
 	}
 	log.Debug("Ran command udevadm settle")
-	cmdStrs = []string{resources.CMDUdevAdm, resources.CMDUdevAdmParamTrigger}
+	args = []string{resources.CMDUdevAdmParamTrigger}
 	// If the directory of attached volume exists, we should run trigger only for that path
 	if _, err = os.Stat(volPath); !os.IsNotExist(err) {
 		log.Debugf("Found directory for attached volume %s", volPath)
-		cmdStrs = []string{resources.CMDUdevAdm, resources.CMDUdevAdmParamTrigger, volPath}
+		args = append(args, volPath)
 	}
-	_, _, err = RunCommand(resources.CMDSudo, cmdStrs)
+	_, _, err = nodeExec.Run(resources.CMDUdevAdm, args...)
 	if err != nil {
-		log.Errorf("Error running %s", cmdStrs)
+		log.Errorf("Error running %s %s", resources.CMDUdevAdm, args)
 		return err
 	}
 	log.Debugf("Ran command udevadm trigger")
 	return nil
 }
+
+// lockScsiScan : Takes the lock that serializes the scans, and the connections to the storage targets, of the
+// processes and goroutines on the node, returning the function that releases it
+func lockScsiScan() (func(), error) {
+	var pID = os.Getpid()
+	scsiScanMutex.Lock()
+	lock, err := lockfile.New(filepath.Join(os.TempDir(), resources.ScsiScanLock))
+	if err != nil {
+		scsiScanMutex.Unlock()
+		log.Debugf("%d : Cannot init lock. Reason : %v", pID, err)
+		return nil, fmt.Errorf("Could not initialize lock file %s", err)
+	}
+	// Try to get the lock
+	for i := 0; i < resources.MaxAttemptsToTryLock; i++ {
+		err = lock.TryLock()
+		if err == nil {
+			break
+		}
+		log.Debugf("%d : Could not get lock, error is %v . Sleeping for 5 secs..", pID, err)
+		time.Sleep(5 * time.Second)
+	}
+	log.Debugf("%d : Got hold of Scsiscan lock", pID)
+	return func() {
+		lock.Unlock()
+		scsiScanMutex.Unlock()
+	}, nil
+}
+
+// WaitForAttachedDevice : Rescans the SCSI bus until the attached volume shows up at the given
+// directory path, returning the block device (or multipath parent) of the volume. Only the LUN of
+// the connection is scanned if it is given, with a scan of every host once in a while in case the
+// connection info doesn't tell where the volume is. The device found must report the identifiers
+// of the volume.
+func WaitForAttachedDevice(volPath string, volume *resources.OSVolume, conn *resources.VolumeConnection) (string, error) {
+	var pID = os.Getpid()
+	unlock, err := lockScsiScan()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// The volumes of some connection types only show up once the node connects to their targets
+	if conn != nil {
+		if connector := GetConnector(conn.DriverVolumeType); connector != nil {
+			log.Debugf("%d : Connecting to the %s targets of the volume", pID, conn.DriverVolumeType)
+			devicePath, err := connector.ConnectVolume(conn)
+			if err != nil {
+				return "", err
+			}
+			// The connector finds the device on its own, which must still be the one of the volume
+			if err := VerifyDeviceIdentity(volume, conn, devicePath); err != nil {
+				log.Errorf("%d : %s", pID, err)
+				return "", err
+			}
+			return devicePath, nil
+		}
+	}
+
+	// Loop for max of 120 seconds to find the attached volume
+	var identityErr error
+	for i := 0; i < resources.MaxAttemptsToFindVolume; i++ {
+		// Run scsi scan to discover the volume directory on VM
+		if conn == nil || i%4 == 3 || !ScsiTargetScan(conn) {
+			ScsiHostScan()
+		}
+		// Sleep for a second before running udevadm
+		time.Sleep(1 * time.Second)
+		// Let udevd handle device events
+		err := UdevdHandleEvents(volPath)
+		if err != nil {
+			log.Warningf("%d : There was error while at udevd. Error is %s", pID, err)
+		}
+		// Sleep for 2 seconds for letting udevadm handle the events
+		time.Sleep(4 * time.Second)
+		// Check if directory is available now after scan
+		if fileInfo, err := os.Lstat(volPath); err == nil {
+			// Find the symbolic link to the file
+			if fileInfo.Mode() != 0&os.ModeSymlink {
+				volDevicePath := FindAttachedVolumeDirectoryPath(volPath)
+				// If the file was link and we failed to read the link, return failed status
+				if volDevicePath == "" {
+					log.Errorf("%d : Error finding link %s", pID, volPath)
+					return "", fmt.Errorf("Could not find symbolic link of attached volume %s", volPath)
+				}
+				// A stale link may still point to the device of another LUN, until udev catches up
+				if identityErr = VerifyDeviceIdentity(volume, conn, volDevicePath); identityErr != nil {
+					log.Warningf("%d : %s", pID, identityErr)
+					continue
+				}
+				log.Debugf("%d : Found directory of attached volume %s", pID, volDevicePath)
+				return volDevicePath, nil
+			}
+			break
+		}
+	}
+	if identityErr != nil {
+		return "", identityErr
+	}
+	return "", fmt.Errorf("Could not find directory %s of attached volume", volPath)
+}
+
+// WaitForDetachedDevice : Waits until the device of the volume at the given directory path, and the
+// multipath map of the device if it has one, are gone from the node before the deadline
+func WaitForDetachedDevice(volPath string, deadline time.Time) error {
+	// The link to the multipath map is gone with the last path, so the map is looked up first
+	var dmParent string
+	if devicePath := FindAttachedVolumeDirectoryPath(volPath); strings.HasPrefix(devicePath, "/dev/dm-") {
+		dmParent = devicePath
+	}
+	for i := 0; i == 0 || time.Now().Before(deadline); i++ {
+		if i > 0 {
+			time.Sleep(5 * time.Second)
+		}
+		if _, err := os.Lstat(volPath); err == nil {
+			log.Debugf("Device %s of detached volume is still on the node", volPath)
+			continue
+		}
+		if dmParent != "" {
+			if _, err := os.Stat(filepath.Join("/sys/block", filepath.Base(dmParent))); err == nil {
+				log.Debugf("Multipath device %s of detached volume is still on the node", dmParent)
+				continue
+			}
+		}
+		log.Debugf("Device %s of detached volume is gone from the node", volPath)
+		return nil
+	}
+	if dmParent != "" {
+		return fmt.Errorf("Timed out waiting for device %s and multipath device %s to be removed", volPath, dmParent)
+	}
+	return fmt.Errorf("Timed out waiting for device %s to be removed", volPath)
+}
+
+// UnmountDevice : Unmounts the device mounted at the mount path and then removes the
+// block devices and multipath entry of the device from the node
+func UnmountDevice(mounter Mounter, mountPath string) error {
+	// First, find out all the block devices and multipath devices
+	// which are associated with this mount directory
+	var dmParent string
+	var devices []string
+	devicePath, _ := mounter.GetDeviceFromMount(mountPath)
+	if devicePath != "" {
+		dmParent, devices, _ = GetAssociatedBlockDevices(devicePath)
+	}
+	refs, _ := mounter.GetMountRefs(mountPath)
+	// Now unmount the directory from the device
+	if err := mounter.Unmount(mountPath); err != nil {
+		return err
+	}
+	// The devices can't be removed while the file system is still mounted somewhere else
+	if len(refs) > 0 {
+		log.Warningf("Device %s is still mounted at %s, leaving its devices on the node", devicePath, refs)
+		return nil
+	}
+	// The targets the devices are connected through can't be found anymore once the devices are removed
+	var disconnects []func() error
+	for _, connector := range Connectors() {
+		if disconnect := connector.PrepareDisconnect(devices); disconnect != nil {
+			disconnects = append(disconnects, disconnect)
+		}
+	}
+	// Now that directory is unmounted, remove the block device which was associated with the mountPath
+	if devices != nil && len(devices) >= 1 {
+		for _, device := range devices {
+			// NVMe namespaces go away when their subsystem is disconnected
+			if nvmeNamespacePattern.MatchString(filepath.Base(device)) {
+				continue
+			}
+			DeleteScsiDevice(device)
+		}
+	}
+	// Clear out the multipath entry too as part of device cleanup
+	if dmParent != "" {
+		RemoveMultipathForDevice(devicePath)
+	}
+	if len(disconnects) > 0 {
+		// Keep a volume from connecting to a target while we disconnect from it
+		unlock, err := lockScsiScan()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		for _, disconnect := range disconnects {
+			if err := disconnect(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ResizeFileSystem : Rescans the devices of the volume mounted at the mount path so the node sees
+// the extended size of the volume, and then grows the file system to fill it
+func ResizeFileSystem(mounter Mounter, mountPath string) error {
+	devicePath, err := mounter.GetDeviceFromMount(mountPath)
+	if err != nil {
+		return fmt.Errorf("Could not find device mounted at %s. Error is %s", mountPath, err)
+	}
+	if err := ResizeDevice(devicePath); err != nil {
+		return err
+	}
+
+	fsType, _, err := nodeExec.Run(resources.CMDLsBlk, devicePath, "--noheadings", "-o", "FSTYPE")
+	if err != nil {
+		return fmt.Errorf("Could not determine file system of %s. Error is %s", devicePath, err)
+	}
+	fsType = strings.ToLower(strings.TrimSpace(fsType))
+	var cmd, arg string
+	switch {
+	case strings.HasPrefix(fsType, "ext"):
+		cmd, arg = resources.CMDResize2FS, devicePath
+	case fsType == "xfs":
+		// xfs can only be grown through its mount point
+		cmd, arg = resources.CMDXFSGrowFS, mountPath
+	default:
+		return fmt.Errorf("Resizing file system %s on %s is not supported", fsType, devicePath)
+	}
+	_, cmdErr, err := nodeExec.Run(cmd, arg)
+	if err != nil {
+		log.Errorf("Could not resize file system on %s. Error is %s %s", devicePath, err, cmdErr)
+		return fmt.Errorf("Could not resize file system on %s. Error is %s", devicePath, err)
+	}
+	log.Debugf("Resized %s file system on %s", fsType, devicePath)
+	return nil
+}
+
+// ResizeDevice : Rescans the SCSI devices of the device so the node sees the extended size of the volume,
+// and resizes the multipath map if the device is one
+func ResizeDevice(devicePath string) error {
+	dmParent, devices, err := GetAssociatedBlockDevices(devicePath)
+	if err != nil {
+		return fmt.Errorf("Could not find block devices of %s. Error is %s", devicePath, err)
+	}
+	for _, device := range devices {
+		RescanScsiDevice(device)
+	}
+	// The multipath device keeps its old size until multipathd picks up the new size of its paths
+	if dmParent != "" {
+		mapName := filepath.Base(devicePath)
+		_, _, err := nodeExec.Run(resources.CMDMultipathd, "resize", "map", mapName)
+		if err != nil {
+			log.Errorf("Could not resize multipath map %s. Error is %s", mapName, err)
+			return fmt.Errorf("Could not resize multipath map %s. Error is %s", mapName, err)
+		}
+	}
+	return nil
+}
+
+// BlockDeviceOfPath : Returns the device of the device file at the path, like the file a raw block volume
+// is bind mounted onto, with the /dev/mapper name of a multipath device
+func BlockDeviceOfPath(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", path)
+	}
+	rdev := uint64(stat.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return blockDeviceOfNumber("/sys", major, minor)
+}
+
+// blockDeviceOfNumber : Returns the device with the major and minor numbers, from its link in sysfs
+func blockDeviceOfNumber(sysDir string, major uint64, minor uint64) (string, error) {
+	deviceDir := filepath.Join(sysDir, "dev", "block", fmt.Sprintf("%d:%d", major, minor))
+	// Multipath devices are known by their map name, like /dev/mapper/mpatha
+	if name := readSysAttr(filepath.Join(deviceDir, "dm"), "name"); name != "" {
+		return "/dev/mapper/" + name, nil
+	}
+	target, err := os.Readlink(deviceDir)
+	if err != nil {
+		return "", fmt.Errorf("Could not find block device %d:%d. Error is %s", major, minor, err)
+	}
+	return "/dev/" + filepath.Base(target), nil
+}
+
+// RescanScsiDevice : Makes the SCSI sub-system pick up the new size of the block device
+func RescanScsiDevice(devicePath string) {
+	fileName := "/sys/block/" + filepath.Base(devicePath) + "/device/rescan"
+	err := ioutil.WriteFile(fileName, []byte("1"), 0666)
+	if err != nil {
+		log.Warningf("Could not rescan device %s", fileName)
+	}
+	Log.Debugf("Rescanned device: %s", fileName)
+}
@@ -0,0 +1,216 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package util
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+)
+
+// Code sets of the designation descriptors of VPD page 0x83
+const (
+	vpdCodeSetBinary = 1
+	vpdCodeSetASCII  = 2
+	vpdCodeSetUTF8   = 3
+)
+
+// Shortest identifier we compare, so that an empty or truncated expectation doesn't match any device
+const minIdentifierLength = 8
+
+// Hex digits of the volume ID looked for in the identifiers, the serial number QEMU gives the disk holds 17 of them
+const volumeIDIdentifierLength = 16
+
+// The sysfs directory of the block devices, which the tests replace
+var sysBlockDir = "/sys/block"
+
+// ParseVPDPage83 : Returns the designators of a Device Identification VPD page, binary ones as lowercase hex.
+// The page is a 4 byte header followed by descriptors, each of which is a 4 byte header and the designator.
+func ParseVPDPage83(data []byte) ([]string, error) {
+	if len(data) < 4 || data[1] != 0x83 {
+		return nil, fmt.Errorf("Not a device identification VPD page")
+	}
+	end := 4 + int(data[2])<<8 + int(data[3])
+	if end > len(data) {
+		end = len(data)
+	}
+	var designators []string
+	for i := 4; i+4 <= end; {
+		codeSet := data[i] & 0x0f
+		length := int(data[i+3])
+		if i+4+length > end {
+			return nil, fmt.Errorf("Truncated designation descriptor in device identification VPD page")
+		}
+		value := data[i+4 : i+4+length]
+		switch codeSet {
+		case vpdCodeSetBinary:
+			designators = append(designators, hex.EncodeToString(value))
+		case vpdCodeSetASCII, vpdCodeSetUTF8:
+			designators = append(designators, strings.TrimSpace(strings.TrimRight(string(value), "\x00")))
+		}
+		i += 4 + length
+	}
+	return designators, nil
+}
+
+// ParseVPDPage80 : Returns the serial number of a Unit Serial Number VPD page
+func ParseVPDPage80(data []byte) (string, error) {
+	if len(data) < 4 || data[1] != 0x80 {
+		return "", fmt.Errorf("Not a unit serial number VPD page")
+	}
+	end := 4 + int(data[2])<<8 + int(data[3])
+	if end > len(data) {
+		end = len(data)
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data[4:end]), "\x00")), nil
+}
+
+// ExpectedDeviceIdentifiers : Returns the identifiers one of which the device of the volume must report: the WWN
+// of the volume, the start of its ID, which is what QEMU and LIO put in the identifiers of their disks, and the
+// NGUID and UUID of its NVMe namespace. They are lowercase without dashes, as matchesIdentifier compares them.
+func ExpectedDeviceIdentifiers(volume *resources.OSVolume, conn *resources.VolumeConnection) []string {
+	var candidates []string
+	if volume != nil {
+		candidates = append(candidates, strings.TrimPrefix(normalizeIdentifier(volume.Metadata["volume_wwn"]), "0x"))
+		volumeID := normalizeIdentifier(volume.ID)
+		if len(volumeID) > volumeIDIdentifierLength {
+			volumeID = volumeID[:volumeIDIdentifierLength]
+		}
+		candidates = append(candidates, volumeID)
+	}
+	if conn != nil {
+		candidates = append(candidates, normalizeIdentifier(conn.VolumeNGUID), normalizeIdentifier(conn.VolumeUUID))
+	}
+	var identifiers []string
+	for _, candidate := range candidates {
+		if len(candidate) >= minIdentifierLength {
+			identifiers = append(identifiers, candidate)
+		}
+	}
+	return identifiers
+}
+
+// VerifyDeviceIdentity : Checks that the device found for the volume reports one of its identifiers in its SCSI VPD
+// pages or NVMe namespace identifiers, so that a stale link can't make us mount another LUN. For a multipath device
+// all its paths are checked. The check can be turned off for devices which don't report them.
+func VerifyDeviceIdentity(volume *resources.OSVolume, conn *resources.VolumeConnection, devicePath string) error {
+	if skip, _ := strconv.ParseBool(os.Getenv(resources.SkipDeviceIdentityCheck)); skip {
+		log.Debugf("Not verifying the identity of device %s, %s is set", devicePath, resources.SkipDeviceIdentityCheck)
+		return nil
+	}
+	return verifyDeviceIdentity(sysBlockDir, ExpectedDeviceIdentifiers(volume, conn), devicePath)
+}
+
+func verifyDeviceIdentity(sysBlockDir string, expected []string, devicePath string) error {
+	if len(expected) == 0 {
+		return fmt.Errorf("Could not verify the identity of device %s, the volume has no identifier to compare", devicePath)
+	}
+	deviceName := filepath.Base(devicePath)
+	devices := []string{deviceName}
+	if strings.HasPrefix(deviceName, "dm-") {
+		slaves, err := ioutil.ReadDir(filepath.Join(sysBlockDir, deviceName, "slaves"))
+		if err != nil || len(slaves) == 0 {
+			return fmt.Errorf("Could not find the paths of multipath device %s. Error is %v", devicePath, err)
+		}
+		devices = devices[:0]
+		for _, slave := range slaves {
+			devices = append(devices, slave.Name())
+		}
+	}
+	for _, device := range devices {
+		identifiers, err := readDeviceIdentifiers(filepath.Join(sysBlockDir, device))
+		if os.IsNotExist(err) {
+			// Kernels before 3.15 don't expose the VPD pages
+			return fmt.Errorf("Could not verify the identity of device %s, it has no VPD pages. Set %s to skip the check",
+				device, resources.SkipDeviceIdentityCheck)
+		} else if err != nil {
+			return fmt.Errorf("Could not read the identifiers of device %s. Error is %s", device, err)
+		}
+		if !matchesIdentifier(identifiers, expected) {
+			log.Errorf("Device %s has identifiers %v, expected one of %v", device, identifiers, expected)
+			return fmt.Errorf("Device %s does not belong to the volume. Its identifiers are %v, expected one of %v",
+				device, identifiers, expected)
+		}
+	}
+	log.Debugf("Verified the identity of device %s", devicePath)
+	return nil
+}
+
+// readDeviceIdentifiers : Returns the identifiers of the NVMe namespace, or the designators and serial number
+// from the VPD pages of the SCSI device
+func readDeviceIdentifiers(blockDir string) ([]string, error) {
+	if strings.HasPrefix(filepath.Base(blockDir), "nvme") {
+		return readNVMeIdentifiers(blockDir)
+	}
+	deviceDir := filepath.Join(blockDir, "device")
+	data, err := ioutil.ReadFile(filepath.Join(deviceDir, "vpd_pg83"))
+	if err != nil {
+		return nil, err
+	}
+	identifiers, err := ParseVPDPage83(data)
+	if err != nil {
+		return nil, err
+	}
+	// Not every device has a serial number page
+	if data, err := ioutil.ReadFile(filepath.Join(deviceDir, "vpd_pg80")); err == nil {
+		if serial, err := ParseVPDPage80(data); err == nil && serial != "" {
+			identifiers = append(identifiers, serial)
+		}
+	}
+	return identifiers, nil
+}
+
+// readNVMeIdentifiers : Returns the identifiers the NVMe namespace has, not every controller reports all of them
+func readNVMeIdentifiers(blockDir string) ([]string, error) {
+	var identifiers []string
+	for _, name := range []string{"wwid", "nguid", "uuid"} {
+		data, err := ioutil.ReadFile(filepath.Join(blockDir, name))
+		if err != nil {
+			continue
+		}
+		if identifier := strings.TrimSpace(string(data)); identifier != "" {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	if len(identifiers) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return identifiers, nil
+}
+
+// normalizeIdentifier : Identifiers are compared lowercase and without the dashes of UUIDs
+func normalizeIdentifier(identifier string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(identifier), "-", "", -1))
+}
+
+// matchesIdentifier : The identifiers of QEMU and LIO disks hold only the start of the volume ID, after a prefix
+// for LIO, and NVMe WWIDs prefix the NGUID or UUID with their type
+func matchesIdentifier(identifiers []string, expected []string) bool {
+	for _, identifier := range identifiers {
+		identifier = normalizeIdentifier(identifier)
+		for _, candidate := range expected {
+			if strings.Contains(identifier, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"fmt"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/kubernetes-incubator/external-storage/lib/util"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The kind of data source used to clone a PVC
+const pvcKind = "PersistentVolumeClaim"
+
+// Returns the Cinder volume ID of the PVC the new PVC is requested to be cloned from, making
+// sure the source PVC can be cloned into a volume of the requested size
+func (p *openstackProvisioner) getSourceVolumeID(namespace string, dataSource *v1.TypedLocalObjectReference, sizeGB int) (string, error) {
+	if dataSource.APIGroup != nil && *dataSource.APIGroup != "" {
+		return "", fmt.Errorf("volume options data source %s is not supported", dataSource.Kind)
+	}
+	sourcePVC, err := p.Client.CoreV1().PersistentVolumeClaims(namespace).Get(dataSource.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("Could not get source PVC %s/%s. Error is %s", namespace, dataSource.Name, err)
+	}
+	if sourcePVC.Status.Phase != v1.ClaimBound || sourcePVC.Spec.VolumeName == "" {
+		return "", fmt.Errorf("Source PVC %s/%s is not bound to a volume yet", namespace, dataSource.Name)
+	}
+	sourcePV, err := p.Client.CoreV1().PersistentVolumes().Get(sourcePVC.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("Could not get source PV %s. Error is %s", sourcePVC.Spec.VolumeName, err)
+	}
+	// Volumes can only be cloned within the namespace of the claim they belong to
+	claimRef := sourcePV.Spec.ClaimRef
+	if claimRef == nil || claimRef.Namespace != namespace || claimRef.Name != sourcePVC.Name {
+		return "", fmt.Errorf("Source PV %s is not bound to PVC %s/%s", sourcePV.Name, namespace, dataSource.Name)
+	}
+	volumeID := sourcePV.Annotations[resources.OsArgsVolID]
+	if sourcePV.Annotations[resources.K8sCreatedBy] != resources.ProvisionerNameOnly || volumeID == "" {
+		return "", fmt.Errorf("Source PV %s was not provisioned by %s", sourcePV.Name, resources.ProvisionerNameOnly)
+	}
+	capacity := sourcePV.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	if sourceSizeGB := int(util.RoundUpSize(capacity.Value(), util.GiB)); sourceSizeGB > sizeGB {
+		return "", fmt.Errorf("volume options requested %dGB which is smaller than the %dGB source PVC %s/%s",
+			sizeGB, sourceSizeGB, namespace, dataSource.Name)
+	}
+	return volumeID, nil
+}
+
+// ValidateSourceVolume : Makes sure the Cinder volume can be cloned into a volume with the create options
+func ValidateSourceVolume(cinderClient *gophercloud.ServiceClient, opts VolumeCreateOpts) error {
+	source, err := volumes.Get(cinderClient, opts.SourceVolID).Extract()
+	if err != nil {
+		return fmt.Errorf("Could not get source volume %s. Error is %s", opts.SourceVolID, err)
+	}
+	if source.Size > opts.Size {
+		return fmt.Errorf("volume options requested %dGB which is smaller than the %dGB source volume %s",
+			opts.Size, source.Size, opts.SourceVolID)
+	}
+	// Cinder would quietly clone into the source's type, which isn't what the storage class asked for
+	if opts.VolumeType != "" && opts.VolumeType != source.VolumeType {
+		return fmt.Errorf("volume options type %s doesn't match the type %s of source volume %s",
+			opts.VolumeType, source.VolumeType, opts.SourceVolID)
+	}
+	return nil
+}
@@ -17,8 +17,6 @@ package volume
 import (
 	"fmt"
 
-	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
-
 	"github.com/golang/glog"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
 
@@ -38,14 +36,24 @@ func (p *openstackProvisioner) Delete(pv *v1.PersistentVolume) error {
 	}
 
 	// Creates a new OpenStack Cinder Client and authenticates
-	cinderClient, err := utils.CreateCinderClient(testParam)
+	cinderClient, err := p.newCinderClient(testParam, provisionerSecretRef(pv))
 	if err != nil {
 		glog.Errorf("Failed to construct / authenticate OpenStack : %s", err)
 		return err
 	}
 
+	// Several clusters may share the project, so make sure the volume is really ours to delete
+	volume, err := volumes.Get(cinderClient, volumeID).Extract()
+	if err != nil {
+		return fmt.Errorf("error getting volume %s : %s", volumeID, err)
+	}
+	if err := CheckOwnership(volume, p.ClusterID, pv.Name); err != nil {
+		glog.Errorf("Refusing to delete volume %s: %s", volumeID, err)
+		return err
+	}
+
 	glog.Infof("Deleting Persistent Volume: %s", volumeID)
-	err = volumes.Delete(cinderClient, volumeID).Err
+	err = volumes.Delete(cinderClient, volumeID, volumes.DeleteOpts{}).Err
 	if err != nil {
 		return fmt.Errorf("error deleting volume : %s", err)
 	}
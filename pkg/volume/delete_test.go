@@ -17,27 +17,61 @@ package volume
 import (
 	"testing"
 
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
 	"github.com/IBM/power-openstack-k8s-volume-driver/pkg/testutils"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
 
 	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestDelete(t *testing.T) {
-	testutils.SetupHTTP()
-	defer testutils.TearDownHTTP()
-
-	pv := testutils.MockPV()
+	tests := []struct {
+		name       string
+		volumeMeta map[string]string
+		expected   bool
+	}{
+		{
+			name: "volume owned by the PV",
+			volumeMeta: map[string]string{
+				resources.OsK8sClusterIDMeta: testClusterID,
+				resources.OsK8sPVNameMeta:    testutils.MockPV().Name,
+			},
+			expected: true,
+		},
+		{
+			name:     "volume created before the ownership tags",
+			expected: true,
+		},
+		{
+			name:       "volume owned by another cluster",
+			volumeMeta: map[string]string{resources.OsK8sClusterIDMeta: "other-cluster"},
+			expected:   false,
+		},
+		{
+			name: "volume owned by another PV",
+			volumeMeta: map[string]string{
+				resources.OsK8sClusterIDMeta: testClusterID,
+				resources.OsK8sPVNameMeta:    "other-pv",
+			},
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		testutils.SetupHTTP()
 
-	testutils.MuxHandleDelete(t, pv.Annotations["volumeID"])
+		pv := testutils.MockPV()
+		testutils.MuxHandleGetAndDeleteVolume(t, pv.Annotations["volumeID"], test.volumeMeta)
 
-	fakeClientset := fake.NewSimpleClientset()
-	testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName)
-	if err != nil {
-		t.Errorf("failed to create testProvisioner: %v", err)
-	}
+		fakeClientset := fake.NewSimpleClientset()
+		testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName, testClusterID, utils.NewClientCache())
+		if err != nil {
+			t.Errorf("failed to create testProvisioner: %v", err)
+		}
 
-	err = testProvisioner.Delete(pv)
-	if err != nil {
-		t.Errorf("failed to delete pv: %s", err)
+		err = testProvisioner.Delete(pv)
+		if (err == nil) != test.expected {
+			t.Errorf("%s: expected the delete to succeed: %t \n received: %v", test.name, test.expected, err)
+		}
+		testutils.TearDownHTTP()
 	}
 }
@@ -0,0 +1,79 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"fmt"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultClusterID : Returns the UID of the kube-system namespace, which is unique to the cluster
+// and lives as long as the cluster does, to identify the cluster when none is configured
+func DefaultClusterID(client kubernetes.Interface) (string, error) {
+	ns, err := client.CoreV1().Namespaces().Get(metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("Could not get namespace %s to identify the cluster. Error is %s", metav1.NamespaceSystem, err)
+	}
+	return string(ns.UID), nil
+}
+
+// OwnershipMetadata : Returns the Cinder metadata identifying the cluster, PV and PVC a volume is created for,
+// and the provisioner creating it. The names that aren't known are left out.
+func OwnershipMetadata(clusterID string, provisioner string, pvName string, pvcNamespace string, pvcName string) map[string]string {
+	volumeMeta := make(map[string]string)
+	for key, value := range map[string]string{
+		resources.OsK8sClusterIDMeta:    clusterID,
+		resources.OsK8sPVNameMeta:       pvName,
+		resources.OsK8sPVCNamespaceMeta: pvcNamespace,
+		resources.OsK8sPVCNameMeta:      pvcName,
+		resources.OsK8sProvisionerMeta:  provisioner,
+	} {
+		if value != "" {
+			volumeMeta[key] = value
+		}
+	}
+	return volumeMeta
+}
+
+// provisionOwnershipMetadata : Returns the Cinder metadata identifying the cluster, PV and PVC the provisioner
+// creates the volume for
+func provisionOwnershipMetadata(clusterID string, provisioner string, options controller.VolumeOptions) map[string]string {
+	volumeMeta := OwnershipMetadata(clusterID, provisioner, options.PVName, options.PVC.Namespace, options.PVC.Name)
+	// Tag the volume with the claim it is for, so a retry can find it even if it were renamed
+	if options.PVC.UID != "" {
+		volumeMeta[resources.OsK8sPVCUIDMeta] = string(options.PVC.UID)
+	}
+	return volumeMeta
+}
+
+// CheckOwnership : Makes sure the volume belongs to the PV in this cluster, or only to this cluster if the
+// PV name isn't known. Volumes created before they were tagged with their owner are treated as belonging
+// to whoever references them.
+func CheckOwnership(volume *volumes.Volume, clusterID string, pvName string) error {
+	if owner := volume.Metadata[resources.OsK8sClusterIDMeta]; owner != "" && owner != clusterID {
+		return fmt.Errorf("volume %s belongs to cluster %s, not to this cluster %s", volume.ID, owner, clusterID)
+	}
+	if owner := volume.Metadata[resources.OsK8sPVNameMeta]; owner != "" && pvName != "" && owner != pvName {
+		return fmt.Errorf("volume %s belongs to persistent volume %s, not to %s", volume.ID, owner, pvName)
+	}
+	return nil
+}
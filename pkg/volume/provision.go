@@ -24,6 +24,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 	"github.com/kubernetes-incubator/external-storage/lib/util"
@@ -34,31 +35,48 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+// The prefix of the names of all of the volumes we create
+const volumeNamePrefix = "icp-"
+
 type openstackProvisioner struct {
 	// The unique name for this provisioner
 	ProvisionerName string
+	// Identifies the cluster in the metadata of the volumes it owns
+	ClusterID string
 
 	Client kubernetes.Interface
+	// The OpenStack clients shared by the controller workers, one per set of credentials
+	Clients *utils.ClientCache
 }
 
-// We need to be able to add the multi-attach attribute to the volume creation
-type volumeCreateOpts struct {
-	Name             string `json:"name,omitempty"`
-	Size             int    `json:"size" required:"true"`
-	VolumeType       string `json:"volume_type,omitempty"`
-	AvailabilityZone string `json:"availability_zone,omitempty"`
-	MultiAttach      bool   `json:"multiattach,omitempty"`
+// VolumeCreateOpts : We need to be able to add the multi-attach attribute to the volume creation
+type VolumeCreateOpts struct {
+	Name             string            `json:"name,omitempty"`
+	Size             int               `json:"size" required:"true"`
+	VolumeType       string            `json:"volume_type,omitempty"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	MultiAttach      bool              `json:"multiattach,omitempty"`
+	SnapshotID       string            `json:"snapshot_id,omitempty"`
+	SourceVolID      string            `json:"source_volid,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
 }
 
-func (opts volumeCreateOpts) ToVolumeCreateMap() (map[string]interface{}, error) {
+// ToVolumeCreateMap : Builds the request body for the Cinder volume create call
+func (opts VolumeCreateOpts) ToVolumeCreateMap() (map[string]interface{}, error) {
 	return gophercloud.BuildRequestBody(opts, "volume")
 }
 
 // creates and returns a new provisioner
-func NewOpenstackProvisioner(client kubernetes.Interface, provisionerName string) (controller.Provisioner, error) {
+func NewOpenstackProvisioner(client kubernetes.Interface, provisionerName string, clusterID string,
+	clients *utils.ClientCache) (controller.Provisioner, error) {
+	if clusterID == "" {
+		return nil, errors.New("a cluster ID is needed to tag the volumes the provisioner owns")
+	}
 	provisioner := &openstackProvisioner{
 		ProvisionerName: provisionerName,
+		ClusterID:       clusterID,
 		Client:          client,
+		Clients:         clients,
 	}
 	return provisioner, nil
 }
@@ -84,41 +102,69 @@ func (p *openstackProvisioner) Provision(options controller.VolumeOptions) (*v1.
 	if testParam == "test" {
 		annotations["test"] = "test"
 	}
+	// The StorageClass may name a secret with the credentials of another project or PowerVC to create the volume in
+	secretRef, err := parseSecretRef(options.Parameters, resources.ParamProvisionerSecretName, resources.ParamProvisionerSecretNamespace)
+	if err != nil {
+		return nil, err
+	}
+	// Delete needs the same credentials to find the volume again
+	if secretRef != nil {
+		annotations[resources.ParamProvisionerSecretName] = secretRef.Name
+		annotations[resources.ParamProvisionerSecretNamespace] = secretRef.Namespace
+	}
 	// Creates a new OpenStack Cinder Client and authenticates
-	cinderClient, err := utils.CreateCinderClient(testParam)
+	cinderClient, err := p.newCinderClient(testParam, secretRef)
 	if err != nil {
 		glog.Errorf("Failed to construct / authenticate OpenStack : %s", err)
 		return nil, err
 	}
 
-	// creates the volume
-	volume, err := volumes.Create(cinderClient, opts).Extract()
+	// A volume created from a snapshot can't be smaller than the snapshot
+	if opts.SnapshotID != "" {
+		snapshot, err := snapshots.Get(cinderClient, opts.SnapshotID).Extract()
+		if err != nil {
+			glog.Errorf("Failed to get snapshot %s: %s", opts.SnapshotID, err)
+			return nil, err
+		}
+		if snapshot.Size > opts.Size {
+			return nil, fmt.Errorf("volume options requested %dGB which is smaller than the %dGB snapshot %s",
+				opts.Size, snapshot.Size, opts.SnapshotID)
+		}
+		annotations[resources.OsArgsSnapshotID] = opts.SnapshotID
+	}
+	// A clone has to be at least as big as its source and of the same volume type
+	if opts.SourceVolID != "" {
+		if err := ValidateSourceVolume(cinderClient, opts); err != nil {
+			glog.Errorf("Failed to validate the source volume: %s", err)
+			return nil, err
+		}
+		annotations[resources.OsArgsSourceVolID] = opts.SourceVolID
+	}
+
+	// A previous attempt may have created the volume before failing to hand back the PV, in
+	// which case we adopt that volume rather than leaving it orphaned and creating another one
+	volume, err := FindVolume(cinderClient, opts.Name, opts.Metadata)
 	if err != nil {
-		glog.Errorf("Failed to provision the volume: %s", err)
+		glog.Errorf("Failed to look up existing volume %s: %s", opts.Name, err)
 		return nil, err
 	}
-
-	// If the volume isn't still created yet, we need to wait until it is created
-	if volume.Status != "available" {
-		// Query the volume and wait for it to actually get fully created
-		updVolume, err := utils.GetCinderVolume(cinderClient, volume.ID)
+	if volume != nil {
+		// Never take over a volume another cluster sharing the project created for itself
+		if err := CheckOwnership(volume, p.ClusterID, options.PVName); err != nil {
+			return nil, err
+		}
+		volume, err = adoptVolume(cinderClient, volume, opts)
 		if err != nil {
-			glog.Errorf("Failed to schedule and create the volume: %s", err)
 			return nil, err
 		}
-		if updVolume.Status == "error" {
-			err = errors.New("Unknown error creating volume")
-			if updVolume.Metadata["schedule Failure description"] != "" {
-				err = errors.New(updVolume.Metadata["schedule Failure description"])
-			}
-			// Clean up the volume we just created since it will be orphaned otherwise
-			volumes.Delete(cinderClient, volume.ID)
-			glog.Errorf("Failed to schedule and create the volume: %s", err)
+	}
+	if volume == nil {
+		// creates the volume and waits for it to be scheduled
+		volume, err = CreateVolume(cinderClient, opts)
+		if err != nil {
 			return nil, err
 		}
 	}
-
-	glog.Infof("Volume %s has been created with the following specs: %s", volume.ID, volume)
 	annotations["volumeID"] = volume.ID
 
 	flexVolumeOptions := make(map[string]string)
@@ -144,7 +190,7 @@ func (p *openstackProvisioner) Provision(options controller.VolumeOptions) (*v1.
 				v1.ResourceName(v1.ResourceStorage): resource.MustParse(fmt.Sprintf("%dGi", opts.Size)),
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
-				FlexVolume: &v1.FlexVolumeSource{
+				FlexVolume: &v1.FlexPersistentVolumeSource{
 					Driver:  resources.FlexPluginVendorDriver,
 					Options: flexVolumeOptions,
 					// We want the file system mounted as read-only if they assed for read-only-many
@@ -152,14 +198,118 @@ func (p *openstackProvisioner) Provision(options controller.VolumeOptions) (*v1.
 					FSType:   fsType,
 				},
 			},
+			// Keep the pods using the volume on nodes which can reach the zone of the volume
+			NodeAffinity: zoneNodeAffinity(options, opts.AvailabilityZone),
 		},
 	}
 	return pv, nil
 }
 
+// CreateVolume : Creates the Cinder volume and waits until it has been scheduled and created,
+// removing the volume again if the storage backend failed to create it
+func CreateVolume(cinderClient *gophercloud.ServiceClient, opts VolumeCreateOpts) (*volumes.Volume, error) {
+	volume, err := volumes.Create(cinderClient, opts).Extract()
+	if err != nil {
+		glog.Errorf("Failed to provision the volume: %s", err)
+		return nil, err
+	}
+
+	// If the volume isn't still created yet, we need to wait until it is created
+	if volume.Status != "available" {
+		// Query the volume and wait for it to actually get fully created
+		updVolume, err := utils.GetCinderVolume(cinderClient, volume.ID)
+		if err != nil {
+			glog.Errorf("Failed to schedule and create the volume: %s", err)
+			return nil, err
+		}
+		if updVolume.Status == "error" {
+			err = errors.New("Unknown error creating volume")
+			if updVolume.Metadata["schedule Failure description"] != "" {
+				err = errors.New(updVolume.Metadata["schedule Failure description"])
+			}
+			// Clean up the volume we just created since it will be orphaned otherwise
+			volumes.Delete(cinderClient, volume.ID, volumes.DeleteOpts{})
+			glog.Errorf("Failed to schedule and create the volume: %s", err)
+			return nil, err
+		}
+	}
+
+	glog.Infof("Volume %s has been created with the following specs: %s", volume.ID, volume)
+	return volume, nil
+}
+
+// FindVolume : Returns the volume with the given name, or if there is none the volume tagged with
+// all of the given metadata. Returns nil if there isn't any such volume.
+func FindVolume(cinderClient *gophercloud.ServiceClient, name string, volumeMeta map[string]string) (*volumes.Volume, error) {
+	vols, err := listVolumes(cinderClient, volumes.ListOpts{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	for i := range vols {
+		if vols[i].Name == name {
+			return &vols[i], nil
+		}
+	}
+	if len(volumeMeta) == 0 {
+		return nil, nil
+	}
+	vols, err = listVolumes(cinderClient, volumes.ListOpts{Metadata: volumeMeta})
+	if err != nil {
+		return nil, err
+	}
+	for i := range vols {
+		matches := true
+		for key, value := range volumeMeta {
+			if vols[i].Metadata[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return &vols[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func listVolumes(cinderClient *gophercloud.ServiceClient, listOpts volumes.ListOpts) ([]volumes.Volume, error) {
+	allPages, err := volumes.List(cinderClient, listOpts).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return volumes.ExtractVolumes(allPages)
+}
+
+// adoptVolume : Waits for the volume left behind by a previous attempt to finish creating so it
+// can be reused. Returns nil if the volume failed to create and has been removed.
+func adoptVolume(cinderClient *gophercloud.ServiceClient, volume *volumes.Volume, opts VolumeCreateOpts) (*volumes.Volume, error) {
+	if volume.Size != opts.Size {
+		return nil, fmt.Errorf("volume %s already exists as %s with size %dGB instead of %dGB",
+			opts.Name, volume.ID, volume.Size, opts.Size)
+	}
+	glog.Infof("Adopting volume %s left behind with status %s", volume.ID, volume.Status)
+	updVolume, err := utils.GetCinderVolume(cinderClient, volume.ID)
+	if err != nil {
+		glog.Errorf("Failed to get the volume %s: %s", volume.ID, err)
+		return nil, err
+	}
+	if updVolume.Status == "error" {
+		// The volume is of no use, so clean it up and create it again
+		glog.Infof("Deleting volume %s which failed to create", volume.ID)
+		volumes.Delete(cinderClient, volume.ID, volumes.DeleteOpts{})
+		return nil, nil
+	}
+	return &updVolume.Volume, nil
+}
+
+// VolumeName : We want to always name the volume with the ICP prefix for clarity
+func VolumeName(pvName string) string {
+	return volumeNamePrefix + pvName
+}
+
 // Parses the volume options to populate a struct for the gophercloud create call
-func (p *openstackProvisioner) parseOptions(options controller.VolumeOptions) (volumeCreateOpts, string, error) {
-	var createOptions volumeCreateOpts
+func (p *openstackProvisioner) parseOptions(options controller.VolumeOptions) (VolumeCreateOpts, string, error) {
+	var createOptions VolumeCreateOpts
 	if options.PVC == nil {
 		return createOptions, "", fmt.Errorf("volume options are missing PVC")
 	}
@@ -188,6 +338,9 @@ func (p *openstackProvisioner) parseOptions(options controller.VolumeOptions) (v
 		// We want to make sure to let the fsType option flow through to the flex volume driver
 		case "fstype":
 			fsType = value
+		// The credentials to create the volume with are looked up by Provision
+		case resources.ParamProvisionerSecretName, resources.ParamProvisionerSecretNamespace:
+			continue
 		// This means we are testing, go ahead
 		case "test":
 			continue
@@ -195,22 +348,47 @@ func (p *openstackProvisioner) parseOptions(options controller.VolumeOptions) (v
 			return createOptions, "", fmt.Errorf("volume options unknown parameter passed in: %s", key)
 		}
 	}
+	// The PVC can ask for the volume to be created from a VolumeSnapshot or cloned from another PVC
+	snapshotID := ""
+	sourceVolID := ""
+	if dataSource := options.PVC.Spec.DataSource; dataSource != nil {
+		var err error
+		switch dataSource.Kind {
+		case resources.SnapshotKind:
+			snapshotID, err = p.getSnapshotID(options.PVC.Namespace, dataSource)
+		case pvcKind:
+			sourceVolID, err = p.getSourceVolumeID(options.PVC.Namespace, dataSource, sizeGB)
+		default:
+			err = fmt.Errorf("volume options data source %s is not supported", dataSource.Kind)
+		}
+		if err != nil {
+			return createOptions, "", err
+		}
+		glog.Infof("Volume requested from %s %s", dataSource.Kind, dataSource.Name)
+	}
 	if volumeType == "" {
 		glog.Info("StorageClass parameter, type, is empty")
 	}
 	if availabilityZone == "" {
 		glog.Info("StorageClass parameter, availability, is empty")
 	}
+	// The zone may also come from the node the pod was scheduled to or the allowed topologies
+	availabilityZone, err := chooseAvailabilityZone(options, availabilityZone)
+	if err != nil {
+		return createOptions, "", err
+	}
 	// Determine if this is ReadWriteMany or ReadOnlyMany so that we specify if we want mult-attach
 	multiAttach := util.AccessModesContains(options.PVC.Spec.AccessModes, v1.ReadWriteMany)
 	multiAttach = multiAttach || util.AccessModesContains(options.PVC.Spec.AccessModes, v1.ReadOnlyMany)
 
-	return volumeCreateOpts{
-		// We want to always name the volume with the ICP prefix for clarity
-		Name:             fmt.Sprintf("icp-%s", options.PVName),
+	return VolumeCreateOpts{
+		Name:             VolumeName(options.PVName),
 		Size:             sizeGB,
 		VolumeType:       volumeType,
 		AvailabilityZone: availabilityZone,
 		MultiAttach:      multiAttach,
+		SnapshotID:       snapshotID,
+		SourceVolID:      sourceVolID,
+		Metadata:         provisionOwnershipMetadata(p.ClusterID, p.ProvisionerName, options),
 	}, fsType, nil
 }
@@ -17,14 +17,19 @@ package volume
 import (
 	"testing"
 
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
 	"github.com/IBM/power-openstack-k8s-volume-driver/pkg/testutils"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
 
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
 const (
-	pName = "ibm/test-provisioner"
+	pName         = "ibm/test-provisioner"
+	testClusterID = "test-cluster"
 )
 
 func TestParseOptions(t *testing.T) {
@@ -70,7 +75,7 @@ func TestParseOptions(t *testing.T) {
 		},
 	}
 	fakeClientset := fake.NewSimpleClientset()
-	testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName)
+	testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName, testClusterID, utils.NewClientCache())
 	if err != nil {
 		t.Errorf("failed to create testProvisioner: %v", err)
 	}
@@ -89,9 +94,10 @@ func TestProvision(t *testing.T) {
 	defer testutils.TearDownHTTP()
 
 	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
 
 	fakeClientset := fake.NewSimpleClientset()
-	testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName)
+	testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName, testClusterID, utils.NewClientCache())
 	if err != nil {
 		t.Errorf("failed to create testProvisioner: %v", err)
 	}
@@ -113,3 +119,359 @@ func TestProvision(t *testing.T) {
 
 	testutils.AssertEquals(t, pv.Spec.PersistentVolumeSource.FlexVolume.Driver, "ibm/power-openstack-k8s-volume-flex")
 }
+
+func TestProvisionFromSnapshot(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
+	testutils.MuxHandleGetSnapshot(t, "snap_1", 1)
+	testutils.MuxHandleGetSnapshot(t, "snap_2", 5)
+
+	// Skip looking up the VolumeSnapshot through the API server
+	defer func(lookup func(kubernetes.Interface, string, string) (string, error)) { getSnapshotHandle = lookup }(getSnapshotHandle)
+	getSnapshotHandle = func(client kubernetes.Interface, namespace string, name string) (string, error) {
+		return name, nil
+	}
+
+	tests := []struct {
+		name       string
+		dataSource *v1.TypedLocalObjectReference
+		expected   string
+	}{
+		{
+			name:       "snapshot is the same size",
+			dataSource: testutils.MockSnapshotDataSource("snap_1"),
+			expected:   "",
+		},
+		{
+			name:       "snapshot is larger than the request",
+			dataSource: testutils.MockSnapshotDataSource("snap_2"),
+			expected:   "volume options requested 1GB which is smaller than the 5GB snapshot snap_2",
+		},
+		{
+			name:       "data source is not a snapshot",
+			dataSource: &v1.TypedLocalObjectReference{Kind: "ConfigMap", Name: "test"},
+			expected:   "volume options data source ConfigMap is not supported",
+		},
+	}
+	testProvisioner, err := NewOpenstackProvisioner(fake.NewSimpleClientset(), pName, testClusterID, utils.NewClientCache())
+	if err != nil {
+		t.Errorf("failed to create testProvisioner: %v", err)
+	}
+	for _, test := range tests {
+		pvc := testutils.MockPVC()
+		pvc.Spec.DataSource = test.dataSource
+		volumeOptions := testutils.MockVolumeOptions(testutils.MockReclaimPolicy(), pName, pvc, map[string]string{"test": "test"})
+		pv, err := testProvisioner.Provision(volumeOptions)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: failed to provision volume: %s", test.name, err)
+				continue
+			}
+			testutils.AssertEquals(t, pv.ObjectMeta.Annotations["snapshotID"], "snap_1")
+		} else if err == nil || err.Error() != test.expected {
+			t.Errorf("%s: expected: %s \n received: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestProvisionClone(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
+	testutils.MuxHandleGetVolume(t, "vol_src", 1, "silver")
+
+	sourcePVC, sourcePV := testutils.MockSourcePVC("source", "vol_src", "1Gi", "")
+	largePVC, largePV := testutils.MockSourcePVC("large", "vol_large", "5Gi", "")
+	otherPVC, otherPV := testutils.MockSourcePVC("other", "vol_other", "1Gi", "other")
+	fakeClientset := fake.NewSimpleClientset(sourcePVC, sourcePV, largePVC, largePV, otherPVC, otherPV)
+
+	tests := []struct {
+		name       string
+		source     string
+		parameters map[string]string
+		expected   string
+	}{
+		{
+			name:       "clone of the same type",
+			source:     "source",
+			parameters: map[string]string{"test": "test", "type": "silver"},
+			expected:   "",
+		},
+		{
+			name:       "source is larger than the request",
+			source:     "large",
+			parameters: map[string]string{"test": "test"},
+			expected:   "volume options requested 1GB which is smaller than the 5GB source PVC /large",
+		},
+		{
+			name:       "source is bound in another namespace",
+			source:     "other",
+			parameters: map[string]string{"test": "test"},
+			expected:   "Source PV pv-other is not bound to PVC /other",
+		},
+		{
+			name:       "source is a different type",
+			source:     "source",
+			parameters: map[string]string{"test": "test", "type": "gold"},
+			expected:   "volume options type gold doesn't match the type silver of source volume vol_src",
+		},
+	}
+	testProvisioner, err := NewOpenstackProvisioner(fakeClientset, pName, testClusterID, utils.NewClientCache())
+	if err != nil {
+		t.Errorf("failed to create testProvisioner: %v", err)
+	}
+	for _, test := range tests {
+		pvc := testutils.MockPVC()
+		pvc.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: test.source}
+		volumeOptions := testutils.MockVolumeOptions(testutils.MockReclaimPolicy(), pName, pvc, test.parameters)
+		pv, err := testProvisioner.Provision(volumeOptions)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: failed to provision volume: %s", test.name, err)
+				continue
+			}
+			testutils.AssertEquals(t, pv.ObjectMeta.Annotations["sourceVolumeID"], "vol_src")
+		} else if err == nil || err.Error() != test.expected {
+			t.Errorf("%s: expected: %s \n received: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestProvisionTopology(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	testutils.MuxHandleCreate(t)
+	testutils.MuxHandleListEmpty(t)
+
+	zoneNode := func(label string, zone string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: map[string]string{label: zone}}}
+	}
+	allowedZones := func(zones ...string) []v1.TopologySelectorTerm {
+		return []v1.TopologySelectorTerm{
+			{
+				MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+					{Key: "failure-domain.beta.kubernetes.io/zone", Values: zones},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name         string
+		node         *v1.Node
+		topologies   []v1.TopologySelectorTerm
+		availability string
+		expectedZone string
+		expectedKey  string
+		expected     string
+	}{
+		{
+			name:         "zone of the selected node",
+			node:         zoneNode("topology.kubernetes.io/zone", "zone_1"),
+			expectedZone: "zone_1",
+			expectedKey:  "topology.kubernetes.io/zone",
+		},
+		{
+			name:         "first of the allowed topologies",
+			topologies:   allowedZones("zone_2", "zone_3"),
+			expectedZone: "zone_2",
+			expectedKey:  "failure-domain.beta.kubernetes.io/zone",
+		},
+		{
+			name:         "availability parameter in the allowed topologies",
+			topologies:   allowedZones("zone_2", "zone_3"),
+			availability: "zone_3",
+			expectedZone: "zone_3",
+			expectedKey:  "failure-domain.beta.kubernetes.io/zone",
+		},
+		{
+			name:         "availability parameter without topology",
+			availability: "zone_1",
+			expectedZone: "zone_1",
+			expectedKey:  "",
+		},
+		{
+			name:       "selected node outside the allowed topologies",
+			node:       zoneNode("failure-domain.beta.kubernetes.io/zone", "zone_1"),
+			topologies: allowedZones("zone_2"),
+			expected:   "volume options zone zone_1 of selected node node is not in the allowed topologies",
+		},
+		{
+			name:         "availability parameter conflicts with the selected node",
+			node:         zoneNode("topology.kubernetes.io/zone", "zone_1"),
+			availability: "zone_2",
+			expected:     "volume options availability zone_2 doesn't match zone zone_1 of selected node node",
+		},
+	}
+	testProvisioner, err := NewOpenstackProvisioner(fake.NewSimpleClientset(), pName, testClusterID, utils.NewClientCache())
+	if err != nil {
+		t.Errorf("failed to create testProvisioner: %v", err)
+	}
+	for _, test := range tests {
+		parameters := map[string]string{"test": "test"}
+		if test.availability != "" {
+			parameters["availability"] = test.availability
+		}
+		volumeOptions := testutils.MockVolumeOptions(testutils.MockReclaimPolicy(), pName, testutils.MockPVC(), parameters)
+		volumeOptions.SelectedNode = test.node
+		volumeOptions.AllowedTopologies = test.topologies
+		opts, _, err := testProvisioner.(*openstackProvisioner).parseOptions(volumeOptions)
+		if test.expected != "" {
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("%s: expected: %s \n received: %v", test.name, test.expected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to parse options: %s", test.name, err)
+			continue
+		}
+		testutils.AssertEquals(t, opts.AvailabilityZone, test.expectedZone)
+
+		pv, err := testProvisioner.Provision(volumeOptions)
+		if err != nil {
+			t.Errorf("%s: failed to provision volume: %s", test.name, err)
+			continue
+		}
+		if test.expectedKey == "" {
+			if pv.Spec.NodeAffinity != nil {
+				t.Errorf("%s: expected no node affinity, but got %v", test.name, pv.Spec.NodeAffinity)
+			}
+			continue
+		}
+		requirement := pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0]
+		testutils.AssertEquals(t, requirement.Key, test.expectedKey)
+		testutils.AssertEquals(t, requirement.Values[0], test.expectedZone)
+	}
+}
+
+func TestProvisionAdoptsExistingVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeMeta map[string]string
+		expected   bool
+	}{
+		{
+			name:       "volume left behind by this cluster",
+			volumeMeta: map[string]string{resources.OsK8sClusterIDMeta: testClusterID},
+			expected:   true,
+		},
+		{
+			name:       "volume owned by another cluster",
+			volumeMeta: map[string]string{resources.OsK8sClusterIDMeta: "other-cluster"},
+			expected:   false,
+		},
+	}
+	for _, test := range tests {
+		testutils.SetupHTTP()
+
+		// No create handler is registered, so creating another volume would fail the provision
+		testutils.MuxHandleListVolume(t, "icp-existing", "icp-"+pName, "available", test.volumeMeta)
+		testutils.MuxHandleGetVolume(t, "icp-existing", 1, "")
+
+		testProvisioner, err := NewOpenstackProvisioner(fake.NewSimpleClientset(), pName, testClusterID, utils.NewClientCache())
+		if err != nil {
+			t.Errorf("failed to create testProvisioner: %v", err)
+		}
+		volumeOptions := testutils.MockVolumeOptions(testutils.MockReclaimPolicy(), pName, testutils.MockPVC(), map[string]string{"test": "test"})
+		pv, err := testProvisioner.Provision(volumeOptions)
+		if !test.expected {
+			if err == nil {
+				t.Errorf("%s: expected the provision to fail", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: failed to provision volume: %s", test.name, err)
+		} else {
+			testutils.AssertEquals(t, pv.ObjectMeta.Annotations["volumeID"], "icp-existing")
+		}
+		testutils.TearDownHTTP()
+	}
+}
+
+func TestProvisionOwnershipMetadata(t *testing.T) {
+	// The provisioner can be deployed under another name than the default
+	testProvisioner, err := NewOpenstackProvisioner(fake.NewSimpleClientset(), "ibm/custom-provisioner", testClusterID, utils.NewClientCache())
+	if err != nil {
+		t.Errorf("failed to create testProvisioner: %v", err)
+	}
+	pvc := testutils.MockPVC()
+	volumeOptions := testutils.MockVolumeOptions(testutils.MockReclaimPolicy(), pName, pvc, map[string]string{"test": "test"})
+	opts, _, err := testProvisioner.(*openstackProvisioner).parseOptions(volumeOptions)
+	if err != nil {
+		t.Fatalf("failed to parse options: %s", err)
+	}
+	testutils.AssertEquals(t, opts.Metadata[resources.OsK8sClusterIDMeta], testClusterID)
+	testutils.AssertEquals(t, opts.Metadata[resources.OsK8sPVNameMeta], pName)
+	testutils.AssertEquals(t, opts.Metadata[resources.OsK8sPVCNamespaceMeta], pvc.Namespace)
+	testutils.AssertEquals(t, opts.Metadata[resources.OsK8sPVCNameMeta], pvc.Name)
+	testutils.AssertEquals(t, opts.Metadata[resources.OsK8sProvisionerMeta], "ibm/custom-provisioner")
+}
+
+func TestNewOpenstackProvisionerNeedsClusterID(t *testing.T) {
+	if _, err := NewOpenstackProvisioner(fake.NewSimpleClientset(), pName, "", utils.NewClientCache()); err == nil {
+		t.Errorf("expected the provisioner to need a cluster ID")
+	}
+}
+
+func TestProvisionWithSecret(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "powervc-creds", Namespace: "storage"},
+		Data:       map[string][]byte{resources.OSAuthURL: []byte("https://auth.url")},
+	}
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		expected   string
+	}{
+		{
+			name: "secret of the storage class",
+			parameters: map[string]string{
+				resources.ParamProvisionerSecretName:      "powervc-creds",
+				resources.ParamProvisionerSecretNamespace: "storage",
+			},
+		},
+		{
+			name:       "secret without a namespace",
+			parameters: map[string]string{resources.ParamProvisionerSecretName: "powervc-creds"},
+			expected:   "volume options need both the provisioner-secret-name and provisioner-secret-namespace parameters",
+		},
+		{
+			name: "secret doesn't exist",
+			parameters: map[string]string{
+				resources.ParamProvisionerSecretName:      "missing",
+				resources.ParamProvisionerSecretNamespace: "storage",
+			},
+			expected: "Could not get secret storage/missing. Error is secrets \"missing\" not found",
+		},
+	}
+	for _, test := range tests {
+		testutils.SetupHTTP()
+		testutils.MuxHandleCreate(t)
+		testutils.MuxHandleListEmpty(t)
+
+		testProvisioner, err := NewOpenstackProvisioner(fake.NewSimpleClientset(secret), pName, testClusterID, utils.NewClientCache())
+		if err != nil {
+			t.Errorf("failed to create testProvisioner: %v", err)
+		}
+		test.parameters["test"] = "test"
+		volumeOptions := testutils.MockVolumeOptions(testutils.MockReclaimPolicy(), pName, testutils.MockPVC(), test.parameters)
+		pv, err := testProvisioner.Provision(volumeOptions)
+		if test.expected != "" {
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("%s: expected: %s \n received: %v", test.name, test.expected, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: failed to provision volume: %s", test.name, err)
+		} else {
+			// Delete has to find the secret again from the PV
+			testutils.AssertEquals(t, provisionerSecretRef(pv).Name, "powervc-creds")
+			testutils.AssertEquals(t, provisionerSecretRef(pv).Namespace, "storage")
+		}
+		testutils.TearDownHTTP()
+	}
+}
@@ -0,0 +1,274 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"strings"
+	"time"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// Event reasons for the orphans found by the reconciler
+	reasonOrphanedVolume = "OrphanedVolume"
+	reasonVolumeMissing  = "VolumeMissing"
+	reasonOrphanDeleted  = "OrphanDeleted"
+
+	// Metric labels for the two kinds of orphans
+	orphanKindCinder = "cinder"
+	orphanKindPV     = "pv"
+)
+
+var (
+	orphanedVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "power_openstack_orphaned_volumes",
+		Help: "Number of Cinder volumes without a PV (cinder) and PVs without a Cinder volume (pv) found in the last reconcile.",
+	}, []string{"kind"})
+	deletedOrphans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "power_openstack_orphaned_volumes_deleted_total",
+		Help: "Number of orphaned Cinder volumes (cinder) and PVs (pv) deleted by the reconciler.",
+	}, []string{"kind"})
+	reconcileErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "power_openstack_reconcile_errors_total",
+		Help: "Number of reconciles which failed to compare the Cinder volumes with the PVs.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(orphanedVolumes, deletedOrphans, reconcileErrors)
+}
+
+// Reconciler : Periodically compares the Cinder volumes created by the provisioner with the PVs in the
+// cluster, reporting orphans on either side and optionally deleting them after a grace period
+type Reconciler struct {
+	// How long something has to stay orphaned before it is deleted
+	GracePeriod time.Duration
+	// Whether orphans are deleted after the grace period, otherwise they are only reported
+	DeleteOrphans bool
+
+	clusterID       string
+	client          kubernetes.Interface
+	newCinderClient func() (*gophercloud.ServiceClient, error)
+	recorder        record.EventRecorder
+	// When each orphan was first found, keyed by the Cinder volume ID or the PV name
+	firstSeen map[string]time.Time
+}
+
+// NewReconciler : Creates a reconciler for the volumes of the cluster, which gets a Cinder client
+// from newCinderClient for each reconcile
+func NewReconciler(clusterID string, client kubernetes.Interface, newCinderClient func() (*gophercloud.ServiceClient, error),
+	recorder record.EventRecorder, gracePeriod time.Duration, deleteOrphans bool) *Reconciler {
+	return &Reconciler{
+		GracePeriod:     gracePeriod,
+		DeleteOrphans:   deleteOrphans,
+		clusterID:       clusterID,
+		client:          client,
+		newCinderClient: newCinderClient,
+		recorder:        recorder,
+		firstSeen:       make(map[string]time.Time),
+	}
+}
+
+// Run : Reconciles every interval until the stop channel is closed
+func (r *Reconciler) Run(interval time.Duration, stopCh <-chan struct{}) {
+	glog.Infof("Reconciling orphaned volumes every %s", interval)
+	wait.Until(r.Reconcile, interval, stopCh)
+}
+
+// Reconcile : Compares the Cinder volumes with the PVs once
+func (r *Reconciler) Reconcile() {
+	if err := r.reconcile(); err != nil {
+		reconcileErrors.Inc()
+		glog.Errorf("Failed to reconcile orphaned volumes: %s", err)
+	}
+}
+
+func (r *Reconciler) reconcile() error {
+	cinderClient, err := r.newCinderClient()
+	if err != nil {
+		return err
+	}
+	vols, err := listVolumes(cinderClient, volumes.ListOpts{})
+	if err != nil {
+		return err
+	}
+	pvList, err := r.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	existingVols := make(map[string]bool)
+	for _, vol := range vols {
+		existingVols[vol.ID] = true
+	}
+	// Any PV may be using a Cinder volume, not just the ones we provisioned
+	usedVols := make(map[string]bool)
+	ambiguousPVs := 0
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if volumeID := pvVolumeID(pv); volumeID != "" {
+			usedVols[volumeID] = true
+		} else if pvOfDriver(pv) {
+			ambiguousPVs++
+		}
+	}
+	// A PV of ours whose volume can't be told could be using any of the orphans, so none are deleted
+	if ambiguousPVs > 0 {
+		glog.Warningf("Could not find the Cinder volume of %d persistent volumes, orphaned volumes will not be deleted", ambiguousPVs)
+	}
+
+	now := time.Now()
+	orphans := make(map[string]bool)
+	cinderOrphans, pvOrphans := 0, 0
+	for i := range vols {
+		vol := &vols[i]
+		if !strings.HasPrefix(vol.Name, volumeNamePrefix) || usedVols[vol.ID] {
+			continue
+		}
+		// Other clusters sharing the project have their own PVs for their volumes
+		owner := vol.Metadata[resources.OsK8sClusterIDMeta]
+		if owner != "" && owner != r.clusterID {
+			continue
+		}
+		// Volumes still being created may not have their PV yet, and deleting ones are on their way out
+		if vol.Status == "creating" || vol.Status == "deleting" {
+			continue
+		}
+		cinderOrphans++
+		orphans[vol.ID] = true
+		// Volumes from before the ownership tags could still belong to another cluster, so they are only reported
+		if r.orphanedLongEnough(vol.ID, now) && vol.Status == "available" && owner == r.clusterID && ambiguousPVs == 0 {
+			r.deleteVolume(cinderClient, vol)
+			continue
+		}
+		r.recorder.Eventf(volumePVReference(vol), v1.EventTypeWarning, reasonOrphanedVolume,
+			"Cinder volume %s (%s) is not used by any persistent volume", vol.Name, vol.ID)
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		volumeID := pvVolumeID(pv)
+		if pv.Annotations[resources.K8sCreatedBy] != resources.ProvisionerNameOnly || volumeID == "" || existingVols[volumeID] {
+			continue
+		}
+		// Volumes provisioned with the credentials of a StorageClass secret may live in another project
+		if provisionerSecretRef(pv) != nil {
+			continue
+		}
+		pvOrphans++
+		orphans[pv.Name] = true
+		// PVs which are still bound to a claim are in use by a workload, so they are left for a person to look at
+		if r.orphanedLongEnough(pv.Name, now) && pv.Status.Phase != v1.VolumeBound {
+			r.deletePV(pv)
+			continue
+		}
+		r.recorder.Eventf(pv, v1.EventTypeWarning, reasonVolumeMissing,
+			"Cinder volume %s of the persistent volume no longer exists", volumeID)
+	}
+
+	// Forget the orphans which have been deleted or aren't orphaned anymore
+	for key := range r.firstSeen {
+		if !orphans[key] {
+			delete(r.firstSeen, key)
+		}
+	}
+	orphanedVolumes.WithLabelValues(orphanKindCinder).Set(float64(cinderOrphans))
+	orphanedVolumes.WithLabelValues(orphanKindPV).Set(float64(pvOrphans))
+	glog.Infof("Reconciled %d volumes and %d persistent volumes, found %d orphaned volumes and %d orphaned persistent volumes",
+		len(vols), len(pvList.Items), cinderOrphans, pvOrphans)
+	return nil
+}
+
+// orphanedLongEnough : Records when the orphan was first found and returns whether it
+// has been orphaned for the grace period and should be deleted
+func (r *Reconciler) orphanedLongEnough(key string, now time.Time) bool {
+	firstSeen, ok := r.firstSeen[key]
+	if !ok {
+		firstSeen = now
+		r.firstSeen[key] = now
+	}
+	return r.DeleteOrphans && now.Sub(firstSeen) >= r.GracePeriod
+}
+
+func (r *Reconciler) deleteVolume(cinderClient *gophercloud.ServiceClient, vol *volumes.Volume) {
+	glog.Infof("Deleting orphaned volume %s (%s)", vol.Name, vol.ID)
+	if err := volumes.Delete(cinderClient, vol.ID, volumes.DeleteOpts{}).ExtractErr(); err != nil {
+		glog.Errorf("Failed to delete orphaned volume %s: %s", vol.ID, err)
+		return
+	}
+	deletedOrphans.WithLabelValues(orphanKindCinder).Inc()
+	r.recorder.Eventf(volumePVReference(vol), v1.EventTypeNormal, reasonOrphanDeleted,
+		"Deleted Cinder volume %s (%s) which was not used by any persistent volume", vol.Name, vol.ID)
+}
+
+func (r *Reconciler) deletePV(pv *v1.PersistentVolume) {
+	glog.Infof("Deleting persistent volume %s whose volume no longer exists", pv.Name)
+	if err := r.client.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{}); err != nil {
+		glog.Errorf("Failed to delete orphaned persistent volume %s: %s", pv.Name, err)
+		return
+	}
+	deletedOrphans.WithLabelValues(orphanKindPV).Inc()
+	r.recorder.Eventf(pv, v1.EventTypeNormal, reasonOrphanDeleted,
+		"Deleted persistent volume whose Cinder volume %s no longer exists", pvVolumeID(pv))
+}
+
+// pvVolumeID : Returns the ID of the Cinder volume backing the PV, whether it is a flex, CSI or in-tree
+// Cinder volume. The CSI driver name is configurable, so the handle of any CSI volume is taken, which
+// can only keep a volume from being seen as orphaned
+func pvVolumeID(pv *v1.PersistentVolume) string {
+	if volumeID := pv.Annotations[resources.OsArgsVolID]; volumeID != "" {
+		return volumeID
+	}
+	if pv.Spec.FlexVolume != nil && pv.Spec.FlexVolume.Options[resources.OsArgsVolID] != "" {
+		return pv.Spec.FlexVolume.Options[resources.OsArgsVolID]
+	}
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.VolumeHandle
+	}
+	if pv.Spec.Cinder != nil {
+		return pv.Spec.Cinder.VolumeID
+	}
+	return ""
+}
+
+// pvOfDriver : Returns whether the PV was provisioned by us or is mounted by our flex plugin,
+// in which case it uses a Cinder volume even when pvVolumeID can't tell which one
+func pvOfDriver(pv *v1.PersistentVolume) bool {
+	if pv.Annotations[resources.K8sCreatedBy] == resources.ProvisionerNameOnly {
+		return true
+	}
+	return pv.Spec.FlexVolume != nil && pv.Spec.FlexVolume.Driver == resources.FlexPluginVendorDriver
+}
+
+// volumePVReference : The orphaned volume has no object of its own in the cluster, so its events
+// are recorded against the PV it was named after
+func volumePVReference(vol *volumes.Volume) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "PersistentVolume",
+		APIVersion: "v1",
+		Name:       strings.TrimPrefix(vol.Name, volumeNamePrefix),
+	}
+}
@@ -0,0 +1,241 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	"github.com/IBM/power-openstack-k8s-volume-driver/pkg/testutils"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+
+	"github.com/gophercloud/gophercloud"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestReconciler(gracePeriod time.Duration, deleteOrphans bool, objects ...runtime.Object) (*Reconciler, *record.FakeRecorder) {
+	recorder := record.NewFakeRecorder(10)
+	newCinderClient := func() (*gophercloud.ServiceClient, error) {
+		return utils.CreateCinderClient("test")
+	}
+	return NewReconciler(testClusterID, fake.NewSimpleClientset(objects...), newCinderClient, recorder, gracePeriod, deleteOrphans), recorder
+}
+
+// Returns the reasons of the events recorded so far
+func recordedReasons(recorder *record.FakeRecorder) []string {
+	var reasons []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			// The fake recorder formats events as "<type> <reason> <message>"
+			reasons = append(reasons, strings.Fields(event)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func orphanedPV(phase v1.PersistentVolumePhase) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv-orphan",
+			Annotations: map[string]string{
+				resources.K8sCreatedBy: resources.ProvisionerNameOnly,
+				resources.OsArgsVolID:  "vol-missing",
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func TestReconcileCinderOrphans(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeName    string
+		status        string
+		volumeMeta    map[string]string
+		gracePeriod   time.Duration
+		deleteOrphans bool
+		expected      []string
+	}{
+		{
+			name:       "orphan is only reported by default",
+			volumeName: "icp-pv-1",
+			status:     "available",
+			expected:   []string{reasonOrphanedVolume},
+		},
+		{
+			name:          "orphan is deleted after the grace period",
+			volumeName:    "icp-pv-1",
+			status:        "available",
+			volumeMeta:    map[string]string{resources.OsK8sClusterIDMeta: testClusterID},
+			deleteOrphans: true,
+			expected:      []string{reasonOrphanDeleted},
+		},
+		{
+			name:          "orphan from before the ownership tags is only reported",
+			volumeName:    "icp-pv-1",
+			status:        "available",
+			deleteOrphans: true,
+			expected:      []string{reasonOrphanedVolume},
+		},
+		{
+			name:          "volume of another cluster is ignored",
+			volumeName:    "icp-pv-1",
+			status:        "available",
+			volumeMeta:    map[string]string{resources.OsK8sClusterIDMeta: "other-cluster"},
+			deleteOrphans: true,
+		},
+		{
+			name:          "orphan is kept during the grace period",
+			volumeName:    "icp-pv-1",
+			status:        "available",
+			gracePeriod:   time.Hour,
+			deleteOrphans: true,
+			expected:      []string{reasonOrphanedVolume},
+		},
+		{
+			name:          "attached orphan is not deleted",
+			volumeName:    "icp-pv-1",
+			status:        "in-use",
+			deleteOrphans: true,
+			expected:      []string{reasonOrphanedVolume},
+		},
+		{
+			name:          "volume still being created is ignored",
+			volumeName:    "icp-pv-1",
+			status:        "creating",
+			deleteOrphans: true,
+		},
+		{
+			name:          "volume not created by the provisioner is ignored",
+			volumeName:    "database",
+			status:        "available",
+			deleteOrphans: true,
+		},
+	}
+	for _, test := range tests {
+		testutils.SetupHTTP()
+		testutils.MuxHandleListVolume(t, "vol-orphan", test.volumeName, test.status, test.volumeMeta)
+		testutils.MuxHandleDelete(t, "vol-orphan")
+
+		reconciler, recorder := newTestReconciler(test.gracePeriod, test.deleteOrphans)
+		if err := reconciler.reconcile(); err != nil {
+			t.Errorf("%s: failed to reconcile: %s", test.name, err)
+		}
+		testutils.AssertEquals(t, strings.Join(recordedReasons(recorder), ","), strings.Join(test.expected, ","))
+		testutils.TearDownHTTP()
+	}
+}
+
+func TestReconcileVolumeInUse(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	pv := testutils.MockPV()
+	testutils.MuxHandleListVolume(t, pv.Annotations[resources.OsArgsVolID], "icp-"+pv.Name, "in-use", nil)
+
+	reconciler, recorder := newTestReconciler(0, true, pv)
+	if err := reconciler.reconcile(); err != nil {
+		t.Fatalf("failed to reconcile: %s", err)
+	}
+	testutils.AssertEquals(t, len(recordedReasons(recorder)), 0)
+}
+
+func TestReconcilePVOrphans(t *testing.T) {
+	resources.UpdateDriverPrefix("power-openstack-k8s")
+	tests := []struct {
+		name     string
+		phase    v1.PersistentVolumePhase
+		deleted  bool
+		expected string
+	}{
+		{
+			name:     "released PV is deleted",
+			phase:    v1.VolumeReleased,
+			deleted:  true,
+			expected: reasonOrphanDeleted,
+		},
+		{
+			name:     "bound PV is only reported",
+			phase:    v1.VolumeBound,
+			expected: reasonVolumeMissing,
+		},
+	}
+	for _, test := range tests {
+		testutils.SetupHTTP()
+		testutils.MuxHandleListEmpty(t)
+
+		reconciler, recorder := newTestReconciler(0, true, orphanedPV(test.phase))
+		if err := reconciler.reconcile(); err != nil {
+			t.Errorf("%s: failed to reconcile: %s", test.name, err)
+		}
+		testutils.AssertEquals(t, strings.Join(recordedReasons(recorder), ","), test.expected)
+		_, err := reconciler.client.CoreV1().PersistentVolumes().Get("pv-orphan", metav1.GetOptions{})
+		testutils.AssertEquals(t, err != nil, test.deleted)
+		testutils.TearDownHTTP()
+	}
+}
+
+func TestReconcileCSIVolumeInUse(t *testing.T) {
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	// The CSI driver can be deployed under any name
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-csi"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "custom-csi-driver", VolumeHandle: "vol-csi"},
+			},
+		},
+	}
+	testutils.MuxHandleListVolume(t, "vol-csi", "icp-pv-csi", "available", map[string]string{resources.OsK8sClusterIDMeta: testClusterID})
+
+	reconciler, recorder := newTestReconciler(0, true, pv)
+	if err := reconciler.reconcile(); err != nil {
+		t.Fatalf("failed to reconcile: %s", err)
+	}
+	testutils.AssertEquals(t, len(recordedReasons(recorder)), 0)
+}
+
+func TestReconcileAmbiguousPV(t *testing.T) {
+	resources.UpdateDriverPrefix("power-openstack-k8s")
+	testutils.SetupHTTP()
+	defer testutils.TearDownHTTP()
+
+	// A PV of ours without a volume ID could be using the orphan, which is then only reported
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pv-unknown",
+			Annotations: map[string]string{resources.K8sCreatedBy: resources.ProvisionerNameOnly},
+		},
+	}
+	testutils.MuxHandleListVolume(t, "vol-orphan", "icp-pv-1", "available", map[string]string{resources.OsK8sClusterIDMeta: testClusterID})
+	testutils.MuxHandleDelete(t, "vol-orphan")
+
+	reconciler, recorder := newTestReconciler(0, true, pv)
+	if err := reconciler.reconcile(); err != nil {
+		t.Fatalf("failed to reconcile: %s", err)
+	}
+	testutils.AssertEquals(t, strings.Join(recordedReasons(recorder), ","), reasonOrphanedVolume)
+}
@@ -0,0 +1,81 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"fmt"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+	utils "github.com/IBM/power-openstack-k8s-volume-driver/pkg/utils"
+
+	"github.com/gophercloud/gophercloud"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// parseSecretRef : Returns the secret named by the pair of StorageClass parameters, or nil if neither is set
+func parseSecretRef(parameters map[string]string, nameKey string, namespaceKey string) (*v1.SecretReference, error) {
+	name, namespace := parameters[nameKey], parameters[namespaceKey]
+	if name == "" && namespace == "" {
+		return nil, nil
+	}
+	if name == "" || namespace == "" {
+		return nil, fmt.Errorf("volume options need both the %s and %s parameters", nameKey, namespaceKey)
+	}
+	return &v1.SecretReference{Name: name, Namespace: namespace}, nil
+}
+
+// GetSecretData : Returns the data of the secret as strings
+func GetSecretData(client kubernetes.Interface, secretRef *v1.SecretReference) (map[string]string, error) {
+	secret, err := client.CoreV1().Secrets(secretRef.Namespace).Get(secretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Could not get secret %s/%s. Error is %s", secretRef.Namespace, secretRef.Name, err)
+	}
+	secretData := make(map[string]string)
+	for key, value := range secret.Data {
+		secretData[key] = string(value)
+	}
+	return secretData, nil
+}
+
+// newCinderClient : Returns a Cinder client authenticated with the credentials in the secret, or with the
+// credentials of the provisioner when there is no secret. The token is shared with the earlier calls
+// that used the same credentials.
+func (p *openstackProvisioner) newCinderClient(testParam string, secretRef *v1.SecretReference) (*gophercloud.ServiceClient, error) {
+	var secretData map[string]string
+	if secretRef != nil {
+		var err error
+		if secretData, err = GetSecretData(p.Client, secretRef); err != nil {
+			return nil, err
+		}
+	}
+	if testParam != "" {
+		return utils.CreateCinderClient(testParam)
+	}
+	return p.Clients.GetCinderClient(secretData)
+}
+
+// provisionerSecretRef : Returns the secret the PV was provisioned with, or nil if it used the provisioner's credentials.
+// There is no attach secret: Kubernetes doesn't pass secrets to FlexVolume attach calls, so the plugin attaches
+// with the credentials of the node.
+func provisionerSecretRef(pv *v1.PersistentVolume) *v1.SecretReference {
+	name := pv.Annotations[resources.ParamProvisionerSecretName]
+	if name == "" {
+		return nil
+	}
+	return &v1.SecretReference{Name: name, Namespace: pv.Annotations[resources.ParamProvisionerSecretNamespace]}
+}
@@ -0,0 +1,71 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// getSnapshotHandle : Holds the function used to look up the Cinder snapshot of a VolumeSnapshot
+var getSnapshotHandle = lookupSnapshotHandle
+
+// Returns the Cinder snapshot ID of the VolumeSnapshot the PVC is requested to be created from
+func (p *openstackProvisioner) getSnapshotID(namespace string, dataSource *v1.TypedLocalObjectReference) (string, error) {
+	if dataSource.APIGroup == nil || *dataSource.APIGroup != resources.SnapshotAPIGroup {
+		return "", fmt.Errorf("volume options data source %s is not supported", dataSource.Kind)
+	}
+	return getSnapshotHandle(p.Client, namespace, dataSource.Name)
+}
+
+// lookupSnapshotHandle : The VolumeSnapshot is bound to a VolumeSnapshotContent, which holds the
+// ID of the Cinder snapshot as its snapshot handle
+func lookupSnapshotHandle(client kubernetes.Interface, namespace string, name string) (string, error) {
+	// The snapshot types are CRDs, so we make the REST calls for them ourselves
+	restClient := client.CoreV1().RESTClient()
+	body, err := restClient.Get().AbsPath("/apis", resources.SnapshotAPIGroup, resources.SnapshotAPIVersion,
+		"namespaces", namespace, "volumesnapshots", name).DoRaw()
+	if err != nil {
+		return "", fmt.Errorf("Could not get volume snapshot %s/%s. Error is %s", namespace, name, err)
+	}
+	var snapshot resources.VolumeSnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return "", fmt.Errorf("Could not parse volume snapshot %s/%s. Error is %s", namespace, name, err)
+	}
+	if snapshot.Status == nil || snapshot.Status.ReadyToUse == nil || !*snapshot.Status.ReadyToUse ||
+		snapshot.Status.BoundVolumeSnapshotContentName == nil {
+		return "", fmt.Errorf("Volume snapshot %s/%s is not ready to use yet", namespace, name)
+	}
+
+	contentName := *snapshot.Status.BoundVolumeSnapshotContentName
+	body, err = restClient.Get().AbsPath("/apis", resources.SnapshotAPIGroup, resources.SnapshotAPIVersion,
+		"volumesnapshotcontents", contentName).DoRaw()
+	if err != nil {
+		return "", fmt.Errorf("Could not get volume snapshot content %s. Error is %s", contentName, err)
+	}
+	var content resources.VolumeSnapshotContent
+	if err := json.Unmarshal(body, &content); err != nil {
+		return "", fmt.Errorf("Could not parse volume snapshot content %s. Error is %s", contentName, err)
+	}
+	if content.Status == nil || content.Status.SnapshotHandle == nil {
+		return "", fmt.Errorf("Volume snapshot content %s has no snapshot handle", contentName)
+	}
+	return *content.Status.SnapshotHandle, nil
+}
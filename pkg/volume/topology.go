@@ -0,0 +1,146 @@
+/*
+  Copyright IBM Corp. 2018, 2019.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+package volume
+
+import (
+	"fmt"
+
+	resources "github.com/IBM/power-openstack-k8s-volume-driver/pkg/resources"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+
+	"k8s.io/api/core/v1"
+)
+
+// The labels a zone can be given with, in the order we look for them
+var zoneLabels = []string{resources.K8sLabelZone, resources.K8sLabelZoneBeta}
+
+// chooseAvailabilityZone : Picks the Cinder availability zone for the volume. The zone of the node
+// the pod was scheduled to wins, then the availability parameter of the storage class, and then
+// the first of the allowed topologies of the storage class.
+func chooseAvailabilityZone(options controller.VolumeOptions, availabilityZone string) (string, error) {
+	allowedZones := allowedTopologyZones(options.AllowedTopologies)
+
+	if options.SelectedNode != nil {
+		if _, zone := nodeZone(options.SelectedNode); zone != "" {
+			if availabilityZone != "" && availabilityZone != zone {
+				return "", fmt.Errorf("volume options availability %s doesn't match zone %s of selected node %s",
+					availabilityZone, zone, options.SelectedNode.Name)
+			}
+			if len(allowedZones) > 0 && !containsZone(allowedZones, zone) {
+				return "", fmt.Errorf("volume options zone %s of selected node %s is not in the allowed topologies",
+					zone, options.SelectedNode.Name)
+			}
+			return zone, nil
+		}
+	}
+	if availabilityZone != "" {
+		if len(allowedZones) > 0 && !containsZone(allowedZones, availabilityZone) {
+			return "", fmt.Errorf("volume options availability %s is not in the allowed topologies", availabilityZone)
+		}
+		return availabilityZone, nil
+	}
+	if len(allowedZones) > 0 {
+		return allowedZones[0], nil
+	}
+	return "", nil
+}
+
+// zoneNodeAffinity : Returns the node affinity that keeps pods using the volume on nodes in the zone
+// of the volume, or nil if the zone didn't come from the topology of the cluster
+func zoneNodeAffinity(options controller.VolumeOptions, zone string) *v1.VolumeNodeAffinity {
+	if zone == "" {
+		return nil
+	}
+	// Use the same label the cluster gave us the zone with, so the nodes are sure to have it
+	zoneKey := ""
+	if options.SelectedNode != nil {
+		zoneKey, _ = nodeZone(options.SelectedNode)
+	}
+	if zoneKey == "" {
+		zoneKey = allowedTopologyZoneKey(options.AllowedTopologies)
+	}
+	if zoneKey == "" {
+		return nil
+	}
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{
+					MatchExpressions: []v1.NodeSelectorRequirement{
+						{
+							Key:      zoneKey,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{zone},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// nodeZone : Returns the zone label of the node along with its value
+func nodeZone(node *v1.Node) (string, string) {
+	for _, label := range zoneLabels {
+		if zone := node.Labels[label]; zone != "" {
+			return label, zone
+		}
+	}
+	return "", ""
+}
+
+// allowedTopologyZones : Returns all of the zones allowed by the topologies
+func allowedTopologyZones(terms []v1.TopologySelectorTerm) []string {
+	var zones []string
+	for _, term := range terms {
+		for _, expr := range term.MatchLabelExpressions {
+			if isZoneLabel(expr.Key) {
+				zones = append(zones, expr.Values...)
+			}
+		}
+	}
+	return zones
+}
+
+// allowedTopologyZoneKey : Returns the zone label used by the topologies
+func allowedTopologyZoneKey(terms []v1.TopologySelectorTerm) string {
+	for _, term := range terms {
+		for _, expr := range term.MatchLabelExpressions {
+			if isZoneLabel(expr.Key) {
+				return expr.Key
+			}
+		}
+	}
+	return ""
+}
+
+func isZoneLabel(key string) bool {
+	for _, label := range zoneLabels {
+		if key == label {
+			return true
+		}
+	}
+	return false
+}
+
+func containsZone(zones []string, zone string) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}